@@ -0,0 +1,139 @@
+package gdb
+
+import (
+	"sync/atomic"
+)
+
+const (
+	kArenaBlockSize = 4096
+	// allocations larger than this get a block of their own, so that
+	// not much of the current block is wasted
+	kArenaMaxSharedAlloc = kArenaBlockSize / 4
+	kArenaAlignment      = 8
+)
+
+// arena hands out memory from byte blocks owned by it. Blocks are
+// allocated in Go heap and never hold Go pointers, so the garbage
+// collector neither needs to scan them nor can free memory still in
+// use. Data that refers to other data in the arena stores offsets.
+//
+// An offset keeps the index of a block in its high 32 bits and the
+// position in the block in its low 32 bits. Offset 0 is never handed
+// out and works as nil.
+//
+// allocate must not be called by more than one goroutine at a time,
+// while offsets can be resolved by any number of goroutines
+type arena struct {
+	// a [][]byte, which is replaced as a whole when a block is added
+	// so that readers can resolve offsets without a lock
+	blocks atomic.Value
+	// number of bytes used in the last shared block
+	used int
+	// index of the block shared by small allocations
+	current int
+	// number of bytes taken by allocations and their alignment
+	// padding, updated atomically
+	allocated int64
+	// total size of blocks, updated atomically
+	reserved int64
+	// if not nil, blocks are charged to it
+	manager *WriteBufferManager
+	// true if markImmutable has been called
+	immutable bool
+}
+
+// Create an arena. Its blocks are charged to @manager unless it is nil
+func makeArena(manager *WriteBufferManager) *arena {
+	ret := &arena{}
+	ret.manager = manager
+	if manager != nil {
+		manager.addMemTable()
+	}
+	ret.blocks.Store([][]byte{})
+	ret.current = ret.addBlock(kArenaBlockSize)
+	// reserve offset 0 for nil
+	ret.used = kArenaAlignment
+	ret.allocated = kArenaAlignment
+	return ret
+}
+
+func (a *arena) loadBlocks() [][]byte {
+	return a.blocks.Load().([][]byte)
+}
+
+// add a block of @size bytes, return its index
+func (a *arena) addBlock(size int) int {
+	old := a.loadBlocks()
+	blocks := make([][]byte, len(old), len(old)+1)
+	copy(blocks, old)
+	blocks = append(blocks, make([]byte, size))
+
+	a.blocks.Store(blocks)
+	atomic.AddInt64(&a.reserved, int64(size))
+	if a.manager != nil {
+		a.manager.reserveMem(size)
+	}
+	return len(blocks) - 1
+}
+
+// allocate @size bytes aligned to kArenaAlignment, return the offset
+// of the space
+func (a *arena) allocate(size int) uint64 {
+	if size > kArenaMaxSharedAlloc {
+		atomic.AddInt64(&a.allocated, int64(size))
+		return uint64(a.addBlock(size)) << 32
+	}
+
+	start := (a.used + kArenaAlignment - 1) &^ (kArenaAlignment - 1)
+	if start+size > kArenaBlockSize {
+		a.current = a.addBlock(kArenaBlockSize)
+		a.used, start = 0, 0
+	}
+
+	atomic.AddInt64(&a.allocated, int64(start+size-a.used))
+	a.used = start + size
+	return uint64(a.current)<<32 | uint64(start)
+}
+
+// return memory in the arena from @offset to the end of its block
+func (a *arena) bytesAt(offset uint64) []byte {
+	block := a.loadBlocks()[offset>>32]
+	return block[offset&0xffffffff:]
+}
+
+// Return number of bytes taken by allocations, including alignment
+// padding between them. The rest of a block too small for the next
+// allocation is not counted
+func (a *arena) memoryUsage() int {
+	return int(atomic.LoadInt64(&a.allocated))
+}
+
+// Return number of bytes of blocks held by the arena, which is what
+// it costs in memory
+func (a *arena) memoryReserved() int {
+	return int(atomic.LoadInt64(&a.reserved))
+}
+
+// no more allocations are expected, which the write buffer manager
+// takes as memory to be freed soon
+func (a *arena) markImmutable() {
+	if a.manager != nil && !a.immutable {
+		a.manager.scheduleFreeMem(a.memoryReserved())
+	}
+	a.immutable = true
+}
+
+// drop all blocks. Offsets handed out before are no longer valid, but
+// slices returned by bytesAt stay readable until they are dropped
+func (a *arena) deallocateAll() {
+	reserved := atomic.SwapInt64(&a.reserved, 0)
+	atomic.StoreInt64(&a.allocated, 0)
+	if a.manager != nil {
+		a.manager.freeMem(int(reserved), !a.immutable)
+	}
+	a.immutable = true
+
+	a.blocks.Store([][]byte{})
+	a.current = -1
+	a.used = kArenaBlockSize
+}
@@ -0,0 +1,124 @@
+package gdb
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestArenaAllocate(t *testing.T) {
+	a := makeArena(nil)
+	defer a.deallocateAll()
+
+	sizes := []int{1, 7, 8, 100, kArenaMaxSharedAlloc, kArenaMaxSharedAlloc + 1, 3 * kArenaBlockSize}
+	offsets := make([]uint64, 0)
+	for round := 0; round < 50; round++ {
+		for _, size := range sizes {
+			offset := a.allocate(size)
+			if offset == 0 || offset%kArenaAlignment != 0 {
+				t.Fatal("Bad offset ", offset, " for size ", size)
+			}
+
+			data := a.bytesAt(offset)[:size]
+			for i := range data {
+				data[i] = byte(size)
+			}
+			offsets = append(offsets, offset)
+		}
+	}
+
+	// all space is intact after later allocations
+	for i, offset := range offsets {
+		size := sizes[i%len(sizes)]
+		for _, b := range a.bytesAt(offset)[:size] {
+			if b != byte(size) {
+				t.Fatal("Space at ", offset, " is overwritten")
+			}
+		}
+	}
+}
+
+func TestArenaMemoryUsage(t *testing.T) {
+	a := makeArena(nil)
+	if a.memoryUsage() != kArenaAlignment || a.memoryReserved() != kArenaBlockSize {
+		t.Error("Unexpected initial usage ", a.memoryUsage(), " ", a.memoryReserved())
+	}
+
+	// padding to alignment is counted
+	a.allocate(1)
+	a.allocate(1)
+	if a.memoryUsage() != 2*kArenaAlignment+1 {
+		t.Error("Unexpected usage with padding ", a.memoryUsage())
+	}
+
+	// fill up the first block
+	a.allocate(kArenaMaxSharedAlloc)
+	a.allocate(kArenaMaxSharedAlloc)
+	a.allocate(kArenaMaxSharedAlloc)
+	used := 3*kArenaAlignment + 3*kArenaMaxSharedAlloc
+	if a.memoryUsage() != used || a.memoryReserved() != kArenaBlockSize {
+		t.Error("Unexpected usage ", a.memoryUsage(), " ", a.memoryReserved())
+	}
+
+	// the rest of the first block is left unused
+	a.allocate(kArenaMaxSharedAlloc)
+	used = used + kArenaMaxSharedAlloc
+	if a.memoryUsage() != used || a.memoryReserved() != 2*kArenaBlockSize {
+		t.Error("Unexpected usage after a new block ", a.memoryUsage(), " ", a.memoryReserved())
+	}
+
+	a.allocate(10000)
+	if a.memoryUsage() != used+10000 || a.memoryReserved() != 2*kArenaBlockSize+10000 {
+		t.Error("Unexpected usage after a big allocation ", a.memoryUsage(), " ", a.memoryReserved())
+	}
+
+	a.deallocateAll()
+	if a.memoryUsage() != 0 || a.memoryReserved() != 0 {
+		t.Error("Memory is not released ", a.memoryUsage(), " ", a.memoryReserved())
+	}
+}
+
+func TestSkiplistMemoryUsage(t *testing.T) {
+	slist := MakeSkiplist()
+	defer slist.Release()
+
+	empty := slist.MemoryUsage()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		slist.Put(key, key)
+	}
+
+	// each entry takes at least its key and value
+	used := slist.MemoryUsage() - empty
+	if used < 1000*2*7 || used > slist.MemoryReserved() {
+		t.Error("Unexpected usage ", used, " of ", slist.MemoryReserved())
+	}
+}
+
+func TestSkiplistSurvivesGC(t *testing.T) {
+	slist := MakeSkiplist()
+	defer slist.Release()
+
+	// nothing but the skiplist refers to keys and values
+	for i := 0; i < 10000; i++ {
+		key := []byte(string(genRandomBytes()))
+		slist.Put(key, append(key, '!'))
+		if i%1000 == 0 {
+			runtime.GC()
+		}
+	}
+	runtime.GC()
+
+	count := 0
+	iter := slist.NewIterator(nil)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if string(iter.Value()) != string(iter.Key())+"!" {
+			t.Fatal("Value of ", string(iter.Key()), " is corrupted")
+		}
+		count++
+	}
+
+	if count != slist.Len() {
+		t.Error("Expect ", slist.Len(), " entries, got ", count)
+	}
+}
@@ -1,17 +1,12 @@
 package gdb
 
-// For efficiency reason, this implementation does not convert
-// integers into big endian format in a file. This is usually
-// fine since we are only use the same data locally which is
-// very unlikely to have an endianess change. But if uses arise
-// that requires physically copy the data to other servers
-// which potentially have different kind of CPUs, we may have
-// to revisit the decision and implement a endianess aware
-// implementation
+// Integers in a block are saved in little endian byte order, so that
+// table files can be copied to machines of other architectures. Blocks
+// written by old releases use native byte order instead, they can
+// still be decoded to convert old tables
 
 import (
 	"sort"
-	"unsafe"
 )
 
 type BlockBuilder struct {
@@ -27,16 +22,35 @@ type blockTailer struct {
 	restartOffset uint32
 }
 
+const kBlockTailerSize = 12
+
 type Block struct {
 	data          []byte
 	restartOffset uint32
 	numKeys       uint32
+	// integers are in native byte order of an old release
+	native bool
+}
+
+// return decoder of integers in the block
+func (a *Block) decoder() decoder {
+	if a.native {
+		return nativeEndian
+	}
+	return littleEndian
+}
+
+// return offset of entry @idx
+func (a *Block) entryOffset(idx int) uint32 {
+	return a.decoder().order.Uint32(a.data[int(a.restartOffset)+idx*4:])
 }
 
 type blockIter struct {
 	block *Block
 	order Comparator
 	idx   int32
+	// a corrupted entry turns the iterator invalid
+	status Status
 }
 
 func (a *Block) NewIterator(o Comparator) Iterator {
@@ -44,67 +58,58 @@ func (a *Block) NewIterator(o Comparator) Iterator {
 	ret.block = a
 	ret.order = o
 	ret.idx = -1
+	ret.status = MakeStatusOk()
 	return ret
 }
 
 // Parse an entry starting at offset @off, returns key, value along with
-// how many bytes has been consumed
-func parseSimpleEntry(data []byte, off uint32) (key, val []byte, s uint32) {
-	keylen := uint32(0)
-	vallen := uint32(0)
-	pos := int(off)
-
-	// parse key length
-	{
-		left := data[pos:]
-		v, r := DecodeVarInt(left)
-
-		// abort if we fails to decode
-		l := len(left) - len(r)
-		if l <= 0 {
-			return
-		}
-
-		keylen = uint32(v)
-		s = s + uint32(l)
-		pos = pos + l
+// how many bytes has been consumed. Nothing is consumed if the entry
+// does not fit in @data
+func parseSimpleEntry(d decoder, data []byte, off uint32) (key, val []byte, s uint32) {
+	if int(off) >= len(data) {
+		return
 	}
+	left := data[off:]
 
-	// parse value length
-	{
-		left := data[pos:]
-		v, r := DecodeVarInt(left)
-
-		// abort if we fails to decode
-		l := len(left) - len(r)
-		if l <= 0 {
-			return
-		}
-
-		vallen = uint32(v)
-		s = s + uint32(l)
-		pos = pos + l
+	// parse key length and value length, abort if we fails to decode
+	keylen, r := d.varInt(left)
+	if len(r) == len(left) {
+		return
 	}
-
-	// parse key
-	{
-		key = data[pos : pos+int(keylen)]
-		s = s + keylen
-		pos = pos + int(keylen)
+	vallen, rest := d.varInt(r)
+	if len(rest) == len(r) {
+		return
 	}
 
-	// parse value
-	{
-		val = data[pos : pos+int(vallen)]
-		s = s + vallen
-		pos = pos + int(vallen)
+	if keylen > uint64(len(rest)) || vallen > uint64(len(rest))-keylen {
+		return
 	}
 
+	key = rest[:keylen]
+	val = rest[keylen : keylen+vallen]
+	s = uint32(len(left) - len(rest) + int(keylen+vallen))
 	return
 }
 
 func (a *blockIter) Valid() bool {
-	return (a.idx >= 0 && a.idx < int32(a.block.numKeys))
+	return a.status.Ok() && a.idx >= 0 && a.idx < int32(a.block.numKeys)
+}
+
+// parse the entry at @idx, a corrupted entry is kept in @status
+func (a *blockIter) entry(idx int) (key, val []byte) {
+	b := a.block
+	key, val, consumed := parseSimpleEntry(b.decoder(), b.data[:b.restartOffset], b.entryOffset(idx))
+	if consumed == 0 {
+		a.corrupt("bad entry in block")
+	}
+	return
+}
+
+// keep the first corruption found in the block
+func (a *blockIter) corrupt(msg string) {
+	if a.status.Ok() {
+		a.status = MakeStatusCorruption(msg)
+	}
 }
 
 func (a *blockIter) SeekToFirst() {
@@ -116,7 +121,7 @@ func (a *blockIter) SeekToFirst() {
 }
 
 func (a *blockIter) SeekToLast() {
-	a.idx = int32(a.block.numKeys)
+	a.idx = int32(a.block.numKeys) - 1
 }
 
 // Find and point to the key. If key does not exist, point to the
@@ -126,14 +131,8 @@ func (a *blockIter) Seek(mark []byte) {
 	a.idx = int32(sort.Search(
 		int(b.numKeys),
 		func(n int) bool {
-			loc := &b.data[int(b.restartOffset)+n*4]
-			offsetPtr := (*uint32)(unsafe.Pointer(loc))
-			key, _, consumed := parseSimpleEntry(b.data, *offsetPtr)
-			if consumed == 0 {
-				panic("corrupted data")
-			}
-
-			return (a.order.Compare(key, mark) >= 0)
+			key, _ := a.entry(n)
+			return !a.status.Ok() || a.order.Compare(key, mark) >= 0
 		}))
 }
 
@@ -146,24 +145,19 @@ func (a *blockIter) Prev() {
 }
 
 func (a *blockIter) Key() []byte {
-	b := a.block
-	loc := &b.data[b.restartOffset+uint32(a.idx)*4]
-	offsetPtr := (*uint32)(unsafe.Pointer(loc))
-	key, _, consumed := parseSimpleEntry(b.data, *offsetPtr)
-	if consumed == 0 {
-		panic("corrupted data")
-	}
+	key, _ := a.entry(int(a.idx))
 	return key
 }
 
+func (a *blockIter) Status() Status {
+	return a.status
+}
+
+func (a *blockIter) Release() {
+}
+
 func (a *blockIter) Value() []byte {
-	b := a.block
-	loc := &b.data[b.restartOffset+uint32(a.idx)*4]
-	offsetPtr := (*uint32)(unsafe.Pointer(loc))
-	_, val, consumed := parseSimpleEntry(b.data, *offsetPtr)
-	if consumed == 0 {
-		panic("corrupted data")
-	}
+	_, val := a.entry(int(a.idx))
 	return val
 }
 
@@ -230,8 +224,6 @@ func (a *BlockBuilder) Add(key []byte, val []byte) bool {
 	return true
 }
 
-var modelTailer blockTailer
-
 // Finish building the block, return the slice that denotes
 // the boundary of the block. Return true if operation succeeds
 func (a *BlockBuilder) Finalize() (ret *Block, ok bool) {
@@ -242,25 +234,22 @@ func (a *BlockBuilder) Finalize() (ret *Block, ok bool) {
 
 	// save all key offsets
 	for _, off := range a.keys {
-		intPtr := (*uint32)(unsafe.Pointer(&a.data[pos]))
-		pos = pos + 4
-		if int(pos) >= len(a.data) {
+		if int(pos)+4 >= len(a.data) {
 			return
 		}
 
-		*intPtr = uint32(off)
+		EncodeUint32(a.data[pos:pos], off)
+		pos = pos + 4
 	}
 
 	// prepare tailer
-	tail := (*blockTailer)(unsafe.Pointer(&a.data[pos]))
-	pos = pos + uint32(unsafe.Sizeof(modelTailer))
-	if int(pos) >= len(a.data) {
+	if int(pos)+kBlockTailerSize >= len(a.data) {
 		return
 	}
 
-	tail.blockSize = pos
-	tail.numKeys = uint32(len(a.keys))
-	tail.restartOffset = restart
+	tail := blockTailer{pos + kBlockTailerSize, uint32(len(a.keys)), restart}
+	tail.encodeTo(a.data[pos:pos])
+	pos = pos + kBlockTailerSize
 
 	//prepare result
 	ret = &Block{}
@@ -279,21 +268,49 @@ func (a *BlockBuilder) Finalize() (ret *Block, ok bool) {
 	return
 }
 
+// append @p after the last finished block, return false if there is
+// no room. It must be called before any entry of next block is added
+func (a *BlockBuilder) appendRaw(p []byte) bool {
+	if a.cur != 0 || len(a.data) < len(p) {
+		return false
+	}
+
+	copy(a.data, p)
+	a.data = a.data[len(p):]
+	return true
+}
+
+func (t *blockTailer) encodeTo(scratch []byte) []byte {
+	scratch = EncodeUint32(scratch, t.blockSize)
+	scratch = EncodeUint32(scratch, t.numKeys)
+	return EncodeUint32(scratch, t.restartOffset)
+}
+
 // recover a block from a binary slice.
 func DecodeBlock(data []byte, endOffset uint32) *Block {
-	tailerSize := uint32(unsafe.Sizeof(modelTailer))
-	if tailerSize > endOffset {
+	return decodeBlock(littleEndian, data, endOffset)
+}
+
+// recover a block whose integers are decoded by @d
+func decodeBlock(d decoder, data []byte, endOffset uint32) *Block {
+	if kBlockTailerSize > endOffset {
 		return nil
 	}
 
-	tail := (*blockTailer)(unsafe.Pointer(&data[endOffset-tailerSize]))
+	tail := &blockTailer{}
+	rest := data[endOffset-kBlockTailerSize:]
+	tail.blockSize, rest = d.uint32(rest)
+	tail.numKeys, rest = d.uint32(rest)
+	tail.restartOffset, _ = d.uint32(rest)
 	ret := &Block{}
+	ret.native = d.order != littleEndian.order
 
 	// make sure data is valid
-	startOffset := endOffset - tail.blockSize
-	if startOffset < 0 {
+	restartEnd := uint64(tail.restartOffset) + 4*uint64(tail.numKeys) + kBlockTailerSize
+	if tail.blockSize > endOffset || restartEnd > uint64(tail.blockSize) {
 		return nil
 	}
+	startOffset := endOffset - tail.blockSize
 
 	ret.data = data[startOffset:endOffset]
 	ret.restartOffset = tail.restartOffset
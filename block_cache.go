@@ -0,0 +1,52 @@
+package gdb
+
+// BlockCache keeps recently read table blocks in memory, keyed by
+// table file number and offset of a block in the file. Each block is
+// charged by its size, least recently used blocks are evicted once
+// the charges exceed the capacity. A block handed out by Lookup or
+// Insert is pinned until its handle is released, pinned blocks are
+// never evicted but still count against the capacity.
+// A BlockCache is safe for concurrent use
+type BlockCache struct {
+	lru *LRU
+}
+
+// Create a block cache that holds @capacity bytes of blocks
+func MakeBlockCache(capacity int) *BlockCache {
+	ret := &BlockCache{}
+	ret.lru = NewLRU(capacity)
+	return ret
+}
+
+// return the key of block at @offset of table @number
+func blockCacheKey(number, offset uint64) []byte {
+	key := EncodeUint64(nil, number)
+	return EncodeUint64(key, offset)
+}
+
+// Find a block in the cache. Return nil if it is not there. Otherwise
+// the block is pinned, and its handle must be released
+func (c *BlockCache) Lookup(key []byte) *LruEntry {
+	return c.lru.Lookup(key)
+}
+
+// Add a block charged by @charge bytes into the cache. The returned
+// handle pins the block, and must be released
+func (c *BlockCache) Insert(key []byte, block *Block, charge int) *LruEntry {
+	return c.lru.Insert(key, block, charge, nil)
+}
+
+// Unpin a block returned by Lookup or Insert
+func (c *BlockCache) Release(h *LruEntry) {
+	c.lru.Release(h)
+}
+
+// Return number of bytes charged by blocks in the cache
+func (c *BlockCache) Usage() int {
+	return c.lru.Usage()
+}
+
+// Return number of lookups that find a block, and those that do not
+func (c *BlockCache) Stats() (hits, misses int64) {
+	return c.lru.Stats()
+}
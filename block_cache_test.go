@@ -0,0 +1,123 @@
+package gdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBlockCacheEvictsByCharge(t *testing.T) {
+	c := MakeBlockCache(100)
+
+	for i := 0; i < 5; i++ {
+		c.Release(c.Insert(blockCacheKey(1, uint64(i)), nil, 30))
+	}
+
+	// only the three most recently used blocks fit
+	if c.Usage() != 90 {
+		t.Error("Unexpected usage ", c.Usage())
+	}
+
+	for i := 0; i < 5; i++ {
+		h := c.Lookup(blockCacheKey(1, uint64(i)))
+		if (h != nil) != (i >= 2) {
+			t.Error("Unexpected lookup result of block ", i)
+		}
+		if h != nil {
+			c.Release(h)
+		}
+	}
+
+	// a lookup makes a block recently used
+	c.Release(c.Lookup(blockCacheKey(1, 2)))
+	c.Release(c.Insert(blockCacheKey(2, 0), nil, 30))
+	if h := c.Lookup(blockCacheKey(1, 3)); h != nil {
+		t.Error("Least recently used block is not evicted")
+	}
+	if h := c.Lookup(blockCacheKey(1, 2)); h == nil {
+		t.Error("Recently used block is evicted")
+	} else {
+		c.Release(h)
+	}
+}
+
+func TestBlockCachePinnedBlocks(t *testing.T) {
+	c := MakeBlockCache(100)
+
+	block := &Block{}
+	pinned := c.Insert(blockCacheKey(1, 0), block, 80)
+	for i := 1; i < 5; i++ {
+		c.Release(c.Insert(blockCacheKey(1, uint64(i)), nil, 30))
+	}
+
+	// a pinned block stays even if the cache is over capacity
+	h := c.Lookup(blockCacheKey(1, 0))
+	if h == nil || h.Value().(*Block) != block {
+		t.Fatal("Pinned block is evicted")
+	}
+	c.Release(h)
+	c.Release(pinned)
+
+	// once released, it is evicted as any other block
+	c.Release(c.Insert(blockCacheKey(2, 0), nil, 90))
+	if h := c.Lookup(blockCacheKey(1, 0)); h != nil {
+		t.Error("Released block is not evicted")
+	}
+	if c.Usage() != 90 {
+		t.Error("Unexpected usage ", c.Usage())
+	}
+}
+
+func TestBlockCacheReplace(t *testing.T) {
+	c := MakeBlockCache(100)
+
+	old := c.Insert(blockCacheKey(1, 0), &Block{}, 40)
+	block := &Block{}
+	c.Release(c.Insert(blockCacheKey(1, 0), block, 20))
+
+	// the old block leaves the cache, but stays valid until released
+	if c.Usage() != 20 || old.Value() == nil {
+		t.Error("Unexpected usage ", c.Usage())
+	}
+	c.Release(old)
+
+	h := c.Lookup(blockCacheKey(1, 0))
+	if h == nil || h.Value().(*Block) != block {
+		t.Fatal("Fails to find the new block")
+	}
+	c.Release(h)
+
+	if hits, misses := c.Stats(); hits != 1 || misses != 0 {
+		t.Error("Unexpected stats ", hits, " ", misses)
+	}
+}
+
+func TestDBBlockCache(t *testing.T) {
+	for _, capacity := range []int{0, -1} {
+		root := "/tmp/db_test/BlockCache"
+		os.RemoveAll(root)
+		os.MkdirAll("/tmp/db_test", os.ModePerm)
+
+		db, s := Open(root, Options{CreateIfMissing: true, BlockCacheCapacity: capacity})
+		if !s.Ok() {
+			t.Fatal("Fails to open db ", s.ToString())
+		}
+
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			db.Put(WriteOptions{}, []byte(key), []byte(key))
+		}
+		db.CompactRange(CompactRangeOptions{}, nil, nil)
+
+		// default read options fill the cache
+		checkGet(t, db, "key0500", "key0500")
+		cache := db.(*dbImpl).tables.blockCache
+		switch {
+		case capacity == 0 && (cache == nil || cache.Usage() == 0):
+			t.Error("Block is not cached by default read options")
+		case capacity < 0 && cache != nil:
+			t.Error("Block cache is not turned off")
+		}
+		db.Close()
+	}
+}
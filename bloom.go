@@ -0,0 +1,86 @@
+package gdb
+
+const kBloomHashSeed = 0xbc9f1d34
+
+// A bloom filter policy. A filter takes about @bitsPerKey bits for each
+// key, 10 bits per key give a false positive rate of about 1%
+type bloomFilterPolicy struct {
+	bitsPerKey int
+	// number of probes for each key
+	k int
+}
+
+// Return a bloom filter policy using @bitsPerKey bits for each key
+func MakeBloomFilterPolicy(bitsPerKey int) FilterPolicy {
+	ret := &bloomFilterPolicy{}
+	ret.bitsPerKey = bitsPerKey
+
+	// ln(2) * bits per key minimizes false positive rate
+	ret.k = bitsPerKey * 69 / 100
+	if ret.k < 1 {
+		ret.k = 1
+	}
+	if ret.k > 30 {
+		ret.k = 30
+	}
+	return ret
+}
+
+func (p *bloomFilterPolicy) Name() string {
+	return "gdb.BuiltinBloomFilter"
+}
+
+// A filter is a bit array followed by a byte of number of probes
+func (p *bloomFilterPolicy) CreateFilter(keys [][]byte) []byte {
+	// a small filter has a high false positive rate
+	bits := len(keys) * p.bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	ret := make([]byte, bytes+1)
+	ret[bytes] = byte(p.k)
+	for _, key := range keys {
+		// double hashing to get k hash values
+		h := hashBytes(key, kBloomHashSeed)
+		delta := h>>17 | h<<15
+		for i := 0; i < p.k; i++ {
+			pos := h % uint32(bits)
+			ret[pos/8] |= 1 << (pos % 8)
+			h = h + delta
+		}
+	}
+
+	return ret
+}
+
+func (p *bloomFilterPolicy) KeyMayMatch(key, filter []byte) bool {
+	if len(filter) < 2 {
+		return false
+	}
+
+	bytes := len(filter) - 1
+	bits := uint32(bytes * 8)
+
+	// a filter built with more probes than supported is taken as a
+	// match, so that new filter formats can be introduced later
+	k := int(filter[bytes])
+	if k > 30 {
+		return true
+	}
+
+	h := hashBytes(key, kBloomHashSeed)
+	delta := h>>17 | h<<15
+	for i := 0; i < k; i++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h = h + delta
+	}
+
+	return true
+}
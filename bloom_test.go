@@ -0,0 +1,47 @@
+package gdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterEmpty(t *testing.T) {
+	policy := MakeBloomFilterPolicy(10)
+	filter := policy.CreateFilter(nil)
+
+	if policy.KeyMayMatch([]byte("hello"), filter) {
+		t.Error("Empty filter matches a key")
+	}
+}
+
+func TestBloomFilterMatch(t *testing.T) {
+	policy := MakeBloomFilterPolicy(10)
+
+	for _, n := range []int{1, 10, 100, 1000, 10000} {
+		keys := make([][]byte, n)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key%08d", i))
+		}
+		filter := policy.CreateFilter(keys)
+
+		// no false negative
+		for _, key := range keys {
+			if !policy.KeyMayMatch(key, filter) {
+				t.Fatal("Filter of ", n, " keys misses key ", string(key))
+			}
+		}
+
+		// about 1% false positive with 10 bits per key
+		positives := 0
+		for i := 0; i < 10000; i++ {
+			key := []byte(fmt.Sprintf("missing%08d", i))
+			if policy.KeyMayMatch(key, filter) {
+				positives++
+			}
+		}
+
+		if positives > 200 {
+			t.Error("Too many false positives for ", n, " keys: ", positives)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package gdb
+
+import (
+	"hash/crc32"
+	"math/bits"
+)
+
+// a block in table files is followed by a trailer of a byte of
+// compression type and a checksum of 4 bytes. The checksum covers the
+// block and the compression type
+const kBlockTrailerSize = 5
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// return checksum of @data followed by @blockType
+func blockChecksum(t ChecksumType, data []byte, blockType byte) uint32 {
+	switch t {
+	case XXHashChecksum:
+		buf := make([]byte, len(data)+1)
+		copy(buf, data)
+		buf[len(data)] = blockType
+		return xxHash32(buf, 0)
+	default:
+		crc := crc32.Update(0, crc32cTable, data)
+		return crc32.Update(crc, crc32cTable, []byte{blockType})
+	}
+}
+
+// return the trailer of @data, which is a block of @blockType
+func makeBlockTrailer(t ChecksumType, data []byte, blockType byte) []byte {
+	ret := []byte{blockType}
+	return EncodeUint32(ret, blockChecksum(t, data, blockType))
+}
+
+// split @data into a block and its trailer, whose checksum is decoded
+// by @d. If @verify is set, a corruption status is returned if the
+// checksum does not match
+func checkBlockTrailer(t ChecksumType, data []byte, verify bool, d decoder) ([]byte, byte, Status) {
+	if len(data) < kBlockTrailerSize {
+		return nil, 0, MakeStatusCorruption("truncated block trailer")
+	}
+
+	block := data[:len(data)-kBlockTrailerSize]
+	blockType := data[len(block)]
+	if verify {
+		expected, _ := d.uint32(data[len(block)+1:])
+		if blockChecksum(t, block, blockType) != expected {
+			return nil, 0, MakeStatusCorruption("block checksum mismatch")
+		}
+	}
+
+	return block, blockType, MakeStatusOk()
+}
+
+const (
+	xxPrime32_1 = 2654435761
+	xxPrime32_2 = 2246822519
+	xxPrime32_3 = 3266489917
+	xxPrime32_4 = 668265263
+	xxPrime32_5 = 374761393
+)
+
+// 32 bit xxHash of @data
+func xxHash32(data []byte, seed uint32) uint32 {
+	n := len(data)
+	var h uint32
+
+	if n >= 16 {
+		v1 := seed + xxPrime32_1 + xxPrime32_2
+		v2 := seed + xxPrime32_2
+		v3 := seed
+		v4 := seed - xxPrime32_1
+		for ; len(data) >= 16; data = data[16:] {
+			v1 = xxRound32(v1, xxLoad32(data[0:]))
+			v2 = xxRound32(v2, xxLoad32(data[4:]))
+			v3 = xxRound32(v3, xxLoad32(data[8:]))
+			v4 = xxRound32(v4, xxLoad32(data[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) +
+			bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + xxPrime32_5
+	}
+
+	h = h + uint32(n)
+	for ; len(data) >= 4; data = data[4:] {
+		h = h + xxLoad32(data)*xxPrime32_3
+		h = bits.RotateLeft32(h, 17) * xxPrime32_4
+	}
+	for _, b := range data {
+		h = h + uint32(b)*xxPrime32_5
+		h = bits.RotateLeft32(h, 11) * xxPrime32_1
+	}
+
+	h = h ^ (h >> 15)
+	h = h * xxPrime32_2
+	h = h ^ (h >> 13)
+	h = h * xxPrime32_3
+	h = h ^ (h >> 16)
+	return h
+}
+
+func xxRound32(acc, input uint32) uint32 {
+	acc = acc + input*xxPrime32_2
+	return bits.RotateLeft32(acc, 13) * xxPrime32_1
+}
+
+// load 4 bytes in little endian order
+func xxLoad32(data []byte) uint32 {
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+}
@@ -0,0 +1,58 @@
+package gdb
+
+import (
+	"testing"
+)
+
+func TestXXHash32(t *testing.T) {
+	cases := []struct {
+		data string
+		hash uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	}
+
+	for _, c := range cases {
+		if h := xxHash32([]byte(c.data), 0); h != c.hash {
+			t.Errorf("Bad hash %x of %q", h, c.data)
+		}
+	}
+}
+
+func TestBlockTrailer(t *testing.T) {
+	data := []byte("some block content")
+	for _, ct := range []ChecksumType{CRC32CChecksum, XXHashChecksum} {
+		raw := append(append([]byte(nil), data...), makeBlockTrailer(ct, data, 0)...)
+		if len(raw) != len(data)+kBlockTrailerSize {
+			t.Fatal("Unexpected trailer size")
+		}
+
+		block, blockType, s := checkBlockTrailer(ct, raw, true, littleEndian)
+		if !s.Ok() || string(block) != string(data) || blockType != 0 {
+			t.Error("Fails to check a good trailer ", s.ToString())
+		}
+
+		// a flipped bit is caught only if checksum is verified
+		raw[3] ^= 0x10
+		if _, _, s := checkBlockTrailer(ct, raw, true, littleEndian); !s.IsCorruption() {
+			t.Error("Corrupted block passes checksum ", ct)
+		}
+		if _, _, s := checkBlockTrailer(ct, raw, false, littleEndian); !s.Ok() {
+			t.Error("Checksum is verified without being asked")
+		}
+		raw[3] ^= 0x10
+
+		// so is a changed block type
+		raw[len(data)] = 1
+		if _, _, s := checkBlockTrailer(ct, raw, true, littleEndian); !s.IsCorruption() {
+			t.Error("Changed block type passes checksum ", ct)
+		}
+	}
+
+	if _, _, s := checkBlockTrailer(CRC32CChecksum, []byte{1, 2}, false, littleEndian); !s.IsCorruption() {
+		t.Error("Accepts a truncated trailer")
+	}
+}
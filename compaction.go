@@ -0,0 +1,536 @@
+package gdb
+
+// Tables are organized in levels. Level 0 holds tables written from
+// memtables, they may overlap with each other. Tables in other levels
+// cover disjoint key ranges. When a level grows too big, some of its
+// tables are merged with the overlapping tables of the next level
+
+const (
+	// level 0 compaction starts when it has this many files
+	kL0CompactionTrigger = 4
+	// writes are stopped when level 0 has this many files
+	kL0StopWritesTrigger = 12
+	// maximum number of bytes in level 1, each following level is
+	// kLevelSizeMultiplier times larger
+	kMaxBytesForLevelBase = 10 * 1024 * 1024
+	kLevelSizeMultiplier  = 10
+)
+
+// describe a compaction: files from @level (inputs[0]) are merged with
+// the overlapping files from @level+1 (inputs[1])
+type compaction struct {
+	level  int
+	inputs [2][]uint64
+	edit   *VersionEdit
+	// requested by CompactRange, files are always rewritten
+	manual bool
+	// user key ranges of files in levels below @level+1, they are
+	// collected up front since the compaction runs without mutex
+	lowerRanges []keyRange
+}
+
+// a compaction of a level requested by CompactRange, it is run by the
+// background thread
+type manualCompaction struct {
+	level int
+	start []byte
+	limit []byte
+	done  bool
+}
+
+type keyRange struct {
+	smallest []byte
+	largest  []byte
+}
+
+// maximum number of bytes a level may hold before it is compacted
+func maxBytesForLevel(level int) float64 {
+	ret := float64(kMaxBytesForLevelBase)
+	for ; level > 1; level-- {
+		ret = ret * kLevelSizeMultiplier
+	}
+	return ret
+}
+
+// total size of files in a list
+func totalFileSize(set *VersionSet, files []uint64) uint64 {
+	ret := uint64(0)
+	for _, fh := range files {
+		ret = ret + uint64(set.fileMap[fh].size)
+	}
+	return ret
+}
+
+// Score each level of a version, a level with a score not less than
+// 1 needs compaction. Level 0 is scored by number of files, since
+// each file has to be read on lookups. Other levels are scored by
+// size. Return the level with the highest score
+func (db *dbImpl) compactionScore(v *Version) (level int, score float64) {
+	level, score = -1, 0
+	for l := 0; l < kNumLevels-1; l++ {
+		var s float64
+		if l == 0 {
+			s = float64(len(v.levels[0])) / kL0CompactionTrigger
+		} else {
+			s = float64(totalFileSize(db.versions, v.levels[l])) / maxBytesForLevel(l)
+		}
+
+		if s > score {
+			level, score = l, s
+		}
+	}
+	return
+}
+
+// Return true if current version needs compaction
+func (db *dbImpl) needsCompaction() bool {
+	_, score := db.compactionScore(db.versions.current)
+	return score >= 1
+}
+
+// Return user key range covered by a list of files
+func (db *dbImpl) userKeyRange(files []uint64) (smallest, largest []byte) {
+	user := db.comparator.user
+	for _, fh := range files {
+		fi := db.versions.fileMap[fh]
+		minKey, maxKey := extractUserKey(fi.minKey), extractUserKey(fi.maxKey)
+		if smallest == nil || user.Compare(minKey, smallest) < 0 {
+			smallest = minKey
+		}
+		if largest == nil || user.Compare(maxKey, largest) > 0 {
+			largest = maxKey
+		}
+	}
+	return
+}
+
+// Return files in @level that overlap with user key range [smallest,
+// largest]. A nil @smallest or @largest means the range is unbounded
+// on that side. Since files in level 0 may overlap with each other,
+// the range is expanded for level 0 until no more file is added
+func (db *dbImpl) overlappingFiles(v *Version, level int, smallest, largest []byte) []uint64 {
+	user := db.comparator.user
+	ret := make([]uint64, 0, 8)
+
+	for i := 0; i < len(v.levels[level]); i++ {
+		fh := v.levels[level][i]
+		fi := db.versions.fileMap[fh]
+		minKey, maxKey := extractUserKey(fi.minKey), extractUserKey(fi.maxKey)
+
+		if smallest != nil && user.Compare(maxKey, smallest) < 0 {
+			continue
+		}
+		if largest != nil && user.Compare(minKey, largest) > 0 {
+			continue
+		}
+
+		ret = append(ret, fh)
+		if level == 0 {
+			expanded := false
+			if smallest != nil && user.Compare(minKey, smallest) < 0 {
+				smallest, expanded = minKey, true
+			}
+			if largest != nil && user.Compare(maxKey, largest) > 0 {
+				largest, expanded = maxKey, true
+			}
+
+			// start over with the larger range
+			if expanded {
+				ret = ret[:0]
+				i = -1
+			}
+		}
+	}
+
+	return ret
+}
+
+// Pick files to compact from current version. Return nil if no level
+// needs compaction. Must be called with mutex held
+func (db *dbImpl) pickCompaction() *compaction {
+	current := db.versions.current
+	level, score := db.compactionScore(current)
+	if score < 1 {
+		return nil
+	}
+
+	c := &compaction{}
+	c.level = level
+
+	if level == 0 {
+		// start from the oldest file
+		c.inputs[0] = append(c.inputs[0], current.levels[0][0])
+	} else {
+		// rotate through the key space of the level, pick the first
+		// file after the one compacted last time
+		pointer := db.versions.compactPointer[level]
+		for _, fh := range current.levels[level] {
+			fi := db.versions.fileMap[fh]
+			if pointer == nil || db.comparator.Compare(fi.maxKey, pointer) > 0 {
+				c.inputs[0] = append(c.inputs[0], fh)
+				break
+			}
+		}
+
+		if len(c.inputs[0]) == 0 {
+			c.inputs[0] = append(c.inputs[0], current.levels[level][0])
+		}
+	}
+
+	db.setupOtherInputs(c)
+	return c
+}
+
+// Return a compaction of all files in @level overlapping user key
+// range [start, limit]. Return nil if there is no such file. Must be
+// called with mutex held
+func (db *dbImpl) compactionForRange(level int, start, limit []byte) *compaction {
+	files := db.overlappingFiles(db.versions.current, level, start, limit)
+	if len(files) == 0 {
+		return nil
+	}
+
+	c := &compaction{}
+	c.level = level
+	c.manual = true
+	c.inputs[0] = files
+
+	db.setupOtherInputs(c)
+	return c
+}
+
+// Fill in inputs of the compaction with overlapping files in the same
+// level (level 0 only) and in the next level, and start its edit
+func (db *dbImpl) setupOtherInputs(c *compaction) {
+	current := db.versions.current
+	c.edit = &VersionEdit{}
+
+	smallest, largest := db.userKeyRange(c.inputs[0])
+	if c.level == 0 {
+		c.inputs[0] = db.overlappingFiles(current, 0, smallest, largest)
+		smallest, largest = db.userKeyRange(c.inputs[0])
+	}
+
+	c.inputs[1] = db.overlappingFiles(current, c.level+1, smallest, largest)
+
+	// compaction of the level starts after this range next time, once
+	// this one is installed
+	last := c.inputs[0][len(c.inputs[0])-1]
+	pointer := compactPointer{c.level, db.versions.fileMap[last].maxKey}
+	c.edit.compactPointers = append(c.edit.compactPointers, pointer)
+
+	for level := c.level + 2; level < kNumLevels; level++ {
+		for _, fh := range current.levels[level] {
+			fi := db.versions.fileMap[fh]
+			r := keyRange{extractUserKey(fi.minKey), extractUserKey(fi.maxKey)}
+			c.lowerRanges = append(c.lowerRanges, r)
+		}
+	}
+}
+
+// Return true if no file in levels below the output level of the
+// compaction may contain @userKey
+func (db *dbImpl) isBaseLevelForKey(c *compaction, userKey []byte) bool {
+	user := db.comparator.user
+	for _, r := range c.lowerRanges {
+		if user.Compare(userKey, r.smallest) >= 0 &&
+			user.Compare(userKey, r.largest) <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the smallest sequence number that is still visible to some
+// reader. Older versions hidden by a newer version at or below this
+// sequence number are not needed by anyone. Must be called with
+// mutex held
+func (db *dbImpl) smallestSnapshot() uint64 {
+	if db.snapshots.Empty() {
+		return db.versions.lastSequence
+	}
+	return db.snapshots.Oldest().sequence
+}
+
+// Write memtable into a table file and wait for it to finish. Must be
+// called with mutex held
+func (db *dbImpl) flushMemTable() Status {
+	if !db.mem.Empty() {
+		// go through the write queue, so that no write is in
+		// progress while memtable is switched
+		s := db.write(WriteOptions{}, nil)
+		if !s.Ok() {
+			return s
+		}
+	}
+
+	for db.imm != nil && db.bgError.Ok() && !db.closing {
+		db.bgCond.Wait()
+	}
+
+	switch {
+	case !db.bgError.Ok():
+		return db.bgError
+	case db.imm != nil:
+		return MakeStatusIoError("db is closing")
+	default:
+		return MakeStatusOk()
+	}
+}
+
+// Ask background thread to compact files in @level overlapping user
+// key range [start, limit] into the next level, and wait for it to
+// finish. Must be called with mutex held
+func (db *dbImpl) runManualCompaction(level int, start, limit []byte) Status {
+	m := &manualCompaction{level: level, start: start, limit: limit}
+
+	// only one manual compaction runs at a time
+	for db.manual != nil && db.bgError.Ok() && !db.closing {
+		db.bgCond.Wait()
+	}
+
+	if db.bgError.Ok() && !db.closing {
+		db.manual = m
+		db.maybeScheduleCompaction()
+	}
+
+	for !m.done && db.bgError.Ok() && !db.closing {
+		db.bgCond.Wait()
+	}
+
+	if db.manual == m {
+		db.manual = nil
+	}
+
+	switch {
+	case !db.bgError.Ok():
+		return db.bgError
+	case !m.done:
+		return MakeStatusIoError("db is closing")
+	default:
+		return MakeStatusOk()
+	}
+}
+
+// Run the pending manual compaction. Must be called with mutex held
+func (db *dbImpl) doManualCompaction() Status {
+	m := db.manual
+	s := MakeStatusOk()
+
+	c := db.compactionForRange(m.level, m.start, m.limit)
+	if c != nil {
+		s = db.doCompaction(c)
+	}
+
+	m.done = true
+	db.manual = nil
+	return s
+}
+
+// Run a compaction and install its result. Must be called with mutex
+// held, the mutex is released while tables are being merged
+func (db *dbImpl) doCompaction(c *compaction) Status {
+	// a single file without overlap in the next level is simply
+	// moved to the next level
+	if !c.manual && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 {
+		change := VersionLevelChange{fileNumber: c.inputs[0][0]}
+		change.MoveLevel(int32(c.level), int32(c.level+1))
+		c.edit.versionLevelChanges = append(c.edit.versionLevelChanges, change)
+		return db.versions.LogAndApply(c.edit)
+	}
+
+	s := db.doCompactionWork(c)
+	if !s.Ok() {
+		// input files are kept, drop tables built so far
+		for _, add := range c.edit.adds {
+			db.env.DeleteFile(tableFileName(db.name, add.fileNumber))
+		}
+		return s
+	}
+
+	for which, files := range c.inputs {
+		for _, fh := range files {
+			change := VersionLevelChange{fileNumber: fh}
+			change.RemoveLevel(int32(c.level + which))
+			c.edit.versionLevelChanges = append(c.edit.versionLevelChanges, change)
+			c.edit.removes = append(c.edit.removes, fh)
+		}
+	}
+
+	return db.versions.LogAndApply(c.edit)
+}
+
+// Merge input files of a compaction into new tables of the next level.
+// Versions of a key that no reader can see are dropped, so are
+// deletions if there is no older version of the key in lower levels.
+// The new tables are added into the edit of the compaction
+func (db *dbImpl) doCompactionWork(c *compaction) Status {
+	children := make([]Iterator, 0, len(c.inputs[0])+len(c.inputs[1]))
+	defer func() {
+		for _, child := range children {
+			child.Release()
+		}
+	}()
+
+	for _, files := range c.inputs {
+		for _, fh := range files {
+			// compaction reads each block once, keep it out of the cache
+			iter, s := db.tables.newIterator(fh, &ReadOptions{DontFillCache: true})
+			if !s.Ok() {
+				return s
+			}
+			children = append(children, iter)
+		}
+	}
+
+	smallestSnapshot := db.smallestSnapshot()
+	user := db.comparator.user
+
+	db.mutex.Unlock()
+	defer db.mutex.Lock()
+
+	input := MakeMergingIterator(children, db.comparator)
+	output := &keyValueList{}
+	outputSize := 0
+
+	var currentUserKey []byte
+	lastSequenceForKey := kMaxSequenceNumber
+
+	for input.SeekToFirst(); input.Valid(); input.Next() {
+		key := input.Key()
+		parsed, ok := ParseInternalKey(key)
+		if !ok {
+			return MakeStatusCorruption("bad internal key in table")
+		}
+
+		if currentUserKey == nil || user.Compare(parsed.userKey, currentUserKey) != 0 {
+			// the first version of a user key. Finish current output
+			// if it is big enough, versions of a user key are never
+			// split into different tables
+			if outputSize >= kTableSizeHint {
+				s := db.finishCompactionOutput(c, output)
+				if !s.Ok() {
+					return s
+				}
+				output, outputSize = &keyValueList{}, 0
+			}
+
+			currentUserKey = parsed.userKey
+			lastSequenceForKey = kMaxSequenceNumber
+		}
+
+		drop := false
+		switch {
+		case lastSequenceForKey <= smallestSnapshot:
+			// hidden by a newer version that every reader can see
+			drop = true
+		case parsed.valueType == kTypeDeletion &&
+			parsed.sequence <= smallestSnapshot &&
+			db.isBaseLevelForKey(c, parsed.userKey):
+			// nothing older to delete, and every reader can see the
+			// deletion
+			drop = true
+		}
+
+		lastSequenceForKey = parsed.sequence
+
+		if !drop {
+			output.Add(key, input.Value())
+			outputSize = outputSize + len(key) + len(input.Value())
+		}
+	}
+
+	// a table that fails to be read ends the merge early, its
+	// remaining entries must not be lost with the input files
+	if s := input.Status(); !s.Ok() {
+		return s
+	}
+
+	if len(output.keys) > 0 {
+		return db.finishCompactionOutput(c, output)
+	}
+
+	return MakeStatusOk()
+}
+
+// Save entries of a compaction output into a new table file, and add
+// the table to the next level of the compaction. Must be called with
+// mutex released
+func (db *dbImpl) finishCompactionOutput(c *compaction, output *keyValueList) Status {
+	db.mutex.Lock()
+	number := db.versions.NewFileNumber()
+	db.mutex.Unlock()
+
+	name := tableFileName(db.name, number)
+	file, s := db.env.NewWritableFile(name)
+	if !s.Ok() {
+		return s
+	}
+
+	info, s := buildTable(output, file, db.comparator, &db.options)
+	file.Close()
+	if !s.Ok() {
+		db.env.DeleteFile(name)
+		return s
+	}
+
+	c.edit.adds = append(c.edit.adds, VersionFileAdd{number, info})
+
+	change := VersionLevelChange{fileNumber: number}
+	change.AddLevel(int32(c.level + 1))
+	c.edit.versionLevelChanges = append(c.edit.versionLevelChanges, change)
+
+	return MakeStatusOk()
+}
+
+// A list of sorted key value pairs held in memory
+type keyValueList struct {
+	keys   [][]byte
+	values [][]byte
+	idx    int
+}
+
+// append a pair at the end of the list
+func (l *keyValueList) Add(key, value []byte) {
+	l.keys = append(l.keys, key)
+	l.values = append(l.values, value)
+}
+
+func (l *keyValueList) Valid() bool {
+	return l.idx >= 0 && l.idx < len(l.keys)
+}
+
+func (l *keyValueList) SeekToFirst() {
+	l.idx = 0
+}
+
+func (l *keyValueList) SeekToLast() {
+	l.idx = len(l.keys) - 1
+}
+
+func (l *keyValueList) Seek(key []byte) {
+	panic("not supported")
+}
+
+func (l *keyValueList) Next() {
+	l.idx++
+}
+
+func (l *keyValueList) Prev() {
+	l.idx--
+}
+
+func (l *keyValueList) Key() []byte {
+	return l.keys[l.idx]
+}
+
+func (l *keyValueList) Value() []byte {
+	return l.values[l.idx]
+}
+
+func (l *keyValueList) Status() Status {
+	return MakeStatusOk()
+}
+
+func (l *keyValueList) Release() {
+}
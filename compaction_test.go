@@ -0,0 +1,380 @@
+package gdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// open a fresh database with a small write buffer under
+// /tmp/compaction_test, so that memtables are flushed often
+func openCompactionTestDB(t *testing.T, name string) (string, DB) {
+	root := "/tmp/compaction_test/" + name
+
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/compaction_test", os.ModePerm)
+
+	db, s := Open(root, Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", root, " ", s.ToString())
+	}
+
+	return root, db
+}
+
+// wait until background work of @db is done
+func waitForCompaction(db DB) {
+	impl := db.(*dbImpl)
+	impl.mutex.Lock()
+	for impl.bgScheduled {
+		impl.bgCond.Wait()
+	}
+	impl.mutex.Unlock()
+}
+
+// return number of files in each level
+func levelFileCounts(db DB) []int {
+	impl := db.(*dbImpl)
+	impl.mutex.Lock()
+	defer impl.mutex.Unlock()
+
+	ret := make([]int, kNumLevels)
+	for level, files := range impl.versions.current.levels {
+		ret[level] = len(files)
+	}
+	return ret
+}
+
+func targetLevel(level int) *int {
+	return &level
+}
+
+func TestCompactionMovesFilesDown(t *testing.T) {
+	root, db := openCompactionTestDB(t, "MovesFilesDown")
+
+	wo := WriteOptions{}
+	value := make([]byte, 200)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 4000; i++ {
+			key := fmt.Sprintf("key%06d", i)
+			copy(value, fmt.Sprintf("%s-%d", key, round))
+			db.Put(wo, []byte(key), value)
+		}
+	}
+
+	waitForCompaction(db)
+
+	counts := levelFileCounts(db)
+	if counts[0] >= kL0CompactionTrigger {
+		t.Error("Too many level 0 files ", counts)
+	}
+
+	lower := 0
+	for _, c := range counts[1:] {
+		lower = lower + c
+	}
+	if lower == 0 {
+		t.Error("Nothing is compacted into lower levels ", counts)
+	}
+
+	check := func(db DB) {
+		for i := 0; i < 4000; i++ {
+			key := fmt.Sprintf("key%06d", i)
+			expect := fmt.Sprintf("%s-%d", key, 4)
+			val, s := db.Get(ReadOptions{}, []byte(key))
+			if !s.Ok() || string(val[:len(expect)]) != expect {
+				t.Fatal("Fails to get key ", key)
+			}
+		}
+	}
+
+	check(db)
+	db.Close()
+
+	db, s := Open(root, Options{WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+
+	check(db)
+	db.Close()
+}
+
+func TestCompactionKeepsSnapshotsAndDeletes(t *testing.T) {
+	_, db := openCompactionTestDB(t, "KeepsSnapshotsAndDeletes")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(wo, []byte(key), []byte("old"))
+	}
+
+	snap := db.GetSnapshot()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		if i%2 == 0 {
+			db.Delete(wo, []byte(key))
+		} else {
+			db.Put(wo, []byte(key), []byte("new"))
+		}
+	}
+
+	// push the updates through several compactions
+	value := make([]byte, 200)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 4000; i++ {
+			db.Put(wo, []byte(fmt.Sprintf("filler%06d", i)), value)
+		}
+	}
+
+	waitForCompaction(db)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		if i%2 == 0 {
+			checkGet(t, db, key, "")
+		} else {
+			checkGet(t, db, key, "new")
+		}
+
+		val, s := db.Get(ReadOptions{Snapshot: snap}, []byte(key))
+		if !s.Ok() || string(val) != "old" {
+			t.Fatal("Fails to get key ", key, " from snapshot")
+		}
+	}
+
+	db.ReleaseSnapshot(snap)
+}
+
+func TestCompactRangeTargetLevel(t *testing.T) {
+	_, db := openCompactionTestDB(t, "CompactRangeTargetLevel")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(wo, []byte(key), []byte(key))
+	}
+
+	s := db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(3)}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	counts := levelFileCounts(db)
+	for level, c := range counts {
+		if level != 3 && c != 0 {
+			t.Error("Files left out of target level ", counts)
+		}
+	}
+	if counts[3] == 0 {
+		t.Error("No file in target level ", counts)
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		checkGet(t, db, key, key)
+	}
+
+	// compact the rest to the deepest level holding data
+	s = db.CompactRange(CompactRangeOptions{}, []byte("key001000"), nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	counts = levelFileCounts(db)
+	if counts[3] == 0 || counts[0] != 0 {
+		t.Error("Data is moved out of the deepest level ", counts)
+	}
+}
+
+func TestCompactRangeTargetLevelZero(t *testing.T) {
+	_, db := openCompactionTestDB(t, "CompactRangeTargetLevelZero")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	db.Put(wo, []byte("a"), []byte("va"))
+	db.Put(wo, []byte("b"), []byte("vb"))
+
+	s := db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(0)}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	counts := levelFileCounts(db)
+	for level, c := range counts {
+		if level != 0 && c != 0 {
+			t.Error("Files moved out of level 0 ", counts)
+		}
+	}
+	if counts[0] == 0 {
+		t.Error("Memtable is not flushed to level 0 ", counts)
+	}
+	checkGet(t, db, "a", "va")
+	checkGet(t, db, "b", "vb")
+}
+
+func TestCompactRangeRejectsShallowTargetLevel(t *testing.T) {
+	_, db := openCompactionTestDB(t, "CompactRangeRejectsShallowTargetLevel")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(wo, []byte(key), []byte(key))
+	}
+	s := db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(3)}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	s = db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(1)}, nil, nil)
+	if !s.IsInvalidArgument() {
+		t.Error("Accepts target level above data in the range ", s.ToString())
+	}
+	if counts := levelFileCounts(db); counts[3] == 0 {
+		t.Error("Data is moved out of level 3 ", counts)
+	}
+
+	// a range without data below the target is accepted
+	s = db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(1)},
+		[]byte("zzz"), nil)
+	if !s.Ok() {
+		t.Error("Fails to compact empty range ", s.ToString())
+	}
+}
+
+func TestCompactRangeDropsDeletes(t *testing.T) {
+	_, db := openCompactionTestDB(t, "CompactRangeDropsDeletes")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	value := make([]byte, 100)
+	for i := 0; i < 3000; i++ {
+		db.Put(wo, []byte(fmt.Sprintf("key%06d", i)), value)
+	}
+
+	s := db.CompactRange(CompactRangeOptions{}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	for i := 0; i < 3000; i++ {
+		db.Delete(wo, []byte(fmt.Sprintf("key%06d", i)))
+	}
+
+	s = db.CompactRange(CompactRangeOptions{}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	// both the values and the deletions are gone
+	counts := levelFileCounts(db)
+	for _, c := range counts {
+		if c != 0 {
+			t.Error("Deleted data is not reclaimed ", counts)
+		}
+	}
+
+	checkGet(t, db, "key000000", "")
+}
+
+func TestCompactionStopsOnCorruptTable(t *testing.T) {
+	root := "/tmp/compaction_test/StopsOnCorruptTable"
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/compaction_test", os.ModePerm)
+
+	opt := Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024, ParanoidChecks: true}
+	db, s := Open(root, opt)
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	wo := WriteOptions{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(wo, []byte(key), []byte(key))
+	}
+	s = db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(2)}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	// flip a byte in the first leaf block of every table
+	tables, _ := filepath.Glob(root + "/table_*.tbl")
+	for _, fname := range tables {
+		data, _ := ioutil.ReadFile(fname)
+		data[100] ^= 0x01
+		ioutil.WriteFile(fname, data, 0644)
+	}
+
+	// the compaction fails instead of dropping entries it cannot read
+	s = db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(3)}, nil, nil)
+	if !s.IsCorruption() {
+		t.Fatal("Compaction over a corrupted table succeeds")
+	}
+	for _, fname := range tables {
+		if _, err := os.Stat(fname); err != nil {
+			t.Error("Input table is deleted ", fname)
+		}
+	}
+	after, _ := filepath.Glob(root + "/table_*.tbl")
+	if len(after) != len(tables) {
+		t.Error("Partial output tables are left ", len(after), " ", len(tables))
+	}
+}
+
+func TestCompactPointerMovesOnlyOnSuccess(t *testing.T) {
+	root := "/tmp/compaction_test/CompactPointer"
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/compaction_test", os.ModePerm)
+
+	db, s := Open(root, Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(WriteOptions{}, []byte(key), []byte(key))
+	}
+	s = db.CompactRange(CompactRangeOptions{TargetLevel: targetLevel(1)}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+	waitForCompaction(db)
+
+	impl := db.(*dbImpl)
+	impl.mutex.Lock()
+	defer impl.mutex.Unlock()
+
+	// a compaction that fails leaves the pointer in place
+	c := impl.compactionForRange(1, nil, nil)
+	if c == nil || impl.versions.compactPointer[1] != nil {
+		t.Fatal("Compaction is not set up, or moves the pointer early")
+	}
+	missing := c.inputs[0][0]
+	os.Rename(tableFileName(root, missing), tableFileName(root, missing)+".bak")
+	impl.tables.evict(missing)
+	if s := impl.doCompaction(c); s.Ok() {
+		t.Fatal("Compaction with a missing table succeeds")
+	}
+	if impl.versions.compactPointer[1] != nil {
+		t.Error("Failed compaction moves the pointer")
+	}
+
+	os.Rename(tableFileName(root, missing)+".bak", tableFileName(root, missing))
+	c = impl.compactionForRange(1, nil, nil)
+	if s := impl.doCompaction(c); !s.Ok() {
+		t.Fatal("Fails to compact ", s.ToString())
+	}
+	if impl.versions.compactPointer[1] == nil {
+		t.Error("Compaction does not move the pointer")
+	}
+}
@@ -0,0 +1,499 @@
+package gdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// compresses blocks of a table builder. Buffers are reused across
+// blocks, a compressed block is valid until the next one is compressed
+type blockCompressor struct {
+	compression CompressionType
+	maxRatio    float64
+	scratch     []byte
+	buf         bytes.Buffer
+	flate       *flate.Writer
+}
+
+// compress @raw, return the block to be written and its block type.
+// @raw itself is returned if compression does not save enough
+func (c *blockCompressor) compress(raw []byte) ([]byte, byte) {
+	var ret []byte
+	switch c.compression {
+	case SnappyCompression:
+		c.scratch = snappyEncode(c.scratch[:0], raw)
+		ret = c.scratch
+
+	case LZ4Compression:
+		c.scratch = EncodeUint32(c.scratch[:0], uint32(len(raw)))
+		c.scratch = lz4Encode(c.scratch, raw)
+		ret = c.scratch
+
+	case FlateCompression:
+		c.buf.Reset()
+		c.scratch = EncodeUint32(c.scratch[:0], uint32(len(raw)))
+		c.buf.Write(c.scratch)
+		if c.flate == nil {
+			c.flate, _ = flate.NewWriter(&c.buf, flate.DefaultCompression)
+		} else {
+			c.flate.Reset(&c.buf)
+		}
+		c.flate.Write(raw)
+		c.flate.Close()
+		ret = c.buf.Bytes()
+
+	default:
+		return raw, byte(NoCompression)
+	}
+
+	if float64(len(ret)) > float64(len(raw))*c.maxRatio {
+		return raw, byte(NoCompression)
+	}
+	return ret, byte(c.compression)
+}
+
+// return content of @data, which is a block of @blockType
+func decompressBlock(blockType byte, data []byte) ([]byte, Status) {
+	switch CompressionType(blockType) {
+	case NoCompression:
+		return data, MakeStatusOk()
+
+	case SnappyCompression:
+		return snappyDecode(data)
+
+	case LZ4Compression:
+		if len(data) < 4 {
+			return nil, MakeStatusCorruption("truncated lz4 block")
+		}
+		size, rest := DecodeUint32(data)
+		return lz4Decode(rest, int(size))
+
+	case FlateCompression:
+		if len(data) < 4 {
+			return nil, MakeStatusCorruption("truncated flate block")
+		}
+		size, rest := DecodeUint32(data)
+		return flateDecode(rest, int(size))
+	}
+
+	return nil, MakeStatusCorruption(fmt.Sprintf("unknown block type %d", blockType))
+}
+
+// Flate blocks start with the raw size in 4 bytes, followed by the
+// deflate stream
+const (
+	// deflate expands a byte into at most this many bytes. A block
+	// declaring a size beyond this expansion of its input is corrupted
+	flateMaxExpansion = 1032
+)
+
+// decode deflate compressed @src of @size bytes. Output beyond @size
+// is never produced, a stream inflating to more is corrupted
+func flateDecode(src []byte, size int) ([]byte, Status) {
+	if size < 0 || int64(size) > int64(len(src))*flateMaxExpansion {
+		return nil, MakeStatusCorruption("bad flate block size")
+	}
+
+	dst := bytes.NewBuffer(make([]byte, 0, size+1))
+	r := io.LimitReader(flate.NewReader(bytes.NewReader(src)), int64(size)+1)
+	if _, err := dst.ReadFrom(r); err != nil {
+		return nil, MakeStatusCorruption("bad flate block: " + err.Error())
+	}
+	if dst.Len() != size {
+		return nil, MakeStatusCorruption("flate block does not match its size")
+	}
+	return dst.Bytes(), MakeStatusOk()
+}
+
+// Snappy block format: the raw size in a varint, followed by elements
+// that are either literals or copies of earlier output. The low 2 bits
+// of the first byte of an element tell its kind
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	// the longest output of an element per byte of it, a 3 byte copy
+	// of 64 bytes. A block declaring a size beyond this expansion of
+	// its input is corrupted
+	snappyMaxExpansion = 22
+
+	// input is encoded in chunks, offsets of copies within a chunk
+	// fit in 2 bytes
+	snappyMaxChunkSize = 65536
+	// chunks shorter than this are written as a literal
+	snappyMinMatchChunkSize = 17
+	snappyInputMargin       = 16 - 1
+	snappyTableBits         = 14
+)
+
+// append the snappy encoding of @src to @dst
+func snappyEncode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	for len(src) > 0 {
+		p := src
+		if len(p) > snappyMaxChunkSize {
+			p = p[:snappyMaxChunkSize]
+		}
+		src = src[len(p):]
+
+		if len(p) < snappyMinMatchChunkSize {
+			dst = snappyEmitLiteral(dst, p)
+		} else {
+			dst = snappyEncodeChunk(dst, p)
+		}
+	}
+	return dst
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+// encode @src of at most snappyMaxChunkSize bytes. Positions of 4 byte
+// sequences are hashed into a table, a sequence seen before is written
+// as a copy. Bytes are skipped faster the longer no match is found
+func snappyEncodeChunk(dst, src []byte) []byte {
+	var table [1 << snappyTableBits]uint16
+
+	sLimit := len(src) - snappyInputMargin
+	nextEmit := 0
+	s := 1
+	nextHash := snappyHash(xxLoad32(src[s:]))
+
+	for {
+		skip := 32
+		nextS := s
+		candidate := 0
+		for {
+			s = nextS
+			step := skip >> 5
+			nextS = s + step
+			skip = skip + step
+			if nextS > sLimit {
+				return snappyEmitRemainder(dst, src, nextEmit)
+			}
+			candidate = int(table[nextHash])
+			table[nextHash] = uint16(s)
+			nextHash = snappyHash(xxLoad32(src[nextS:]))
+			if xxLoad32(src[s:]) == xxLoad32(src[candidate:]) {
+				break
+			}
+		}
+
+		dst = snappyEmitLiteral(dst, src[nextEmit:s])
+
+		// emit copies as long as the bytes right after a copy match
+		// something seen before
+		for {
+			base := s
+			s = s + 4
+			for i := candidate + 4; s < len(src) && src[i] == src[s]; i, s = i+1, s+1 {
+			}
+			dst = snappyEmitCopy(dst, base-candidate, s-base)
+			nextEmit = s
+			if s >= sLimit {
+				return snappyEmitRemainder(dst, src, nextEmit)
+			}
+
+			table[snappyHash(xxLoad32(src[s-1:]))] = uint16(s - 1)
+			h := snappyHash(xxLoad32(src[s:]))
+			candidate = int(table[h])
+			table[h] = uint16(s)
+			if xxLoad32(src[s:]) != xxLoad32(src[candidate:]) {
+				nextHash = snappyHash(xxLoad32(src[s+1:]))
+				s++
+				break
+			}
+		}
+	}
+}
+
+func snappyEmitRemainder(dst, src []byte, nextEmit int) []byte {
+	if nextEmit < len(src) {
+		dst = snappyEmitLiteral(dst, src[nextEmit:])
+	}
+	return dst
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, uint8(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, uint8(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, uint8(n), uint8(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, uint8(n), uint8(n>>8), uint8(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral)
+		dst = EncodeUint32(dst, n)
+	}
+	return append(dst, lit...)
+}
+
+// emit a copy of @length bytes from @offset bytes back. A copy of 2
+// byte offset holds at most 64 bytes, longer copies are split
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, uint8(offset), uint8(offset>>8))
+		length = length - 64
+	}
+	if length > 64 {
+		// leave at least 4 bytes for the last copy
+		dst = append(dst, 59<<2|snappyTagCopy2, uint8(offset), uint8(offset>>8))
+		length = length - 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, uint8(length-1)<<2|snappyTagCopy2, uint8(offset), uint8(offset>>8))
+	}
+	return append(dst, uint8(offset>>8)<<5|uint8(length-4)<<2|snappyTagCopy1, uint8(offset))
+}
+
+// decode snappy encoded @src
+func snappyDecode(src []byte) ([]byte, Status) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > math.MaxUint32 || size > uint64(len(src))*snappyMaxExpansion {
+		return nil, MakeStatusCorruption("bad snappy block size")
+	}
+
+	dst := make([]byte, size)
+	d, s := 0, n
+	for s < len(src) {
+		var length, offset int
+		switch src[s] & 0x03 {
+		case snappyTagLiteral:
+			x := uint32(src[s] >> 2)
+			extra := 0
+			if x >= 60 {
+				extra = int(x) - 59
+			}
+			s = s + 1 + extra
+			if s > len(src) {
+				return nil, MakeStatusCorruption("truncated snappy literal")
+			}
+			if extra > 0 {
+				x = 0
+				for i := 0; i < extra; i++ {
+					x = x | uint32(src[s-extra+i])<<(8*i)
+				}
+			}
+
+			length = int(x) + 1
+			if length > len(dst)-d || length > len(src)-s {
+				return nil, MakeStatusCorruption("bad snappy literal")
+			}
+			copy(dst[d:], src[s:s+length])
+			d = d + length
+			s = s + length
+			continue
+
+		case snappyTagCopy1:
+			s = s + 2
+			if s > len(src) {
+				return nil, MakeStatusCorruption("truncated snappy copy")
+			}
+			length = 4 + int(src[s-2])>>2&0x07
+			offset = int(src[s-2])&0xe0<<3 | int(src[s-1])
+
+		case snappyTagCopy2:
+			s = s + 3
+			if s > len(src) {
+				return nil, MakeStatusCorruption("truncated snappy copy")
+			}
+			length = 1 + int(src[s-3])>>2
+			offset = int(src[s-2]) | int(src[s-1])<<8
+
+		case snappyTagCopy4:
+			s = s + 5
+			if s > len(src) {
+				return nil, MakeStatusCorruption("truncated snappy copy")
+			}
+			length = 1 + int(src[s-5])>>2
+			offset = int(xxLoad32(src[s-4:]))
+		}
+
+		if offset <= 0 || offset > d || length > len(dst)-d {
+			return nil, MakeStatusCorruption("bad snappy copy")
+		}
+		// source and destination may overlap
+		for i := 0; i < length; i++ {
+			dst[d+i] = dst[d-offset+i]
+		}
+		d = d + length
+	}
+
+	if d != len(dst) {
+		return nil, MakeStatusCorruption("snappy block is shorter than its size")
+	}
+	return dst, MakeStatusOk()
+}
+
+// LZ4 block format: a sequence of literals followed by a copy, repeated
+// until the last sequence which has literals only. A token byte holds
+// the literal length in high 4 bits and the copy length less 4 in low
+// 4 bits, lengths of 15 continue in following bytes
+const (
+	lz4MinMatch = 4
+	// the last copy starts at least this many bytes before the end
+	lz4MatchFindLimit = 12
+	// the last bytes are always literals
+	lz4LastLiterals = 5
+	lz4MaxOffset    = 65535
+	lz4TableBits    = 14
+	// a length byte of 255 adds 255 bytes of output, nothing else
+	// expands more. A block declaring a size beyond this expansion of
+	// its input is corrupted
+	lz4MaxExpansion = 255
+)
+
+// append the lz4 encoding of @src to @dst
+func lz4Encode(dst, src []byte) []byte {
+	var table [1 << lz4TableBits]int32
+
+	anchor := 0
+	matchLimit := len(src) - lz4LastLiterals
+	for s := 0; s+lz4MatchFindLimit <= len(src); {
+		seq := xxLoad32(src[s:])
+		h := (seq * 2654435761) >> (32 - lz4TableBits)
+		// positions are saved plus one, zero means empty
+		ref := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if ref < 0 || s-ref > lz4MaxOffset || xxLoad32(src[ref:]) != seq {
+			s++
+			continue
+		}
+
+		n := lz4MinMatch
+		for s+n < matchLimit && src[ref+n] == src[s+n] {
+			n++
+		}
+		dst = lz4EmitSequence(dst, src[anchor:s], s-ref, n)
+		s = s + n
+		anchor = s
+	}
+
+	// last literals
+	lit := len(src) - anchor
+	if lit >= 15 {
+		dst = append(dst, 15<<4)
+		dst = lz4AppendLength(dst, lit-15)
+	} else {
+		dst = append(dst, uint8(lit)<<4)
+	}
+	return append(dst, src[anchor:]...)
+}
+
+func lz4EmitSequence(dst, lit []byte, offset, length int) []byte {
+	token := uint8(0)
+	if len(lit) >= 15 {
+		token = 15 << 4
+	} else {
+		token = uint8(len(lit)) << 4
+	}
+	length = length - lz4MinMatch
+	if length >= 15 {
+		token = token | 15
+	} else {
+		token = token | uint8(length)
+	}
+
+	dst = append(dst, token)
+	if len(lit) >= 15 {
+		dst = lz4AppendLength(dst, len(lit)-15)
+	}
+	dst = append(dst, lit...)
+	dst = append(dst, uint8(offset), uint8(offset>>8))
+	if length >= 15 {
+		dst = lz4AppendLength(dst, length-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n = n - 255
+	}
+	return append(dst, uint8(n))
+}
+
+// read the rest of a length of 15 or more, starting at @s
+func lz4ReadLength(src []byte, s, n int) (int, int, bool) {
+	for {
+		if s >= len(src) {
+			return 0, s, false
+		}
+		b := src[s]
+		s++
+		n = n + int(b)
+		if b != 255 {
+			return n, s, true
+		}
+	}
+}
+
+// decode lz4 encoded @src of @size bytes
+func lz4Decode(src []byte, size int) ([]byte, Status) {
+	if size < 0 || int64(size) > int64(len(src))*lz4MaxExpansion {
+		return nil, MakeStatusCorruption("bad lz4 block size")
+	}
+
+	dst := make([]byte, 0, size)
+	s := 0
+	for {
+		if s >= len(src) {
+			return nil, MakeStatusCorruption("truncated lz4 block")
+		}
+		token := src[s]
+		s++
+
+		ok := true
+		lit := int(token >> 4)
+		if lit == 15 {
+			lit, s, ok = lz4ReadLength(src, s, lit)
+		}
+		if !ok || lit > len(src)-s || lit > size-len(dst) {
+			return nil, MakeStatusCorruption("bad lz4 literal")
+		}
+		dst = append(dst, src[s:s+lit]...)
+		s = s + lit
+
+		// the last sequence has no copy
+		if s == len(src) {
+			break
+		}
+
+		if s+2 > len(src) {
+			return nil, MakeStatusCorruption("truncated lz4 copy")
+		}
+		offset := int(src[s]) | int(src[s+1])<<8
+		s = s + 2
+
+		length := int(token & 0x0f)
+		if length == 15 {
+			length, s, ok = lz4ReadLength(src, s, length)
+		}
+		length = length + lz4MinMatch
+		if !ok || offset == 0 || offset > len(dst) || length > size-len(dst) {
+			return nil, MakeStatusCorruption("bad lz4 copy")
+		}
+		// source and destination may overlap
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != size {
+		return nil, MakeStatusCorruption("lz4 block is shorter than its size")
+	}
+	return dst, MakeStatusOk()
+}
@@ -0,0 +1,156 @@
+package gdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// inputs of various sizes and redundancy
+func compressionTestInputs() [][]byte {
+	rnd := rand.New(rand.NewSource(301))
+	random := make([]byte, 10000)
+	rnd.Read(random)
+
+	var json bytes.Buffer
+	for i := 0; json.Len() < 200*1024; i++ {
+		fmt.Fprintf(&json, `{"id":%d,"name":"user%d","active":true,"tags":["a","b"]},`, i, i%37)
+	}
+
+	return [][]byte{
+		[]byte("a"),
+		[]byte("abcdefghijklmnopqrstuvwxyz"),
+		bytes.Repeat([]byte("a"), 100000),
+		bytes.Repeat([]byte("abc"), 1000),
+		random,
+		json.Bytes(),
+		append(json.Bytes()[:5000:5000], random...),
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	for _, input := range compressionTestInputs() {
+		encoded := snappyEncode(nil, input)
+		decoded, s := snappyDecode(encoded)
+		if !s.Ok() || !bytes.Equal(decoded, input) {
+			t.Fatal("Fails to decode input of ", len(input), " bytes ", s.ToString())
+		}
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for _, input := range compressionTestInputs() {
+		encoded := lz4Encode(nil, input)
+		decoded, s := lz4Decode(encoded, len(input))
+		if !s.Ok() || !bytes.Equal(decoded, input) {
+			t.Fatal("Fails to decode input of ", len(input), " bytes ", s.ToString())
+		}
+	}
+}
+
+func TestCompressionKnownEncodings(t *testing.T) {
+	// "abc" as a literal, then a copy of 7 bytes at offset 3
+	snappy := []byte{10, 2 << 2, 'a', 'b', 'c', (7-4)<<2 | snappyTagCopy1, 3}
+	decoded, s := snappyDecode(snappy)
+	if !s.Ok() || string(decoded) != "abcabcabca" {
+		t.Error("Bad snappy decoding ", string(decoded), " ", s.ToString())
+	}
+
+	// "abc" and a copy of 15 bytes at offset 3, then 5 literals
+	lz4 := []byte{3<<4 | (15 - 4), 'a', 'b', 'c', 3, 0, 5 << 4, 'x', 'x', 'x', 'x', 'x'}
+	decoded, s = lz4Decode(lz4, 23)
+	if !s.Ok() || string(decoded) != "abcabcabcabcabcabcxxxxx" {
+		t.Error("Bad lz4 decoding ", string(decoded), " ", s.ToString())
+	}
+}
+
+func TestCompressionRejectsBadInput(t *testing.T) {
+	input := compressionTestInputs()[5]
+	snappy := snappyEncode(nil, input)
+	lz4 := lz4Encode(nil, input)
+
+	bad := [][]byte{
+		snappy[:len(snappy)/2],
+		// copy before start of output
+		{10, 2 << 2, 'a', 'b', 'c', (7-4)<<2 | snappyTagCopy1, 4},
+		// longer than declared size
+		{2, 2 << 2, 'a', 'b', 'c'},
+	}
+	for _, data := range bad {
+		if _, s := snappyDecode(data); !s.IsCorruption() {
+			t.Error("Bad snappy block is decoded ", data)
+		}
+	}
+
+	if _, s := lz4Decode(lz4[:len(lz4)/2], len(input)); !s.IsCorruption() {
+		t.Error("Truncated lz4 block is decoded")
+	}
+	if _, s := lz4Decode(lz4, len(input)-1); !s.IsCorruption() {
+		t.Error("lz4 block longer than its size is decoded")
+	}
+	if _, s := lz4Decode([]byte{3<<4 | 1, 'a', 'b', 'c', 4, 0, 0}, 8); !s.IsCorruption() {
+		t.Error("lz4 copy before start of output is decoded")
+	}
+
+	// declared sizes beyond what the input can expand to are rejected
+	// before output is allocated
+	huge := binary.AppendUvarint(nil, math.MaxUint32)
+	if _, s := snappyDecode(append(huge, 0)); !s.IsCorruption() {
+		t.Error("Snappy block of huge size is decoded")
+	}
+	if _, s := decompressBlock(byte(LZ4Compression), []byte{0xff, 0xff, 0xff, 0xff, 0}); !s.IsCorruption() {
+		t.Error("lz4 block of huge size is decoded")
+	}
+
+	if _, s := decompressBlock(byte(FlateCompression), []byte{0xff, 0xff}); !s.IsCorruption() {
+		t.Error("Bad flate block is decoded")
+	}
+
+	// a flate stream inflating beyond or short of its declared size
+	c := blockCompressor{compression: FlateCompression, maxRatio: 1}
+	flated, blockType := c.compress(input)
+	if decoded, s := decompressBlock(blockType, flated); blockType != byte(FlateCompression) || !s.Ok() || !bytes.Equal(decoded, input) {
+		t.Fatal("Fails to decode a flate block")
+	}
+	for _, size := range []int{len(input) - 1, len(input) + 1, math.MaxUint32} {
+		data := append(EncodeUint32(nil, uint32(size)), flated[4:]...)
+		if _, s := decompressBlock(byte(FlateCompression), data); !s.IsCorruption() {
+			t.Error("Flate block of wrong size ", size, " is decoded")
+		}
+	}
+	if _, s := decompressBlock(100, []byte("abc")); !s.IsCorruption() {
+		t.Error("Unknown block type is accepted")
+	}
+}
+
+func TestBlockCompressor(t *testing.T) {
+	inputs := compressionTestInputs()
+	json, random := inputs[5], inputs[4]
+
+	for _, ct := range []CompressionType{SnappyCompression, LZ4Compression, FlateCompression} {
+		c := blockCompressor{compression: ct, maxRatio: kDefaultMaxCompressionRatio}
+		for _, input := range [][]byte{json, random} {
+			data, blockType := c.compress(input)
+			decoded, s := decompressBlock(blockType, data)
+			if !s.Ok() || !bytes.Equal(decoded, input) {
+				t.Fatal("Fails to decompress ", ct, " ", s.ToString())
+			}
+		}
+
+		// verbose data is compressed, random data is not worth it
+		if data, blockType := c.compress(json); blockType != byte(ct) || len(data) > len(json)/4 {
+			t.Error("Compresses poorly ", ct, " ", len(data))
+		}
+		if data, blockType := c.compress(random); blockType != byte(NoCompression) || len(data) != len(random) {
+			t.Error("Keeps a block that does not compress ", ct)
+		}
+	}
+
+	var c blockCompressor
+	if data, blockType := c.compress(json); blockType != byte(NoCompression) || len(data) != len(json) {
+		t.Error("Compresses without a compression type")
+	}
+}
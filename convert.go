@@ -0,0 +1,415 @@
+package gdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Format version of a db. Version 1 dbs are in native byte order of
+// the machine writing them, and have no format file. Version 2 dbs are
+// in little endian byte order
+const kDBFormatVersion = 2
+
+// return format version of db @name
+func readDBFormatVersion(env Env, name string) (int, Status) {
+	fname := formatFileName(name)
+	if !env.FileExists(fname) {
+		return 1, MakeStatusOk()
+	}
+
+	size, s := env.GetFileSize(fname)
+	if !s.Ok() {
+		return 0, s
+	}
+
+	file, s := env.NewSequentialFile(fname)
+	if !s.Ok() {
+		return 0, s
+	}
+	defer file.Close()
+
+	data, s := file.Read(make([]byte, size))
+	if !s.Ok() {
+		return 0, s
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || version < 1 {
+		return 0, MakeStatusCorruption(fmt.Sprintf("bad format file %s", fname))
+	}
+	return version, MakeStatusOk()
+}
+
+// record that db @name is of the current format version
+func writeDBFormatVersion(env Env, name string) Status {
+	fname := formatFileName(name)
+	future := fname + ".future"
+
+	// may be left by a crash
+	env.DeleteFile(future)
+	file, s := env.NewWritableFile(future)
+	if !s.Ok() {
+		return s
+	}
+
+	s = file.Append([]byte(fmt.Sprintf("%d\n", kDBFormatVersion)))
+	if s.Ok() {
+		s = file.Flush()
+	}
+	file.Close()
+	if !s.Ok() {
+		return s
+	}
+
+	return env.RenameFile(future, fname)
+}
+
+// Make sure a db of format version @version can be opened. Old dbs
+// written on little endian machines are the same as new ones, they
+// are upgraded in place. Others have to be converted by ConvertDB
+func checkDBFormatVersion(env Env, name string, version int) Status {
+	switch {
+	case version > kDBFormatVersion:
+		return MakeStatusInvalidArgument(fmt.Sprintf(
+			"%s is of format version %d, newer than supported version %d",
+			name, version, kDBFormatVersion))
+	case version == kDBFormatVersion:
+		return MakeStatusOk()
+	case !isNativeLittleEndian():
+		return MakeStatusInvalidArgument(fmt.Sprintf(
+			"%s is in native byte order of an old release, convert it by ConvertDB", name))
+	default:
+		return writeDBFormatVersion(env, name)
+	}
+}
+
+// Rewrite db @name written by an old release into the current format.
+// Old files are in native byte order of the machine writing them, so
+// the conversion must run on that machine, or one of the same byte
+// order. The db must not be open. Files are replaced one by one, keep
+// a copy of the db until the conversion succeeds. A conversion stopped
+// by a crash can be run again, files converted by it are skipped
+func ConvertDB(name string, opt Options) Status {
+	opt, s := sanitizeOptions(opt)
+	if !s.Ok() {
+		return s
+	}
+
+	env := opt.Env
+	version, s := readDBFormatVersion(env, name)
+	switch {
+	case !s.Ok():
+		return s
+	case version == kDBFormatVersion:
+		return MakeStatusOk()
+	case version > kDBFormatVersion:
+		return checkDBFormatVersion(env, name, version)
+	}
+
+	// the manifest holds the name of the version log
+	manifest := strings.Join([]string{name, "manifest"}, "/")
+	size, s := env.GetFileSize(manifest)
+	if !s.Ok() {
+		return s
+	}
+	file, s := env.NewSequentialFile(manifest)
+	if !s.Ok() {
+		return s
+	}
+	data, s := file.Read(make([]byte, size))
+	file.Close()
+	if !s.Ok() {
+		return s
+	}
+	versionLog := string(data)
+
+	// the version log is converted last, if an earlier run got that
+	// far it is already in the current format
+	converted, s := finishLogConversion(env, versionLog)
+	if !s.Ok() {
+		return s
+	}
+	d := nativeEndian
+	if converted {
+		d = littleEndian
+	}
+
+	var edits []*VersionEdit
+	var logs []string
+	s = readLogFile(env, versionLog, d, func(record []byte) Status {
+		edit := &VersionEdit{}
+		if _, ok := edit.decodeFrom(record, d); !ok {
+			return MakeStatusCorruption(fmt.Sprintf("bad record in %s", versionLog))
+		}
+		edits = append(edits, edit)
+		return MakeStatusOk()
+	})
+	if !s.Ok() {
+		return s
+	}
+
+	// convert all files that were ever added, some may have been
+	// deleted since
+	c := MakeInternalKeyComparator(opt.Comparator)
+	sizes := make(map[uint64]uint32)
+	for _, edit := range edits {
+		for _, add := range edit.adds {
+			if add.info.IsLogFile() {
+				fname := walFileName(name, add.fileNumber)
+				if env.FileExists(fname) {
+					s = convertLogFile(env, fname, convertWriteBatch)
+					logs = append(logs, fname)
+				}
+			} else {
+				fname := tableFileName(name, add.fileNumber)
+				if env.FileExists(fname) {
+					sizes[add.fileNumber], s = convertTableFile(env, fname, c, &opt)
+				}
+			}
+			if !s.Ok() {
+				return s
+			}
+		}
+	}
+
+	// at last the version log, with internal keys and sizes of tables
+	// updated
+	i := 0
+	s = convertLogFile(env, versionLog, func(record []byte) ([]byte, Status) {
+		edit := edits[i]
+		i++
+		for j := range edit.adds {
+			info := &edit.adds[j].info
+			if info.IsLogFile() {
+				continue
+			}
+			info.minKey = convertInternalKey(info.minKey)
+			info.maxKey = convertInternalKey(info.maxKey)
+			if size, ok := sizes[edit.adds[j].fileNumber]; ok {
+				info.size = size
+			}
+		}
+		return edit.EncodeTo(nil), MakeStatusOk()
+	})
+	if !s.Ok() {
+		return s
+	}
+
+	s = writeDBFormatVersion(env, name)
+	if !s.Ok() {
+		return s
+	}
+
+	// the format file tells the db is converted, markers of logs are
+	// no longer needed
+	for _, fname := range append(logs, versionLog) {
+		env.DeleteFile(convertedLogFileName(fname))
+	}
+	return MakeStatusOk()
+}
+
+// pass each record of log file @fname to @f. Records are decoded by @d
+func readLogFile(env Env, fname string, d decoder, f func([]byte) Status) Status {
+	file, s := env.NewSequentialFile(fname)
+	if !s.Ok() {
+		return s
+	}
+	defer file.Close()
+
+	reader := Reader{file, 0, true}
+	buffer := make([]byte, 4096)
+	for true {
+		record, result := reader.readRecord(buffer, d)
+		switch result {
+		case ReadStatusOk:
+			if s = f(record); !s.Ok() {
+				return s
+			}
+		case ReadStatusEOF:
+			return MakeStatusOk()
+		default:
+			return MakeStatusCorruption(fmt.Sprintf("corrupted log %s", fname))
+		}
+	}
+
+	panic("should not reach here")
+	return MakeStatusOk()
+}
+
+// Return true if log file @fname has been rewritten by an earlier run
+// of ConvertDB. If the run crashed before the new log replaced the old
+// one, it is replaced now
+func finishLogConversion(env Env, fname string) (bool, Status) {
+	if !env.FileExists(convertedLogFileName(fname)) {
+		return false, MakeStatusOk()
+	}
+
+	future := fname + ".future"
+	if env.FileExists(future) {
+		return true, env.RenameFile(future, fname)
+	}
+	return true, MakeStatusOk()
+}
+
+// pass each record of log file @fname in native byte order to
+// @convert. If it returns a record, the log file is rewritten with
+// the returned records. The new log is written aside and marked as
+// complete before it replaces the old one, a log marked by an earlier
+// run is not converted again
+func convertLogFile(env Env, fname string, convert func([]byte) ([]byte, Status)) Status {
+	converted, s := finishLogConversion(env, fname)
+	if !s.Ok() || converted {
+		return s
+	}
+
+	var out WritableFile
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+
+	future := fname + ".future"
+	s = readLogFile(env, fname, nativeEndian, func(record []byte) Status {
+		converted, s := convert(record)
+		if !s.Ok() || converted == nil {
+			return s
+		}
+
+		if out == nil {
+			env.DeleteFile(future)
+			file, s := env.NewWritableFile(future)
+			if !s.Ok() {
+				return s
+			}
+			out = file
+		}
+
+		writer := Writer{out}
+		return writer.AddRecord(converted)
+	})
+	if !s.Ok() || out == nil {
+		return s
+	}
+
+	s = out.Flush()
+	out.Close()
+	out = nil
+	if !s.Ok() {
+		return s
+	}
+
+	marker, s := env.NewWritableFile(convertedLogFileName(fname))
+	if !s.Ok() {
+		return s
+	}
+	marker.Close()
+	return env.RenameFile(future, fname)
+}
+
+// rebuild a write batch in native byte order
+func convertWriteBatch(record []byte) ([]byte, Status) {
+	if len(record) < kBatchHeaderSize {
+		return nil, MakeStatusCorruption("write batch is too small")
+	}
+	seq, rest := nativeEndian.uint64(record)
+	count, rest := nativeEndian.uint32(rest)
+
+	batch := MakeWriteBatch()
+	for len(rest) > 0 {
+		tag := rest[0]
+		oldLen := len(rest) - 1
+		key, remaining := nativeEndian.slice(rest[1:])
+		if len(remaining) == oldLen {
+			return nil, MakeStatusCorruption("bad key in write batch")
+		}
+
+		switch tag {
+		case kTypeValue:
+			oldLen = len(remaining)
+			var value []byte
+			value, remaining = nativeEndian.slice(remaining)
+			if len(remaining) == oldLen {
+				return nil, MakeStatusCorruption("bad value in write batch")
+			}
+			batch.Put(key, value)
+
+		case kTypeDeletion:
+			batch.Delete(key)
+
+		default:
+			return nil, MakeStatusCorruption("unknown update type in write batch")
+		}
+		rest = remaining
+	}
+
+	if batch.Count() != int(count) {
+		return nil, MakeStatusCorruption("write batch has wrong count")
+	}
+	batch.setSequence(seq)
+	return batch.Data(), MakeStatusOk()
+}
+
+// rebuild an internal key whose trailer is in native byte order
+func convertInternalKey(key []byte) []byte {
+	if len(key) < kInternalKeyTrailerSize {
+		return key
+	}
+
+	trailer, _ := nativeEndian.uint64(key[len(key)-kInternalKeyTrailerSize:])
+	ret := append([]byte(nil), extractUserKey(key)...)
+	return EncodeUint64(ret, trailer)
+}
+
+// rewrite table file @fname of an old release, return its new size
+func convertTableFile(env Env, fname string, c *InternalKeyComparator, opt *Options) (uint32, Status) {
+	size, s := env.GetFileSize(fname)
+	if !s.Ok() {
+		return 0, s
+	}
+
+	file, s := env.NewRandomAccessFile(fname)
+	if !s.Ok() {
+		return 0, s
+	}
+
+	table, s := OpenTable(file, size, c, nil)
+	if !s.Ok() {
+		file.Close()
+		return 0, s
+	}
+	defer table.Close()
+
+	// converted by an earlier run that crashed
+	if table.version == kTableFormatVersion {
+		return uint32(size), MakeStatusOk()
+	}
+
+	future := fname + ".future"
+	env.DeleteFile(future)
+	out, s := env.NewWritableFile(future)
+	if !s.Ok() {
+		return 0, s
+	}
+
+	iter := &convertKeyIter{table.NewIterator(&ReadOptions{})}
+	info, s := buildTable(iter, out, c, opt)
+	iter.Release()
+	out.Close()
+	if !s.Ok() {
+		env.DeleteFile(future)
+		return 0, s
+	}
+
+	return info.size, env.RenameFile(future, fname)
+}
+
+// an iterator over internal keys whose trailers are in native byte order
+type convertKeyIter struct {
+	Iterator
+}
+
+func (it *convertKeyIter) Key() []byte {
+	return convertInternalKey(it.Iterator.Key())
+}
@@ -0,0 +1,218 @@
+package gdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDBFormatVersion(t *testing.T) {
+	root := "/tmp/convert_test/DBFormatVersion"
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/convert_test", os.ModePerm)
+
+	db, s := Open(root, Options{CreateIfMissing: true})
+	if !s.Ok() {
+		t.Fatal("Fails to create db ", s.ToString())
+	}
+	db.Put(WriteOptions{Sync: true}, []byte("key"), []byte("value"))
+	db.Close()
+
+	env := NativeEnv{}
+	version, s := readDBFormatVersion(env, root)
+	if !s.Ok() || version != kDBFormatVersion {
+		t.Fatal("New db has format version ", version)
+	}
+
+	// a db of an old release on a little endian machine is upgraded
+	// when opened
+	if isNativeLittleEndian() {
+		os.Remove(formatFileName(root))
+		db, s = Open(root, Options{})
+		if !s.Ok() {
+			t.Fatal("Fails to open an old db ", s.ToString())
+		}
+		checkGet(t, db, "key", "value")
+		db.Close()
+
+		version, s = readDBFormatVersion(env, root)
+		if !s.Ok() || version != kDBFormatVersion {
+			t.Error("Old db is not upgraded ", version)
+		}
+	}
+
+	// dbs of newer versions are rejected
+	newer := fmt.Sprintf("%d\n", kDBFormatVersion+1)
+	ioutil.WriteFile(formatFileName(root), []byte(newer), 0644)
+	if _, s = Open(root, Options{}); !s.IsInvalidArgument() {
+		t.Error("Opens a db of a newer format version")
+	}
+	if s = ConvertDB(root, Options{}); !s.IsInvalidArgument() {
+		t.Error("Converts a db of a newer format version")
+	}
+
+	ioutil.WriteFile(formatFileName(root), []byte("garbage"), 0644)
+	if _, s = Open(root, Options{}); !s.IsCorruption() {
+		t.Error("Opens a db with a bad format file")
+	}
+}
+
+// make db @root look like a db of an old release, whose tables are of
+// format version 2. Return names of its tables
+func makeOldDB(t *testing.T, root string) []string {
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/convert_test", os.ModePerm)
+
+	opt := Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024}
+	db, s := Open(root, opt)
+	if !s.Ok() {
+		t.Fatal("Fails to create db ", s.ToString())
+	}
+
+	// some keys are in tables, the latest ones only in the log
+	value := make([]byte, 100)
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		copy(value, key)
+		db.Put(WriteOptions{}, key, value)
+	}
+	db.Delete(WriteOptions{}, []byte("key000010"))
+	db.Close()
+
+	// make it look like a db of an old release, whose tables are of
+	// format version 2
+	os.Remove(formatFileName(root))
+	tables, _ := filepath.Glob(root + "/table_*.tbl")
+	if len(tables) == 0 {
+		t.Fatal("Memtable is never written into tables")
+	}
+	for _, fname := range tables {
+		data, _ := ioutil.ReadFile(fname)
+		copy(data[len(data)-16:], EncodeUint32(nil, 2))
+		ioutil.WriteFile(fname, data, 0644)
+	}
+
+	return tables
+}
+
+func TestConvertDB(t *testing.T) {
+	if !isNativeLittleEndian() {
+		t.Skip("old dbs are built by rewriting format versions of little endian files")
+	}
+
+	root := "/tmp/convert_test/ConvertDB"
+	tables := makeOldDB(t, root)
+
+	s := ConvertDB(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to convert db ", s.ToString())
+	}
+
+	version, s := readDBFormatVersion(NativeEnv{}, root)
+	if !s.Ok() || version != kDBFormatVersion {
+		t.Error("Converted db has format version ", version)
+	}
+	for _, fname := range tables {
+		data, _ := ioutil.ReadFile(fname)
+		footer, s := decodeTableFooter(data[len(data)-kTableFooterSize:], uint64(len(data)))
+		if !s.Ok() || footer.version != kTableFormatVersion {
+			t.Error("Table ", fname, " is not converted")
+		}
+	}
+
+	// converting again does nothing
+	if s = ConvertDB(root, Options{}); !s.Ok() {
+		t.Error("Fails to convert a converted db ", s.ToString())
+	}
+
+	db, s := Open(root, Options{WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open converted db ", s.ToString())
+	}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		if i == 10 {
+			checkGet(t, db, key, "")
+			continue
+		}
+		val, s := db.Get(ReadOptions{}, []byte(key))
+		if !s.Ok() || string(val[:len(key)]) != key {
+			t.Fatal("Fails to get key ", key)
+		}
+	}
+	db.Close()
+}
+
+// an env that fails renames onto @failRename, and records files
+// opened for writing
+type convertCrashEnv struct {
+	NativeEnv
+	failRename string
+	written    []string
+}
+
+func (e *convertCrashEnv) NewWritableFile(name string) (WritableFile, Status) {
+	e.written = append(e.written, name)
+	return e.NativeEnv.NewWritableFile(name)
+}
+
+func (e *convertCrashEnv) RenameFile(src string, target string) Status {
+	if target == e.failRename {
+		return MakeStatusIoError("crash")
+	}
+	return e.NativeEnv.RenameFile(src, target)
+}
+
+func TestConvertDBAfterCrash(t *testing.T) {
+	if !isNativeLittleEndian() {
+		t.Skip("old dbs are built by rewriting format versions of little endian files")
+	}
+
+	root := "/tmp/convert_test/ConvertDBAfterCrash"
+	makeOldDB(t, root)
+	data, _ := ioutil.ReadFile(root + "/manifest")
+	versionLog := string(data)
+
+	// crash before the new version log replaces the old one
+	env := &convertCrashEnv{failRename: versionLog}
+	if s := ConvertDB(root, Options{Env: env}); s.Ok() {
+		t.Fatal("Conversion does not fail")
+	}
+
+	// crash before the format file is written
+	env = &convertCrashEnv{failRename: formatFileName(root)}
+	if s := ConvertDB(root, Options{Env: env}); s.Ok() {
+		t.Fatal("Conversion does not fail")
+	}
+	for _, fname := range env.written {
+		if fname != formatFileName(root)+".future" {
+			t.Error("Converted file ", fname, " is converted again")
+		}
+	}
+
+	env = &convertCrashEnv{}
+	if s := ConvertDB(root, Options{Env: env}); !s.Ok() {
+		t.Fatal("Fails to convert db ", s.ToString())
+	}
+	if len(env.written) != 1 {
+		t.Error("Converted files are converted again ", env.written)
+	}
+	if markers, _ := filepath.Glob(root + "/*.converted"); len(markers) != 0 {
+		t.Error("Markers are left behind ", markers)
+	}
+
+	db, s := Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to open converted db ", s.ToString())
+	}
+	defer db.Close()
+	for i := 0; i < 3000; i += 7 {
+		key := fmt.Sprintf("key%06d", i)
+		val, s := db.Get(ReadOptions{}, []byte(key))
+		if !s.Ok() || string(val[:len(key)]) != key {
+			t.Fatal("Fails to get key ", key)
+		}
+	}
+}
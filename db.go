@@ -0,0 +1,990 @@
+package gdb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// the maximum size of batches merged into a single log record
+const kMaxBatchGroupSize = 1024 * 1024
+
+// The implementation of DB interface. Recent updates are appended to
+// a write ahead log and kept in a memtable, older data are saved in
+// table files which are tracked by a version set
+type dbImpl struct {
+	name       string
+	options    Options
+	env        Env
+	comparator *InternalKeyComparator
+	mutex      sync.Mutex
+	versions   *VersionSet
+	mem        *MemTable
+	tables     *tableCache
+	logFile    WritableFile
+	log        *Writer
+	logNumber  uint64
+	snapshots  *snapshotList
+
+	// a memtable being written into a table file, and the log file
+	// that holds its content
+	imm          *MemTable
+	immLogNumber uint64
+
+	// state of background work, protected by mutex
+	bgCond      *sync.Cond
+	bgScheduled bool
+	bgError     Status
+	closing     bool
+	manual      *manualCompaction
+
+	// writers waiting to write, the first one does the write
+	writers []*writer
+	// set by Close, the db takes no more reads or writes
+	closed bool
+}
+
+// Open a database named @name. If the database does not exist yet, it
+// is created if @opt asks for it. Otherwise, the state of the database
+// is recovered from the directory
+func Open(name string, opt Options) (DB, Status) {
+	opt, s := sanitizeOptions(opt)
+	if !s.Ok() {
+		return nil, s
+	}
+
+	db := &dbImpl{}
+	db.name = name
+	db.options = opt
+	db.env = opt.Env
+	db.comparator = MakeInternalKeyComparator(opt.Comparator)
+	db.snapshots = makeSnapshotList()
+	db.bgCond = sync.NewCond(&db.mutex)
+	db.bgError = MakeStatusOk()
+
+	manifest := strings.Join([]string{name, "manifest"}, "/")
+	exists := db.env.FileExists(manifest)
+	switch {
+	case exists && opt.ErrorIfExists:
+		return nil, MakeStatusInvalidArgument(fmt.Sprintf("%s exists", name))
+	case !exists && !opt.CreateIfMissing:
+		return nil, MakeStatusInvalidArgument(fmt.Sprintf("%s does not exist", name))
+	}
+
+	if exists {
+		version, s := readDBFormatVersion(db.env, name)
+		if s.Ok() {
+			s = checkDBFormatVersion(db.env, name, version)
+		}
+		if !s.Ok() {
+			return nil, s
+		}
+	} else {
+		s = db.env.CreateDir(name)
+		if s.Ok() {
+			s = writeDBFormatVersion(db.env, name)
+		}
+		if !s.Ok() {
+			return nil, s
+		}
+	}
+
+	var blockCache *BlockCache
+	if opt.BlockCacheCapacity > 0 {
+		blockCache = MakeBlockCache(opt.BlockCacheCapacity)
+	}
+	db.tables = makeTableCache(name, &db.options, db.comparator, blockCache)
+	db.versions = MakeVersionSet(name, db.env, db.comparator)
+	db.versions.tables = db.tables
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if exists {
+		s = db.versions.Recover()
+	}
+	if s.Ok() {
+		s = db.recoverLogFiles()
+	}
+	if !s.Ok() {
+		db.versions.Close()
+		db.tables.close()
+		return nil, s
+	}
+
+	db.mem = MakeMemTable(db.comparator, db.options.WriteBufferManager)
+	db.mem.Ref()
+	db.maybeScheduleCompaction()
+	return db, MakeStatusOk()
+}
+
+// Replay log files that have not been saved into tables yet. Content
+// of the logs is written into a level 0 table, then the logs are
+// replaced by a new empty log in a single version edit
+func (db *dbImpl) recoverLogFiles() Status {
+	edit := &VersionEdit{}
+	mem := MakeMemTable(db.comparator, db.options.WriteBufferManager)
+	defer mem.Release()
+
+	logFiles := db.versions.current.logFiles
+	for _, number := range logFiles {
+		s := db.replayLogFile(number, mem)
+		if !s.Ok() {
+			return s
+		}
+
+		edit.removes = append(edit.removes, number)
+	}
+
+	if !mem.Empty() {
+		s := db.writeLevel0Table(mem, edit)
+		if !s.Ok() {
+			return s
+		}
+	}
+
+	number := db.versions.NewFileNumber()
+	file, s := db.env.NewWritableFile(walFileName(db.name, number))
+	if !s.Ok() {
+		return s
+	}
+
+	edit.adds = append(edit.adds, VersionFileAdd{number, FileInfo{}})
+	s = db.versions.LogAndApply(edit)
+	if !s.Ok() {
+		file.Close()
+		return s
+	}
+
+	db.logFile = file
+	db.log = &Writer{file}
+	db.logNumber = number
+	return MakeStatusOk()
+}
+
+// Insert all records in a log file into @mem
+func (db *dbImpl) replayLogFile(number uint64, mem *MemTable) Status {
+	file, s := db.env.NewSequentialFile(walFileName(db.name, number))
+	if !s.Ok() {
+		return s
+	}
+
+	defer file.Close()
+
+	buffer := make([]byte, 4096)
+	reader := Reader{file, 0, true}
+
+	for true {
+		record, result := reader.ReadRecord(buffer)
+		switch result {
+		case ReadStatusOk:
+			batch, s := WriteBatchFromBytes(record)
+			if !s.Ok() {
+				return s
+			}
+
+			batch.insertInto(mem)
+
+			last := batch.Sequence() + uint64(batch.Count()) - 1
+			if last > db.versions.lastSequence {
+				db.versions.lastSequence = last
+			}
+
+		case ReadStatusEOF:
+			return MakeStatusOk()
+
+		case ReadStatusCorruption:
+			// a torn record at the end of the log is expected if
+			// the process crashed in the middle of a write
+			if db.options.ParanoidChecks {
+				return MakeStatusCorruption(fmt.Sprintf("corrupted log %d", number))
+			}
+			return MakeStatusOk()
+
+		default:
+			panic("unexpected result")
+		}
+	}
+
+	panic("should not reach here")
+	return MakeStatusOk()
+}
+
+func (db *dbImpl) Put(opt WriteOptions, key, value []byte) Status {
+	batch := MakeWriteBatch()
+	batch.Put(key, value)
+	return db.Write(opt, batch)
+}
+
+func (db *dbImpl) Delete(opt WriteOptions, key []byte) Status {
+	batch := MakeWriteBatch()
+	batch.Delete(key)
+	return db.Write(opt, batch)
+}
+
+// Apply all updates in a batch atomically. The batch is assigned
+// sequence numbers, appended to write ahead log as a single record,
+// then applied to memtable
+func (db *dbImpl) Write(opt WriteOptions, updates *WriteBatch) Status {
+	if updates.Count() == 0 {
+		return MakeStatusOk()
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.write(opt, updates)
+}
+
+// a writer waiting in the write queue
+type writer struct {
+	batch  *WriteBatch
+	sync   bool
+	done   bool
+	status Status
+	cond   *sync.Cond
+}
+
+// Writers are queued, the one at the head of the queue is the leader.
+// It merges batches of the writers behind it into a single log record,
+// and syncs the log once if any of them asks for it. The leader then
+// hands the result to every writer in the group. A nil @updates asks
+// to switch memtable even if it is not full. Must be called with mutex
+// held, the mutex is released while the log is written
+func (db *dbImpl) write(opt WriteOptions, updates *WriteBatch) Status {
+	if db.closed {
+		return MakeStatusIoError("db is closed")
+	}
+
+	w := &writer{batch: updates, sync: opt.Sync}
+	w.cond = sync.NewCond(&db.mutex)
+
+	db.writers = append(db.writers, w)
+	for !w.done && w != db.writers[0] {
+		w.cond.Wait()
+	}
+
+	// a leader has done the write for us
+	if w.done {
+		return w.status
+	}
+
+	s := db.makeRoomForWrite(updates == nil)
+	last := w
+
+	if s.Ok() && updates != nil {
+		var batch *WriteBatch
+		var doSync bool
+		batch, doSync, last = db.buildBatchGroup()
+		batch.setSequence(db.versions.lastSequence + 1)
+
+		// only the leader touches the log and the memtable, other
+		// writers are waiting in the queue. Readers of the memtable
+		// do not need the mutex
+		mem := db.mem
+		db.mutex.Unlock()
+		s = db.log.AddRecord(batch.Data())
+		if s.Ok() && doSync {
+			s = db.logFile.Flush()
+		}
+		if s.Ok() {
+			s = batch.insertInto(mem)
+		}
+		db.mutex.Lock()
+
+		if s.Ok() {
+			db.versions.lastSequence = batch.Sequence() + uint64(batch.Count()) - 1
+		} else {
+			// the log may end with a partial record, stop all
+			// further writes
+			db.bgError = s
+		}
+	}
+
+	for true {
+		ready := db.writers[0]
+		db.writers[0] = nil
+		db.writers = db.writers[1:]
+
+		if ready != w {
+			ready.status, ready.done = s, true
+			ready.cond.Signal()
+		}
+
+		if ready == last {
+			break
+		}
+	}
+
+	// wake up the next leader, or Close waiting for the queue to
+	// drain
+	if len(db.writers) > 0 {
+		db.writers[0].cond.Signal()
+	} else if db.closed {
+		db.bgCond.Broadcast()
+	}
+
+	return s
+}
+
+// Merge batches of writers at the head of the write queue into a
+// single batch. Return the batch, whether any writer asks for sync,
+// and the last writer in the group. Must be called with mutex held
+func (db *dbImpl) buildBatchGroup() (batch *WriteBatch, doSync bool, last *writer) {
+	first := db.writers[0]
+	batch, doSync, last = first.batch, first.sync, first
+
+	// limit the size of a group, so that a small write is not slowed
+	// down too much by the group
+	size := first.batch.ByteSize()
+	maxSize := kMaxBatchGroupSize
+	if size <= kMaxBatchGroupSize/8 {
+		maxSize = size + kMaxBatchGroupSize/8
+	}
+
+	for _, w := range db.writers[1:] {
+		// a memtable switch is not merged
+		if w.batch == nil {
+			break
+		}
+
+		size = size + w.batch.ByteSize()
+		if size > maxSize {
+			break
+		}
+
+		// do not change the batch of the first writer
+		if batch == first.batch {
+			batch = MakeWriteBatch()
+			batch.append(first.batch)
+		}
+
+		batch.append(w.batch)
+		doSync = doSync || w.sync
+		last = w
+	}
+
+	return
+}
+
+// Look up @key in memtables and tables. The mutex is only held to pin
+// the memtables and the current version, lookups run without it
+func (db *dbImpl) Get(opt ReadOptions, key []byte) ([]byte, Status) {
+	db.mutex.Lock()
+	if db.closed {
+		db.mutex.Unlock()
+		return nil, MakeStatusIoError("db is closed")
+	}
+
+	seq := db.versions.lastSequence
+	if opt.Snapshot != nil {
+		seq = opt.Snapshot.Sequence()
+	}
+
+	mem, imm, current := db.mem, db.imm, db.versions.current
+	mem.Ref()
+	if imm != nil {
+		imm.Ref()
+	}
+	current.Ref()
+	files := current.filesForKey(db.comparator.user, key)
+	db.mutex.Unlock()
+
+	defer func() {
+		db.mutex.Lock()
+		mem.Unref()
+		if imm != nil {
+			imm.Unref()
+		}
+		current.Unref()
+		db.mutex.Unlock()
+	}()
+
+	tag, value, found := mem.Get(key, seq)
+	if !found && imm != nil {
+		tag, value, found = imm.Get(key, seq)
+	}
+
+	if !found {
+		var s Status
+		tag, value, found, s = db.getFromTables(opt, files, key, seq)
+		if !s.Ok() {
+			return nil, s
+		}
+	}
+
+	if !found || tag == kTypeDeletion {
+		return nil, MakeStatusNotFound("")
+	}
+
+	// the value may live in a memtable that is released afterwards
+	ret := make([]byte, len(value))
+	copy(ret, value)
+	return ret, MakeStatusOk()
+}
+
+// look up the newest version of a key that is not newer than @seq in
+// table files @files, which are searched in order. The first file
+// containing the key wins
+func (db *dbImpl) getFromTables(opt ReadOptions, files []uint64, key []byte, seq uint64) (tag uint8, value []byte, found bool, s Status) {
+	lookup := MakeInternalKey(nil, key, seq, kValueTypeForSeek)
+
+	for _, fh := range files {
+		value, s = db.tables.get(fh, lookup, opt)
+		switch {
+		case s.Ok():
+			tag, found = kTypeValue, true
+			return
+		case s.IsDeleted():
+			// older data of the key in lower levels is hidden
+			tag, found, s = kTypeDeletion, true, MakeStatusOk()
+			return
+		case !s.IsNotFound():
+			return
+		}
+	}
+
+	s = MakeStatusOk()
+	return
+}
+
+// Return an iterator over the state of the db as of the snapshot in
+// @opt, or the latest state. The iterator keeps memtables and tables
+// it reads alive until it is released, it must be released when it is
+// not needed any more. Keys and values it returns must not be used
+// after that. If a table cannot be loaded, an empty iterator reporting
+// the error by its status is returned
+func (db *dbImpl) NewIterator(opt ReadOptions) Iterator {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.closed {
+		return &emptyIterator{MakeStatusIoError("db is closed")}
+	}
+
+	sequence := db.versions.lastSequence
+	if opt.Snapshot != nil {
+		sequence = opt.Snapshot.Sequence()
+	}
+
+	children := make([]Iterator, 0, 16)
+	for _, files := range db.versions.current.levels {
+		for _, fh := range files {
+			iter, s := db.tables.newIterator(fh, &opt)
+			if !s.Ok() {
+				for _, child := range children {
+					child.Release()
+				}
+				return &emptyIterator{s}
+			}
+			children = append(children, iter)
+		}
+	}
+
+	mem, imm := db.mem, db.imm
+	children = append(children, mem.NewIterator())
+	mem.Ref()
+	if imm != nil {
+		children = append(children, imm.NewIterator())
+		imm.Ref()
+	}
+
+	internal := MakeMergingIterator(children, db.comparator)
+	ret := makeDBIter(internal, db.comparator.user, sequence)
+	ret.cleanup = func() {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+
+		mem.Unref()
+		if imm != nil {
+			imm.Unref()
+		}
+	}
+	return ret
+}
+
+// Create a snapshot of current state. The snapshot has to be released
+// by ReleaseSnapshot when it is not needed any more
+func (db *dbImpl) GetSnapshot() Snapshot {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.snapshots.New(db.versions.lastSequence)
+}
+
+// Release a snapshot created by GetSnapshot. Releasing it again does
+// nothing
+func (db *dbImpl) ReleaseSnapshot(snap Snapshot) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.snapshots.Delete(snap.(*snapshotImpl))
+}
+
+// Estimate number of bytes the data in each range takes. For a table
+// partially overlapping a range, the size is taken from offsets of
+// leaf blocks in the table, so the result is accurate to a block. The
+// mutex is only held to pin the memtables and the current version. A
+// closed db reports zero sizes
+func (db *dbImpl) GetApproximateSizes(opt SizeApproximationOptions, ranges []Range) []uint64 {
+	ret := make([]uint64, len(ranges))
+	db.mutex.Lock()
+	if db.closed {
+		db.mutex.Unlock()
+		return ret
+	}
+
+	mem, imm, current := db.mem, db.imm, db.versions.current
+	mem.Ref()
+	if imm != nil {
+		imm.Ref()
+	}
+	current.Ref()
+
+	var files []uint64
+	var infos []*FileInfo
+	for _, level := range current.levels {
+		for _, fh := range level {
+			files = append(files, fh)
+			infos = append(infos, db.versions.fileMap[fh])
+		}
+	}
+	db.mutex.Unlock()
+
+	defer func() {
+		db.mutex.Lock()
+		mem.Unref()
+		if imm != nil {
+			imm.Unref()
+		}
+		current.Unref()
+		db.mutex.Unlock()
+	}()
+
+	for i, r := range ranges {
+		for j, fh := range files {
+			ret[i] = ret[i] + db.approximateSizeInFile(fh, infos[j], r)
+		}
+
+		if opt.IncludeMemtable {
+			ret[i] = ret[i] + db.approximateSizeInMemTable(mem, r)
+			if imm != nil {
+				ret[i] = ret[i] + db.approximateSizeInMemTable(imm, r)
+			}
+		}
+	}
+
+	return ret
+}
+
+// Estimate number of bytes of table file @fh described by @fi in range
+// @r. The file must be pinned by a version
+func (db *dbImpl) approximateSizeInFile(fh uint64, fi *FileInfo, r Range) uint64 {
+	user := db.comparator.user
+	minKey, maxKey := extractUserKey(fi.minKey), extractUserKey(fi.maxKey)
+
+	if r.Start != nil && user.Compare(maxKey, r.Start) < 0 {
+		return 0
+	}
+	if r.Limit != nil && user.Compare(minKey, r.Limit) >= 0 {
+		return 0
+	}
+
+	// the file is fully covered, avoid loading the table
+	startInside := r.Start != nil && user.Compare(minKey, r.Start) < 0
+	limitInside := r.Limit != nil && user.Compare(maxKey, r.Limit) >= 0
+	if !startInside && !limitInside {
+		return uint64(fi.size)
+	}
+
+	h, s := db.tables.findTable(fh)
+	if !s.Ok() {
+		return 0
+	}
+	defer db.tables.release(h)
+	table := h.Value().(*Table)
+
+	start, limit := uint64(0), uint64(fi.size)
+	if startInside {
+		key := MakeInternalKey(nil, r.Start, kMaxSequenceNumber, kValueTypeForSeek)
+		start = table.ApproximateOffsetOf(key)
+	}
+	if limitInside {
+		key := MakeInternalKey(nil, r.Limit, kMaxSequenceNumber, kValueTypeForSeek)
+		limit = table.ApproximateOffsetOf(key)
+	}
+
+	if limit < start {
+		return 0
+	}
+	return limit - start
+}
+
+// Return number of bytes of keys and values in @mem within range @r
+func (db *dbImpl) approximateSizeInMemTable(mem *MemTable, r Range) uint64 {
+	user := db.comparator.user
+	ret := uint64(0)
+
+	iter := mem.NewIterator()
+	if r.Start != nil {
+		iter.Seek(MakeInternalKey(nil, r.Start, kMaxSequenceNumber, kValueTypeForSeek))
+	} else {
+		iter.SeekToFirst()
+	}
+
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if r.Limit != nil && user.Compare(extractUserKey(key), r.Limit) >= 0 {
+			break
+		}
+		ret = ret + uint64(len(key)+len(iter.Value()))
+	}
+
+	return ret
+}
+
+// Compact memtable and all levels overlapping [start, limit) into
+// the target level. A nil @start or @limit means the range is
+// unbounded on that side. Files overlapping the range are compacted
+// as a whole. A target level above the deepest level holding data in
+// the range is rejected
+func (db *dbImpl) CompactRange(opt CompactRangeOptions, start, limit []byte) Status {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	s := db.flushMemTable()
+	if !s.Ok() {
+		return s
+	}
+
+	deepest := 0
+	for level := 1; level < kNumLevels; level++ {
+		files := db.overlappingFiles(db.versions.current, level, start, limit)
+		if len(files) > 0 {
+			deepest = level
+		}
+	}
+
+	target := deepest
+	if opt.TargetLevel == nil {
+		if target == 0 {
+			target = 1
+		}
+	} else {
+		target = *opt.TargetLevel
+		if target >= kNumLevels {
+			target = kNumLevels - 1
+		}
+		if target < deepest {
+			return MakeStatusInvalidArgument(fmt.Sprintf(
+				"target level %d is above level %d holding data in the range",
+				*opt.TargetLevel, deepest))
+		}
+	}
+
+	for level := 0; level < target; level++ {
+		s = db.runManualCompaction(level, start, limit)
+		if !s.Ok() {
+			return s
+		}
+	}
+
+	return MakeStatusOk()
+}
+
+// Close the database. Data in memtable is recovered from write ahead
+// log when the database is opened again. Writes already queued finish
+// first, later reads and writes fail. Closing it again does nothing
+func (db *dbImpl) Close() Status {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.closed {
+		return MakeStatusOk()
+	}
+	db.closed = true
+
+	// writers already queued go on, the leader appends to the log
+	// without the mutex
+	for len(db.writers) > 0 {
+		db.bgCond.Wait()
+	}
+
+	// wait for background work to finish
+	db.closing = true
+	for db.bgScheduled {
+		db.bgCond.Wait()
+	}
+
+	s := db.logFile.Close()
+	db.mem.Unref()
+	if db.imm != nil {
+		db.imm.Unref()
+	}
+	db.versions.Close()
+	db.tables.close()
+	return s
+}
+
+// Make sure there is room in memtable for a write. If memtable is full,
+// it becomes the immutable memtable and is written into a table file
+// in background. A new memtable and a new log file replace it. If the
+// previous immutable memtable is still being written, wait for it.
+// If @force is true, memtable is switched even if it is not full.
+// Must be called with mutex held
+func (db *dbImpl) makeRoomForWrite(force bool) Status {
+	for true {
+		switch {
+		case !db.bgError.Ok():
+			return db.bgError
+
+		case !force && db.mem.ApproximateMemoryUsage() < db.options.WriteBufferSize && !db.overBudget():
+			return MakeStatusOk()
+
+		case db.imm != nil:
+			db.bgCond.Wait()
+
+		case len(db.versions.current.levels[0]) >= kL0StopWritesTrigger:
+			// too many level 0 files, wait for compaction
+			db.bgCond.Wait()
+
+		default:
+			number := db.versions.NewFileNumber()
+			file, s := db.env.NewWritableFile(walFileName(db.name, number))
+			if !s.Ok() {
+				return s
+			}
+
+			edit := &VersionEdit{}
+			edit.adds = append(edit.adds, VersionFileAdd{number, FileInfo{}})
+			s = db.versions.LogAndApply(edit)
+			if !s.Ok() {
+				file.Close()
+				return s
+			}
+
+			db.logFile.Close()
+			db.logFile = file
+			db.log = &Writer{file}
+
+			db.mem.MarkImmutable()
+			db.imm, db.immLogNumber = db.mem, db.logNumber
+			db.mem, db.logNumber = MakeMemTable(db.comparator, db.options.WriteBufferManager), number
+			db.mem.Ref()
+			db.maybeScheduleCompaction()
+			force = false
+		}
+	}
+
+	panic("should not reach here")
+	return MakeStatusOk()
+}
+
+// Return true if memtables of all dbs sharing the write buffer manager
+// hold too much memory, and the memtable of this db holds enough of it
+// to be worth flushing. Must be called with mutex held
+func (db *dbImpl) overBudget() bool {
+	manager := db.options.WriteBufferManager
+	return manager != nil && !db.mem.Empty() && manager.ShouldFlushMemTable(db.mem.ApproximateMemoryUsage())
+}
+
+// Start background work if there is something to do. Must be called
+// with mutex held
+func (db *dbImpl) maybeScheduleCompaction() {
+	switch {
+	case db.bgScheduled || db.closing || !db.bgError.Ok():
+		return
+	case db.imm == nil && db.manual == nil && !db.needsCompaction():
+		return
+	default:
+		db.bgScheduled = true
+		go db.backgroundCall()
+	}
+}
+
+func (db *dbImpl) backgroundCall() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if !db.closing {
+		s := db.backgroundCompaction()
+		if !s.Ok() {
+			db.bgError = s
+		}
+	}
+
+	db.bgScheduled = false
+	db.maybeScheduleCompaction()
+	db.bgCond.Broadcast()
+}
+
+// Flush the immutable memtable if there is one, otherwise run the
+// requested manual compaction or a compaction between levels. Must be called with mutex held
+func (db *dbImpl) backgroundCompaction() Status {
+	if db.imm != nil {
+		return db.compactMemTable()
+	}
+
+	if db.manual != nil {
+		return db.doManualCompaction()
+	}
+
+	c := db.pickCompaction()
+	if c == nil {
+		return MakeStatusOk()
+	}
+
+	return db.doCompaction(c)
+}
+
+// Write the immutable memtable into a level 0 table, the log file
+// holding its content is not needed afterwards. Must be called with
+// mutex held
+func (db *dbImpl) compactMemTable() Status {
+	edit := &VersionEdit{}
+	s := db.writeLevel0Table(db.imm, edit)
+	if !s.Ok() {
+		return s
+	}
+
+	edit.removes = append(edit.removes, db.immLogNumber)
+	s = db.versions.LogAndApply(edit)
+	if !s.Ok() {
+		return s
+	}
+
+	db.imm.Unref()
+	db.imm = nil
+	return MakeStatusOk()
+}
+
+// Save content of a memtable into a new table file. The new table
+// is added to level 0 through @edit. Must be called with mutex held,
+// the mutex is released while the table is being built
+func (db *dbImpl) writeLevel0Table(mem *MemTable, edit *VersionEdit) Status {
+	number := db.versions.NewFileNumber()
+	name := tableFileName(db.name, number)
+
+	db.mutex.Unlock()
+
+	file, s := db.env.NewWritableFile(name)
+	var info FileInfo
+	if s.Ok() {
+		info, s = buildTable(mem.NewIterator(), file, db.comparator, &db.options)
+		file.Close()
+	}
+
+	db.mutex.Lock()
+
+	if !s.Ok() {
+		db.env.DeleteFile(name)
+		return s
+	}
+
+	edit.adds = append(edit.adds, VersionFileAdd{number, info})
+
+	change := VersionLevelChange{fileNumber: number}
+	change.AddLevel(0)
+	edit.versionLevelChanges = append(edit.versionLevelChanges, change)
+
+	return MakeStatusOk()
+}
+
+// Save all entries from @iter into a table file laid out as @opt asks.
+// The table builder needs buffers large enough to hold the entire
+// table, so entries are scanned twice: first to size the buffers, then
+// to build
+func buildTable(iter Iterator, file WritableFile, c Comparator, opt *Options) (info FileInfo, s Status) {
+	leafSize, maxKey := 0, 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		keyLen, valLen := len(iter.Key()), len(iter.Value())
+		// 2 varints of lengths, a byte of shared key length and
+		// a key offset for each entry
+		leafSize = leafSize + keyLen + valLen + 2*9 + 1 + 4
+		if keyLen > maxKey {
+			maxKey = keyLen
+		}
+	}
+
+	// a block is finished once its entries reach the block size,
+	// each block needs room for restart offsets alignment, tailer
+	// and trailer
+	numBlocks := leafSize/opt.BlockSize + 1
+	leafSize = leafSize + numBlocks*(32+kBlockTrailerSize)
+	indexSize := numBlocks*(maxKey+4+2*9+4) + 32 + kBlockTrailerSize
+
+	builder := MakeTableBuilder(make([]byte, leafSize), make([]byte, indexSize), file)
+	builder.blockSize = uint32(opt.BlockSize)
+	builder.restartInterval = uint32(opt.BlockRestartInterval)
+	builder.checksum = opt.Checksum
+	builder.compressor.compression = opt.Compression
+	builder.compressor.maxRatio = opt.MaxCompressionRatio
+	if opt.FilterPolicy != nil {
+		builder.filter = makeFilterBlockBuilder(makeInternalFilterPolicy(opt.FilterPolicy))
+	}
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		builder.Add(iter.Key(), iter.Value())
+	}
+	if s = iter.Status(); !s.Ok() {
+		return
+	}
+
+	if _, s = builder.Finalize(c); !s.Ok() {
+		return
+	}
+
+	s = file.Flush()
+	if !s.Ok() {
+		return
+	}
+
+	info.size = uint32(builder.FileSize())
+	info.minKey = append([]byte{}, builder.firstKey...)
+	info.maxKey = append([]byte{}, builder.prevKey...)
+	return
+}
+
+// An iterator that contains nothing, because of @status if it is not
+// nil
+type emptyIterator struct {
+	status Status
+}
+
+func (it *emptyIterator) Valid() bool {
+	return false
+}
+
+func (it *emptyIterator) SeekToFirst() {
+}
+
+func (it *emptyIterator) SeekToLast() {
+}
+
+func (it *emptyIterator) Seek(key []byte) {
+}
+
+func (it *emptyIterator) Next() {
+	panic("iterator is not valid")
+}
+
+func (it *emptyIterator) Prev() {
+	panic("iterator is not valid")
+}
+
+func (it *emptyIterator) Key() []byte {
+	panic("iterator is not valid")
+}
+
+func (it *emptyIterator) Value() []byte {
+	panic("iterator is not valid")
+}
+
+func (it *emptyIterator) Status() Status {
+	if it.status == nil {
+		return MakeStatusOk()
+	}
+	return it.status
+}
+
+func (it *emptyIterator) Release() {
+}
@@ -0,0 +1,196 @@
+package gdb
+
+// dbIter turns an iterator over internal keys into an iterator over
+// user keys as of a sequence number. Entries newer than the sequence
+// number, versions hidden by newer ones and deleted keys are skipped.
+//
+// When moving forward, the internal iterator points to the newest
+// visible entry of the current user key. When moving backward, it
+// points to the last entry before the current user key, whose key and
+// value are saved in @savedKey and @savedValue
+type dbIter struct {
+	iter       Iterator
+	user       Comparator
+	sequence   uint64
+	forward    bool
+	valid      bool
+	savedKey   []byte
+	savedValue []byte
+	// if not nil, called once the iterator is released
+	cleanup  func()
+	released bool
+}
+
+func makeDBIter(iter Iterator, user Comparator, sequence uint64) *dbIter {
+	ret := &dbIter{}
+	ret.iter = iter
+	ret.user = user
+	ret.sequence = sequence
+	ret.forward = true
+	return ret
+}
+
+func (it *dbIter) Valid() bool {
+	return it.valid
+}
+
+func (it *dbIter) Key() []byte {
+	if it.forward {
+		return extractUserKey(it.iter.Key())
+	}
+	return it.savedKey
+}
+
+func (it *dbIter) Value() []byte {
+	if it.forward {
+		return it.iter.Value()
+	}
+	return it.savedValue
+}
+
+func (it *dbIter) Status() Status {
+	return it.iter.Status()
+}
+
+func (it *dbIter) Release() {
+	if it.released {
+		return
+	}
+	it.released = true
+
+	it.valid = false
+	it.iter.Release()
+	if it.cleanup != nil {
+		it.cleanup()
+	}
+}
+
+func (it *dbIter) SeekToFirst() {
+	it.forward = true
+	it.savedKey = it.savedKey[:0]
+	it.iter.SeekToFirst()
+	it.findNextUserEntry(false)
+}
+
+func (it *dbIter) SeekToLast() {
+	it.forward = false
+	it.savedValue = it.savedValue[:0]
+	it.iter.SeekToLast()
+	it.findPrevUserEntry()
+}
+
+func (it *dbIter) Seek(key []byte) {
+	it.forward = true
+	it.savedKey = it.savedKey[:0]
+	it.iter.Seek(MakeInternalKey(nil, key, it.sequence, kValueTypeForSeek))
+	it.findNextUserEntry(false)
+}
+
+func (it *dbIter) Next() {
+	if !it.forward {
+		// the internal iterator is before all entries of the current
+		// user key, which is saved in @savedKey
+		it.forward = true
+		if it.iter.Valid() {
+			it.iter.Next()
+		} else {
+			it.iter.SeekToFirst()
+		}
+	} else {
+		// skip remaining entries of the current user key
+		it.savedKey = append(it.savedKey[:0], extractUserKey(it.iter.Key())...)
+		it.iter.Next()
+	}
+
+	it.findNextUserEntry(true)
+}
+
+func (it *dbIter) Prev() {
+	if it.forward {
+		// move the internal iterator before all entries of the current
+		// user key
+		it.savedKey = append(it.savedKey[:0], extractUserKey(it.iter.Key())...)
+		for true {
+			it.iter.Prev()
+			if !it.iter.Valid() {
+				it.valid = false
+				it.savedKey = it.savedKey[:0]
+				it.savedValue = it.savedValue[:0]
+				return
+			}
+
+			if it.user.Compare(extractUserKey(it.iter.Key()), it.savedKey) < 0 {
+				break
+			}
+		}
+		it.forward = false
+	}
+
+	it.findPrevUserEntry()
+}
+
+// Move forward to the newest visible entry of the next user key that
+// is not deleted. If @skipping is true, entries with user keys not
+// greater than @savedKey are skipped
+func (it *dbIter) findNextUserEntry(skipping bool) {
+	for ; it.iter.Valid(); it.iter.Next() {
+		parsed, ok := ParseInternalKey(it.iter.Key())
+		if !ok || parsed.sequence > it.sequence {
+			continue
+		}
+
+		if skipping && it.user.Compare(parsed.userKey, it.savedKey) <= 0 {
+			continue
+		}
+
+		if parsed.valueType == kTypeDeletion {
+			// hide older versions of the deleted key
+			it.savedKey = append(it.savedKey[:0], parsed.userKey...)
+			skipping = true
+			continue
+		}
+
+		it.valid = true
+		return
+	}
+
+	it.valid = false
+}
+
+// Move backward past all entries of the previous user key that is
+// not deleted. Its newest visible value is saved in @savedKey and
+// @savedValue
+func (it *dbIter) findPrevUserEntry() {
+	valueType := uint8(kTypeDeletion)
+
+	for ; it.iter.Valid(); it.iter.Prev() {
+		parsed, ok := ParseInternalKey(it.iter.Key())
+		if !ok || parsed.sequence > it.sequence {
+			continue
+		}
+
+		if valueType != kTypeDeletion && it.user.Compare(parsed.userKey, it.savedKey) < 0 {
+			// found a visible value for the saved key
+			break
+		}
+
+		valueType = parsed.valueType
+		if valueType == kTypeDeletion {
+			it.savedKey = it.savedKey[:0]
+			it.savedValue = it.savedValue[:0]
+		} else {
+			it.savedKey = append(it.savedKey[:0], parsed.userKey...)
+			it.savedValue = append(it.savedValue[:0], it.iter.Value()...)
+		}
+	}
+
+	if valueType == kTypeDeletion {
+		it.valid = false
+		it.savedKey = it.savedKey[:0]
+		it.savedValue = it.savedValue[:0]
+		it.forward = true
+		return
+	}
+
+	it.valid = true
+}
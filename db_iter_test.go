@@ -0,0 +1,207 @@
+package gdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+// check that a new iterator of @db yields exactly the entries of @model
+func checkDBIterMatches(t *testing.T, db DB, opt ReadOptions, model map[string]string) {
+	iter := db.NewIterator(opt)
+	defer iter.Release()
+	checkIterMatches(t, iter, model)
+}
+
+// check that @iter yields exactly the entries of @model, in both
+// directions
+func checkIterMatches(t *testing.T, iter Iterator, model map[string]string) {
+	keys := make([]string, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	idx := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if idx >= len(keys) {
+			t.Fatal("Extra key ", string(iter.Key()))
+		}
+		if string(iter.Key()) != keys[idx] || string(iter.Value()) != model[keys[idx]] {
+			t.Fatal("Got ", string(iter.Key()), " expect ", keys[idx])
+		}
+		idx++
+	}
+	if idx != len(keys) {
+		t.Fatal("Forward scan returns ", idx, " keys, expect ", len(keys))
+	}
+
+	idx = len(keys) - 1
+	for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+		if idx < 0 {
+			t.Fatal("Extra key ", string(iter.Key()))
+		}
+		if string(iter.Key()) != keys[idx] || string(iter.Value()) != model[keys[idx]] {
+			t.Fatal("Got ", string(iter.Key()), " expect ", keys[idx])
+		}
+		idx--
+	}
+	if idx != -1 {
+		t.Fatal("Backward scan stops at ", idx)
+	}
+}
+
+func TestDBIterHidesOldVersionsAndDeletes(t *testing.T) {
+	_, db := openTestDB(t, "IterHidesOldVersionsAndDeletes")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	model := make(map[string]string)
+
+	db.Put(wo, []byte("a"), []byte("1"))
+	db.Put(wo, []byte("b"), []byte("2"))
+	db.Put(wo, []byte("c"), []byte("3"))
+	db.Put(wo, []byte("b"), []byte("22"))
+	db.Delete(wo, []byte("a"))
+	db.Delete(wo, []byte("missing"))
+	db.Put(wo, []byte("d"), []byte("4"))
+	db.Delete(wo, []byte("d"))
+
+	model["b"] = "22"
+	model["c"] = "3"
+
+	checkDBIterMatches(t, db, ReadOptions{}, model)
+
+	iter := db.NewIterator(ReadOptions{})
+	defer iter.Release()
+	iter.Seek([]byte("a"))
+	if !iter.Valid() || string(iter.Key()) != "b" {
+		t.Fatal("Seek does not skip deleted key")
+	}
+
+	// switch direction in the middle
+	iter.Next()
+	iter.Prev()
+	if !iter.Valid() || string(iter.Key()) != "b" {
+		t.Fatal("Fails to move back to b")
+	}
+	iter.Prev()
+	if iter.Valid() {
+		t.Error("Iterator should be before the first key")
+	}
+}
+
+func TestDBIterSnapshot(t *testing.T) {
+	_, db := openTestDB(t, "IterSnapshot")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	db.Put(wo, []byte("a"), []byte("1"))
+	db.Put(wo, []byte("b"), []byte("2"))
+
+	snap := db.GetSnapshot()
+	defer db.ReleaseSnapshot(snap)
+
+	iter := db.NewIterator(ReadOptions{})
+	defer iter.Release()
+
+	db.Put(wo, []byte("a"), []byte("11"))
+	db.Delete(wo, []byte("b"))
+	db.Put(wo, []byte("c"), []byte("3"))
+
+	// both the snapshot and the earlier iterator see the old state
+	old := map[string]string{"a": "1", "b": "2"}
+	checkDBIterMatches(t, db, ReadOptions{Snapshot: snap}, old)
+	checkIterMatches(t, iter, old)
+
+	checkDBIterMatches(t, db, ReadOptions{}, map[string]string{"a": "11", "c": "3"})
+}
+
+func TestDBIterAcrossTables(t *testing.T) {
+	root := "/tmp/db_test/IterAcrossTables"
+	os.RemoveAll(root)
+
+	db, s := Open(root, Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	rand.Seed(2)
+	wo := WriteOptions{}
+	model := make(map[string]string)
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", rand.Intn(3000))
+		if rand.Intn(5) == 0 {
+			db.Delete(wo, []byte(key))
+			delete(model, key)
+			continue
+		}
+
+		val := fmt.Sprintf("%s-%d", key, i)
+		db.Put(wo, []byte(key), []byte(val))
+		model[key] = val
+	}
+
+	// data is spread over memtables and several levels
+	iter := db.NewIterator(ReadOptions{})
+	defer iter.Release()
+	checkIterMatches(t, iter, model)
+
+	s = db.CompactRange(CompactRangeOptions{}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	// the memtable read by the old iterator has been flushed
+	checkIterMatches(t, iter, model)
+	checkDBIterMatches(t, db, ReadOptions{}, model)
+}
+
+func TestDBIterRelease(t *testing.T) {
+	root := "/tmp/db_test/IterRelease"
+	os.RemoveAll(root)
+
+	db, s := Open(root, Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		db.Put(WriteOptions{}, []byte(key), []byte(key))
+	}
+	s = db.CompactRange(CompactRangeOptions{}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	impl := db.(*dbImpl)
+	iter := db.NewIterator(ReadOptions{})
+	iter.SeekToFirst()
+	if !iter.Valid() || impl.tables.lru.PinnedUsage() == 0 {
+		t.Fatal("Iterator does not pin tables")
+	}
+
+	impl.mutex.Lock()
+	refs := impl.mem.refs
+	impl.mutex.Unlock()
+
+	iter.Release()
+	if impl.tables.lru.PinnedUsage() != 0 {
+		t.Error("Tables are pinned after release ", impl.tables.lru.PinnedUsage())
+	}
+
+	impl.mutex.Lock()
+	if impl.mem.refs != refs-1 {
+		t.Error("Memtable is not unpinned after release")
+	}
+	impl.mutex.Unlock()
+
+	// releasing again does nothing
+	iter.Release()
+}
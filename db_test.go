@@ -0,0 +1,1027 @@
+package gdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// open a fresh database under /tmp/db_test
+func openTestDB(t *testing.T, name string) (string, DB) {
+	root := "/tmp/db_test/" + name
+
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/db_test", os.ModePerm)
+
+	db, s := Open(root, Options{CreateIfMissing: true})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", root, " ", s.ToString())
+	}
+
+	return root, db
+}
+
+// expect @key to map to @expect in @db. An empty @expect means the
+// key should not be found
+func checkGet(t *testing.T, db DB, key, expect string) {
+	val, s := db.Get(ReadOptions{}, []byte(key))
+	switch {
+	case expect == "" && !s.IsNotFound():
+		t.Error("key ", key, " should not be found, got ", string(val))
+	case expect != "" && !s.Ok():
+		t.Fatal("Fails to get key ", key)
+	case expect != "" && string(val) != expect:
+		t.Error("key ", key, " has value ", string(val), " expect ", expect)
+	}
+}
+
+func TestDBPutGetDelete(t *testing.T) {
+	_, db := openTestDB(t, "PutGetDelete")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	db.Put(wo, []byte("hello"), []byte("world"))
+	db.Put(wo, []byte("go"), []byte("language"))
+
+	checkGet(t, db, "hello", "world")
+	checkGet(t, db, "go", "language")
+	checkGet(t, db, "missing", "")
+
+	db.Put(wo, []byte("hello"), []byte("again"))
+	checkGet(t, db, "hello", "again")
+
+	db.Delete(wo, []byte("hello"))
+	checkGet(t, db, "hello", "")
+	checkGet(t, db, "go", "language")
+}
+
+func TestDBReopen(t *testing.T) {
+	root, db := openTestDB(t, "Reopen")
+
+	wo := WriteOptions{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			val := []byte(fmt.Sprintf("val%d_%d", i, round))
+			db.Put(wo, key, val)
+		}
+
+		// remove a different key in each round
+		db.Delete(wo, []byte(fmt.Sprintf("key%d", round)))
+
+		s := db.Close()
+		if !s.Ok() {
+			t.Fatal("Fails to close db ", s.ToString())
+		}
+
+		db, s = Open(root, Options{})
+		if !s.Ok() {
+			t.Fatal("Fails to reopen db ", s.ToString())
+		}
+	}
+
+	defer db.Close()
+
+	// keys deleted in earlier rounds are written again afterwards
+	checkGet(t, db, "key0", "val0_2")
+	checkGet(t, db, "key1", "val1_2")
+	checkGet(t, db, "key2", "")
+
+	for i := 3; i < 1000; i++ {
+		checkGet(t, db, fmt.Sprintf("key%d", i), fmt.Sprintf("val%d_2", i))
+	}
+}
+
+func TestDBWriteBatch(t *testing.T) {
+	_, db := openTestDB(t, "WriteBatch")
+	defer db.Close()
+
+	wo := WriteOptions{}
+	db.Put(wo, []byte("a"), []byte("1"))
+
+	batch := MakeWriteBatch()
+	batch.Delete([]byte("a"))
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Put([]byte("c"), []byte("3"))
+
+	s := db.Write(wo, batch)
+	if !s.Ok() {
+		t.Error("Fails to write a batch")
+	}
+
+	checkGet(t, db, "a", "")
+	checkGet(t, db, "b", "2")
+	checkGet(t, db, "c", "3")
+}
+
+func TestDBRecoverFromLog(t *testing.T) {
+	root, db := openTestDB(t, "RecoverFromLog")
+
+	wo := WriteOptions{}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		db.Put(wo, key, key)
+	}
+	db.Delete(wo, []byte("key7"))
+
+	// simulate a crash, the database is opened again without being
+	// closed, so all updates have to be recovered from the log
+	db2, s := Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+
+	checkGet(t, db2, "key7", "")
+	for i := 0; i < 100; i++ {
+		if i != 7 {
+			key := fmt.Sprintf("key%d", i)
+			checkGet(t, db2, key, key)
+		}
+	}
+
+	db2.Close()
+}
+
+func TestDBRecoverFromTornLog(t *testing.T) {
+	root, db := openTestDB(t, "RecoverFromTornLog")
+
+	wo := WriteOptions{}
+	db.Put(wo, []byte("first"), []byte("1"))
+	db.Put(wo, []byte("second"), []byte("2"))
+
+	// cut the last record in the middle
+	impl := db.(*dbImpl)
+	name := walFileName(root, impl.logNumber)
+	size := impl.logFile.Size()
+	db.Close()
+	os.Truncate(name, size-2)
+
+	db, s := Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+
+	defer db.Close()
+
+	checkGet(t, db, "first", "1")
+	checkGet(t, db, "second", "")
+}
+
+func TestDBSnapshot(t *testing.T) {
+	root, db := openTestDB(t, "Snapshot")
+
+	wo := WriteOptions{}
+	db.Put(wo, []byte("key"), []byte("v1"))
+	db.Put(wo, []byte("gone"), []byte("here"))
+
+	snap := db.GetSnapshot()
+	ro := ReadOptions{Snapshot: snap}
+
+	db.Put(wo, []byte("key"), []byte("v2"))
+	db.Put(wo, []byte("new"), []byte("value"))
+	db.Delete(wo, []byte("gone"))
+
+	check := func(db DB) {
+		checkGet(t, db, "key", "v2")
+		checkGet(t, db, "gone", "")
+		checkGet(t, db, "new", "value")
+
+		val, s := db.Get(ro, []byte("key"))
+		if !s.Ok() || string(val) != "v1" {
+			t.Error("Snapshot should see old value, got ", string(val))
+		}
+
+		val, s = db.Get(ro, []byte("gone"))
+		if !s.Ok() || string(val) != "here" {
+			t.Error("Snapshot should see deleted key, got ", string(val))
+		}
+
+		if _, s = db.Get(ro, []byte("new")); !s.IsNotFound() {
+			t.Error("Snapshot should not see later updates")
+		}
+	}
+
+	check(db)
+
+	// the memtable is saved into a table when the db is opened again,
+	// older versions are still visible at the same sequence number
+	db2, s := Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+
+	check(db2)
+
+	db.ReleaseSnapshot(snap)
+	db2.Close()
+}
+
+func TestDBReleaseSnapshotTwice(t *testing.T) {
+	_, db := openTestDB(t, "ReleaseSnapshotTwice")
+	defer db.Close()
+
+	first := db.GetSnapshot()
+	db.Put(WriteOptions{}, []byte("key"), []byte("value"))
+	second := db.GetSnapshot()
+
+	// releasing a snapshot again does nothing
+	db.ReleaseSnapshot(first)
+	db.ReleaseSnapshot(first)
+
+	snapshots := db.(*dbImpl).snapshots
+	if snapshots.Empty() || snapshots.Oldest() != second {
+		t.Error("Other snapshots are changed by a second release")
+	}
+	db.ReleaseSnapshot(second)
+	if !snapshots.Empty() {
+		t.Error("Snapshot is not released")
+	}
+}
+
+func TestDBFlushMemTable(t *testing.T) {
+	root := "/tmp/db_test/FlushMemTable"
+	os.RemoveAll(root)
+
+	db, s := Open(root, Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+
+	wo := WriteOptions{}
+	value := make([]byte, 100)
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i%5000))
+		copy(value, key)
+		db.Put(wo, key, value)
+	}
+
+	// memtable has been written into tables several times, and only
+	// the logs of memtables that are not written stay
+	impl := db.(*dbImpl)
+	impl.mutex.Lock()
+	numTables := 0
+	for _, files := range impl.versions.current.levels {
+		numTables = numTables + len(files)
+	}
+	numLogs := len(impl.versions.current.logFiles)
+	impl.mutex.Unlock()
+
+	if numTables == 0 {
+		t.Error("Memtable is never written into tables")
+	}
+
+	if numLogs > 2 {
+		t.Error("Too many log files ", numLogs)
+	}
+
+	check := func(db DB) {
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("key%06d", i)
+			val, s := db.Get(ReadOptions{}, []byte(key))
+			if !s.Ok() || string(val[:len(key)]) != key {
+				t.Fatal("Fails to get key ", key)
+			}
+		}
+	}
+
+	check(db)
+	db.Close()
+
+	db, s = Open(root, Options{WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+
+	check(db)
+	db.Close()
+}
+
+func TestDBGetApproximateSizes(t *testing.T) {
+	root := "/tmp/db_test/GetApproximateSizes"
+	os.RemoveAll(root)
+
+	db, s := Open(root, Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	wo := WriteOptions{}
+	value := make([]byte, 1000)
+	for i := 0; i < 4000; i++ {
+		db.Put(wo, []byte(fmt.Sprintf("key%06d", i)), value)
+	}
+
+	s = db.CompactRange(CompactRangeOptions{}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	ranges := []Range{
+		{nil, nil},
+		{[]byte("key000000"), []byte("key002000")},
+		{[]byte("key002000"), nil},
+		{[]byte("zzz"), nil},
+	}
+	sizes := db.GetApproximateSizes(SizeApproximationOptions{}, ranges)
+
+	total := uint64(4000 * 1000)
+	if sizes[0] < total || sizes[0] > total*11/10 {
+		t.Error("Bad size of the whole key space ", sizes[0])
+	}
+
+	for _, size := range sizes[1:3] {
+		if size < total*4/10 || size > total*6/10 {
+			t.Error("Bad size of half of the key space ", size)
+		}
+	}
+
+	if sizes[3] != 0 {
+		t.Error("Range past all keys has size ", sizes[3])
+	}
+
+	// data in memtable is only counted on demand
+	db.Put(wo, []byte("zzz1"), value)
+	sizes = db.GetApproximateSizes(SizeApproximationOptions{}, ranges[3:])
+	if sizes[0] != 0 {
+		t.Error("Memtable is counted ", sizes[0])
+	}
+
+	opt := SizeApproximationOptions{IncludeMemtable: true}
+	sizes = db.GetApproximateSizes(opt, ranges[3:])
+	if sizes[0] < 1000 {
+		t.Error("Memtable is not counted ", sizes[0])
+	}
+}
+
+func TestDBOpenExistence(t *testing.T) {
+	root := "/tmp/db_test/OpenExistence"
+	os.RemoveAll(root)
+
+	_, s := Open(root, Options{})
+	if !s.IsInvalidArgument() {
+		t.Fatal("Missing db is opened without CreateIfMissing")
+	}
+
+	db, s := Open(root, Options{CreateIfMissing: true, ErrorIfExists: true})
+	if !s.Ok() {
+		t.Fatal("Fails to create db ", s.ToString())
+	}
+	db.Put(WriteOptions{Sync: true}, []byte("key"), []byte("value"))
+	db.Close()
+
+	_, s = Open(root, Options{CreateIfMissing: true, ErrorIfExists: true})
+	if !s.IsInvalidArgument() {
+		t.Fatal("Existing db is opened with ErrorIfExists")
+	}
+
+	db, s = Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to open existing db ", s.ToString())
+	}
+	checkGet(t, db, "key", "value")
+	db.Close()
+}
+
+func TestDBParanoidChecks(t *testing.T) {
+	root, db := openTestDB(t, "ParanoidChecks")
+
+	db.Put(WriteOptions{}, []byte("first"), []byte("1"))
+	db.Put(WriteOptions{}, []byte("second"), []byte("2"))
+
+	impl := db.(*dbImpl)
+	name := walFileName(root, impl.logNumber)
+	size := impl.logFile.Size()
+	db.Close()
+	os.Truncate(name, size-2)
+
+	_, s := Open(root, Options{ParanoidChecks: true})
+	if !s.IsCorruption() {
+		t.Fatal("Torn log is accepted with paranoid checks")
+	}
+
+	db, s = Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+	checkGet(t, db, "first", "1")
+	db.Close()
+}
+
+// order keys in reverse byte order
+type reverseBytesOrder struct {
+}
+
+func (x reverseBytesOrder) Compare(a, b []byte) int {
+	return -BytesSkiplistOrder{}.Compare(a, b)
+}
+
+func TestDBCustomComparator(t *testing.T) {
+	root := "/tmp/db_test/CustomComparator"
+	os.RemoveAll(root)
+
+	opt := Options{
+		CreateIfMissing:      true,
+		Comparator:           reverseBytesOrder{},
+		WriteBufferSize:      64 * 1024,
+		BlockSize:            256,
+		BlockRestartInterval: 3,
+	}
+	db, s := Open(root, opt)
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(WriteOptions{}, []byte(key), []byte(key))
+	}
+
+	s = db.CompactRange(CompactRangeOptions{}, nil, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+
+	for i := 0; i < 5000; i += 7 {
+		key := fmt.Sprintf("key%06d", i)
+		checkGet(t, db, key, key)
+	}
+
+	// keys come out in reverse order
+	iter := db.NewIterator(ReadOptions{})
+	defer iter.Release()
+	i := 4999
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if string(iter.Key()) != fmt.Sprintf("key%06d", i) {
+			t.Fatal("Bad key ", string(iter.Key()), " expect ", i)
+		}
+		i--
+	}
+	if i != -1 {
+		t.Error("Iteration stops at ", i)
+	}
+}
+
+// an env whose log files count syncs. Each sync takes a while, so
+// that writers pile up behind the one syncing. Writes to a log after
+// it is closed are counted in @misuses
+type slowSyncEnv struct {
+	NativeEnv
+	syncs   int32
+	misuses int32
+}
+
+type slowSyncFile struct {
+	WritableFile
+	env    *slowSyncEnv
+	closed int32
+}
+
+func (e *slowSyncEnv) NewWritableFile(name string) (WritableFile, Status) {
+	f, s := e.NativeEnv.NewWritableFile(name)
+	if !s.Ok() || !strings.Contains(name, "/wal_") {
+		return f, s
+	}
+	return &slowSyncFile{WritableFile: f, env: e}, s
+}
+
+func (f *slowSyncFile) checkOpen() {
+	if atomic.LoadInt32(&f.closed) != 0 {
+		atomic.AddInt32(&f.env.misuses, 1)
+	}
+}
+
+func (f *slowSyncFile) Append(data []byte) Status {
+	f.checkOpen()
+	return f.WritableFile.Append(data)
+}
+
+func (f *slowSyncFile) Flush() Status {
+	atomic.AddInt32(&f.env.syncs, 1)
+	time.Sleep(time.Millisecond)
+	f.checkOpen()
+	return f.WritableFile.Flush()
+}
+
+func (f *slowSyncFile) Close() Status {
+	atomic.StoreInt32(&f.closed, 1)
+	return f.WritableFile.Close()
+}
+
+func TestDBConcurrentWrites(t *testing.T) {
+	root := "/tmp/db_test/ConcurrentWrites"
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/db_test", os.ModePerm)
+
+	env := &slowSyncEnv{}
+	db, s := Open(root, Options{CreateIfMissing: true, Env: env})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+
+	const numWriters = 8
+	const numWrites = 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < numWrites; j++ {
+				key := fmt.Sprintf("key%d-%d", id, j)
+				s := db.Put(WriteOptions{Sync: j%2 == 0}, []byte(key), []byte(key))
+				if !s.Ok() {
+					t.Error("Fails to put ", key, " ", s.ToString())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// merged records carry every update with distinct sequence numbers
+	impl := db.(*dbImpl)
+	name := walFileName(root, impl.logNumber)
+	db.Close()
+
+	file := MakeLocalSequentialFile(name)
+	defer file.Close()
+	reader := Reader{file, 0, true}
+
+	numRecords := 0
+	numUpdates := 0
+	nextSequence := uint64(0)
+	for true {
+		record, result := reader.ReadRecord(make([]byte, 4096))
+		if result != ReadStatusOk {
+			break
+		}
+		numRecords++
+
+		batch, s := WriteBatchFromBytes(record)
+		if !s.Ok() {
+			t.Fatal("Bad batch in log ", s.ToString())
+		}
+		if batch.Sequence() < nextSequence {
+			t.Error("Sequence goes backward ", batch.Sequence())
+		}
+		nextSequence = batch.Sequence() + uint64(batch.Count())
+		numUpdates = numUpdates + batch.Count()
+	}
+
+	if numUpdates != numWriters*numWrites {
+		t.Error("Log has ", numUpdates, " updates")
+	}
+
+	// writers waiting behind a sync are grouped into one record and
+	// share the next sync
+	if numRecords >= numUpdates {
+		t.Error("Writes are not grouped, ", numRecords, " records for ", numUpdates, " writes")
+	}
+	if syncs := atomic.LoadInt32(&env.syncs); int(syncs) >= numWriters*numWrites/2 {
+		t.Error("Syncs are not shared, ", syncs, " syncs for ", numWriters*numWrites/2, " synced writes")
+	}
+
+	db, s = Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+	defer db.Close()
+
+	for i := 0; i < numWriters; i++ {
+		for j := 0; j < numWrites; j++ {
+			key := fmt.Sprintf("key%d-%d", i, j)
+			checkGet(t, db, key, key)
+		}
+	}
+}
+
+func TestDBFilterPolicy(t *testing.T) {
+	root := "/tmp/db_test/FilterPolicy"
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/db_test", os.ModePerm)
+
+	opt := Options{
+		CreateIfMissing: true,
+		WriteBufferSize: 64 * 1024,
+		FilterPolicy:    MakeBloomFilterPolicy(10),
+	}
+	db, s := Open(root, opt)
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+
+	wo := WriteOptions{}
+	for i := 0; i < 5000; i += 2 {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(wo, []byte(key), []byte(key))
+	}
+	db.Delete(wo, []byte("key000100"))
+
+	check := func(db DB) {
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("key%06d", i)
+			switch {
+			case i == 100 || i%2 != 0:
+				checkGet(t, db, key, "")
+			default:
+				checkGet(t, db, key, key)
+			}
+		}
+	}
+
+	check(db)
+	waitForCompaction(db)
+	db.Close()
+
+	// filters are read back from table files
+	opt.CreateIfMissing = false
+	db, s = Open(root, opt)
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+	check(db)
+	db.Close()
+
+	// a db opened without the policy ignores the filters
+	opt.FilterPolicy = nil
+	db, s = Open(root, opt)
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+	check(db)
+	db.Close()
+}
+
+func TestDBCompression(t *testing.T) {
+	for _, ct := range []CompressionType{SnappyCompression, LZ4Compression, FlateCompression} {
+		root := fmt.Sprintf("/tmp/db_test/Compression%d", ct)
+		os.RemoveAll(root)
+
+		opt := Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024, Compression: ct}
+		db, s := Open(root, opt)
+		if !s.Ok() {
+			t.Fatal("Fails to open db ", s.ToString())
+		}
+		for i := 0; i < 5000; i++ {
+			value := fmt.Sprintf(`{"id":%d,"name":"user","active":true}`, i)
+			db.Put(WriteOptions{}, []byte(fmt.Sprintf("key%06d", i)), []byte(value))
+		}
+		db.Close()
+
+		// tables written with any compression can be read
+		db, s = Open(root, Options{WriteBufferSize: 64 * 1024})
+		if !s.Ok() {
+			t.Fatal("Fails to reopen db ", s.ToString())
+		}
+		for i := 0; i < 5000; i += 7 {
+			checkGet(t, db, fmt.Sprintf("key%06d", i), fmt.Sprintf(`{"id":%d,"name":"user","active":true}`, i))
+		}
+		db.Close()
+	}
+}
+
+func TestDBIteratorReportsMissingTable(t *testing.T) {
+	root := "/tmp/db_test/IteratorReportsMissingTable"
+	os.RemoveAll(root)
+
+	db, s := Open(root, Options{CreateIfMissing: true})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		db.Put(WriteOptions{}, []byte(key), []byte(key))
+	}
+	if s = db.CompactRange(CompactRangeOptions{}, nil, nil); !s.Ok() {
+		t.Fatal("Fails to compact range ", s.ToString())
+	}
+	db.Close()
+
+	tables, _ := filepath.Glob(root + "/table_*.tbl")
+	if len(tables) == 0 {
+		t.Fatal("No table is written")
+	}
+	os.Remove(tables[0])
+
+	db, s = Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+	defer db.Close()
+
+	// a missing table is an error, not an empty db
+	iter := db.NewIterator(ReadOptions{})
+	defer iter.Release()
+	iter.SeekToFirst()
+	if iter.Valid() || iter.Status().Ok() {
+		t.Error("Missing table is not reported")
+	}
+}
+
+// an env whose table files fail to be written
+type failingTableEnv struct {
+	NativeEnv
+}
+
+func (e failingTableEnv) NewWritableFile(name string) (WritableFile, Status) {
+	if strings.HasSuffix(name, ".tbl") {
+		e.NativeEnv.NewWritableFile(name)
+		return &failingWritableFile{}, MakeStatusOk()
+	}
+	return e.NativeEnv.NewWritableFile(name)
+}
+
+func TestDBTableWriteError(t *testing.T) {
+	root := "/tmp/db_test/TableWriteError"
+	os.RemoveAll(root)
+
+	opt := Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024, Env: failingTableEnv{}}
+	db, s := Open(root, opt)
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	// a failed flush stops writes instead of crashing the process
+	value := make([]byte, 100)
+	for i := 0; i < 10000 && s.Ok(); i++ {
+		s = db.Put(WriteOptions{}, []byte(fmt.Sprintf("key%06d", i)), value)
+	}
+	if !s.IsIoError() {
+		t.Fatal("Write error of tables is not reported ", s.ToString())
+	}
+
+	tables, _ := filepath.Glob(root + "/table_*.tbl")
+	if len(tables) != 0 {
+		t.Error("Partial table files are left ", tables)
+	}
+}
+
+// an env whose table reads wait on @gate while it is set. Blocked
+// reads are announced on @blocked
+type blockingReadEnv struct {
+	NativeEnv
+	gate    chan struct{}
+	blocked chan struct{}
+}
+
+type blockingReadFile struct {
+	RandomAccessFile
+	env *blockingReadEnv
+}
+
+func (e *blockingReadEnv) NewRandomAccessFile(name string) (RandomAccessFile, Status) {
+	f, s := e.NativeEnv.NewRandomAccessFile(name)
+	if !s.Ok() {
+		return f, s
+	}
+	return &blockingReadFile{f, e}, s
+}
+
+func (f *blockingReadFile) Read(off int64, scratch []byte) ([]byte, Status) {
+	if gate := f.env.gate; gate != nil {
+		select {
+		case f.env.blocked <- struct{}{}:
+		default:
+		}
+		<-gate
+	}
+	return f.RandomAccessFile.Read(off, scratch)
+}
+
+// check that writes go on while @read is stuck in a table read
+func checkReadDoesNotBlockWriters(t *testing.T, name string, read func(db DB) Status) {
+	root := "/tmp/db_test/" + name
+	os.RemoveAll(root)
+
+	env := &blockingReadEnv{}
+	db, s := Open(root, Options{CreateIfMissing: true, Env: env})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer func() { db.Close() }()
+
+	db.Put(WriteOptions{}, []byte("key"), []byte("value"))
+	db.Put(WriteOptions{}, []byte("key2"), []byte("value"))
+	db.Close()
+
+	// the keys are moved into a table when the log is replayed
+	db, s = Open(root, Options{Env: env})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+	db.(*dbImpl).tables.close()
+
+	env.gate = make(chan struct{})
+	env.blocked = make(chan struct{}, 1)
+	done := make(chan Status)
+	go func() {
+		done <- read(db)
+	}()
+	<-env.blocked
+
+	written := make(chan Status, 1)
+	go func() {
+		s := MakeStatusOk()
+		for i := 0; i < 10 && s.Ok(); i++ {
+			s = db.Put(WriteOptions{}, []byte(fmt.Sprintf("other%d", i)), []byte("value"))
+		}
+		db.ReleaseSnapshot(db.GetSnapshot())
+		written <- s
+	}()
+
+	select {
+	case s := <-written:
+		if !s.Ok() {
+			t.Error("Fails to put ", s.ToString())
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Writes are blocked by a read")
+	}
+
+	close(env.gate)
+	if s := <-done; !s.Ok() {
+		t.Error("Fails to read ", s.ToString())
+	}
+}
+
+func TestDBGetDoesNotBlockWriters(t *testing.T) {
+	checkReadDoesNotBlockWriters(t, "GetDoesNotBlockWriters", func(db DB) Status {
+		_, s := db.Get(ReadOptions{}, []byte("key"))
+		return s
+	})
+}
+
+func TestDBApproximateSizesDoesNotBlockWriters(t *testing.T) {
+	checkReadDoesNotBlockWriters(t, "ApproximateSizesDoesNotBlockWriters", func(db DB) Status {
+		// the range cuts the table, which is opened to find offsets
+		ranges := []Range{{Start: []byte("key1"), Limit: nil}}
+		db.GetApproximateSizes(SizeApproximationOptions{IncludeMemtable: true}, ranges)
+		return MakeStatusOk()
+	})
+}
+
+func TestDBConcurrentReadsAndCompactions(t *testing.T) {
+	root := "/tmp/db_test/ConcurrentReadsAndCompactions"
+	os.RemoveAll(root)
+
+	db, s := Open(root, Options{CreateIfMissing: true, WriteBufferSize: 64 * 1024})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+	defer db.Close()
+
+	const numKeys = 2000
+	value := func(i, round int) string {
+		return fmt.Sprintf("value%06d-%d-%s", i, round, strings.Repeat("x", 50))
+	}
+	for i := 0; i < numKeys; i++ {
+		db.Put(WriteOptions{}, []byte(fmt.Sprintf("key%06d", i)), []byte(value(i, 0)))
+	}
+
+	// tables are replaced under readers, a key always has one of its
+	// values
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				i := (n*7 + r) % numKeys
+				val, s := db.Get(ReadOptions{}, []byte(fmt.Sprintf("key%06d", i)))
+				if !s.Ok() || !strings.HasPrefix(string(val), fmt.Sprintf("value%06d-", i)) {
+					t.Error("Fails to get key ", i, " ", s.ToString())
+					return
+				}
+			}
+		}(r)
+	}
+
+	for round := 1; round <= 3; round++ {
+		for i := 0; i < numKeys; i++ {
+			db.Put(WriteOptions{}, []byte(fmt.Sprintf("key%06d", i)), []byte(value(i, round)))
+		}
+		if s := db.CompactRange(CompactRangeOptions{}, nil, nil); !s.Ok() {
+			t.Error("Fails to compact range ", s.ToString())
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// versions pinned by lookups are gone, and so are their files
+	impl := db.(*dbImpl)
+	impl.mutex.Lock()
+	live := 0
+	for v := impl.versions.base.next; v != impl.versions.base; v = v.next {
+		live++
+	}
+	numFiles := len(impl.versions.fileMap)
+	current := impl.versions.current
+	inCurrent := len(current.logFiles)
+	for _, files := range current.levels {
+		inCurrent = inCurrent + len(files)
+	}
+	impl.mutex.Unlock()
+
+	if live != 1 {
+		t.Error("Old versions are left ", live)
+	}
+	if numFiles != inCurrent {
+		t.Error("Files of old versions are kept ", numFiles, " ", inCurrent)
+	}
+}
+
+func TestDBUseAfterClose(t *testing.T) {
+	_, db := openTestDB(t, "UseAfterClose")
+	db.Put(WriteOptions{}, []byte("key"), []byte("value"))
+
+	if s := db.Close(); !s.Ok() {
+		t.Fatal("Fails to close db ", s.ToString())
+	}
+	if s := db.Close(); !s.Ok() {
+		t.Error("Fails to close db twice ", s.ToString())
+	}
+
+	if s := db.Put(WriteOptions{}, []byte("key"), []byte("value")); s.Ok() {
+		t.Error("Writes to a closed db")
+	}
+	if _, s := db.Get(ReadOptions{}, []byte("key")); s.Ok() {
+		t.Error("Reads from a closed db")
+	}
+	iter := db.NewIterator(ReadOptions{})
+	iter.SeekToFirst()
+	if iter.Valid() || iter.Status().Ok() {
+		t.Error("Iterates over a closed db")
+	}
+	iter.Release()
+	if s := db.CompactRange(CompactRangeOptions{}, nil, nil); s.Ok() {
+		t.Error("Compacts a closed db")
+	}
+}
+
+func TestDBCloseWaitsForWriters(t *testing.T) {
+	root := "/tmp/db_test/CloseWaitsForWriters"
+	os.RemoveAll(root)
+	os.MkdirAll("/tmp/db_test", os.ModePerm)
+
+	// writers pile up behind slow syncs while the db is closed
+	env := &slowSyncEnv{}
+	db, s := Open(root, Options{CreateIfMissing: true, Env: env})
+	if !s.Ok() {
+		t.Fatal("Fails to open db ", s.ToString())
+	}
+
+	const numWriters = 8
+	var wg sync.WaitGroup
+	written := make([][]string, numWriters)
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := fmt.Sprintf("key%d-%d", id, j)
+				if !db.Put(WriteOptions{Sync: true}, []byte(key), []byte(key)).Ok() {
+					return
+				}
+				written[id] = append(written[id], key)
+			}
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if s := db.Close(); !s.Ok() {
+		t.Fatal("Fails to close db ", s.ToString())
+	}
+	wg.Wait()
+
+	if misuses := atomic.LoadInt32(&env.misuses); misuses != 0 {
+		t.Error("Log is written after it is closed ", misuses)
+	}
+
+	// every acknowledged write is in the log
+	db, s = Open(root, Options{})
+	if !s.Ok() {
+		t.Fatal("Fails to reopen db ", s.ToString())
+	}
+	defer db.Close()
+
+	for _, keys := range written {
+		for _, key := range keys {
+			checkGet(t, db, key, key)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package gdb
+
+// Keys saved in memtable and tables are internal keys. An internal key
+// is the user key followed by 8 bytes which pack a 56 bit sequence
+// number and a 8 bit value type: (sequence << 8) | type.
+// Entries with the same user key are ordered by decreasing sequence
+// number, so the newest version of a key comes first
+
+// Type of an entry saved in memtable and tables
+const (
+	kTypeDeletion = 0
+	kTypeValue    = 1
+
+	// Entries of the same user key and sequence are ordered by
+	// decreasing type, so a lookup key should use the largest type
+	kValueTypeForSeek = kTypeValue
+)
+
+const (
+	kMaxSequenceNumber = (uint64(1) << 56) - 1
+	// size of the sequence and type trailer of an internal key
+	kInternalKeyTrailerSize = 8
+)
+
+// combine a sequence number and a value type into the trailer of an
+// internal key
+func packSequenceAndType(seq uint64, t uint8) uint64 {
+	if seq > kMaxSequenceNumber {
+		panic("sequence number is too big")
+	}
+	return (seq << 8) | uint64(t)
+}
+
+// Append an internal key made of @userKey, @seq and @t to @scratch,
+// returns the resulting slice
+func MakeInternalKey(scratch []byte, userKey []byte, seq uint64, t uint8) []byte {
+	scratch = append(scratch, userKey...)
+	return EncodeUint64(scratch, packSequenceAndType(seq, t))
+}
+
+// An internal key that has been split into its parts
+type ParsedInternalKey struct {
+	userKey   []byte
+	sequence  uint64
+	valueType uint8
+}
+
+// Split an internal key, return false if the key is malformed
+func ParseInternalKey(key []byte) (ret ParsedInternalKey, ok bool) {
+	size := len(key)
+	if size < kInternalKeyTrailerSize {
+		return
+	}
+
+	num, _ := DecodeUint64(key[size-kInternalKeyTrailerSize:])
+	ret.userKey = key[:size-kInternalKeyTrailerSize]
+	ret.sequence = num >> 8
+	ret.valueType = uint8(num & 0xff)
+
+	ok = ret.valueType <= kTypeValue
+	return
+}
+
+// return the user key part of an internal key
+func extractUserKey(key []byte) []byte {
+	return key[:len(key)-kInternalKeyTrailerSize]
+}
+
+// return the packed sequence and type of an internal key
+func extractTrailer(key []byte) uint64 {
+	num, _ := DecodeUint64(key[len(key)-kInternalKeyTrailerSize:])
+	return num
+}
+
+// Order internal keys by increasing user key, and by decreasing
+// sequence number and type for the same user key
+type InternalKeyComparator struct {
+	user Comparator
+}
+
+func MakeInternalKeyComparator(user Comparator) *InternalKeyComparator {
+	return &InternalKeyComparator{user}
+}
+
+func (c *InternalKeyComparator) Compare(a, b []byte) int {
+	r := c.user.Compare(extractUserKey(a), extractUserKey(b))
+	if r != 0 {
+		return r
+	}
+
+	anum, bnum := extractTrailer(a), extractTrailer(b)
+	switch {
+	case anum > bnum:
+		return -1
+	case anum < bnum:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// return the comparator for user keys
+func (c *InternalKeyComparator) UserComparator() Comparator {
+	return c.user
+}
+
+// Apply a filter policy for user keys to internal keys, so that a key
+// matches no matter what its sequence number is
+type internalFilterPolicy struct {
+	user FilterPolicy
+}
+
+// Return nil if @user is nil
+func makeInternalFilterPolicy(user FilterPolicy) FilterPolicy {
+	if user == nil {
+		return nil
+	}
+	return &internalFilterPolicy{user}
+}
+
+func (p *internalFilterPolicy) Name() string {
+	return p.user.Name()
+}
+
+func (p *internalFilterPolicy) CreateFilter(keys [][]byte) []byte {
+	userKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		userKeys[i] = extractUserKey(key)
+	}
+	return p.user.CreateFilter(userKeys)
+}
+
+func (p *internalFilterPolicy) KeyMayMatch(key, filter []byte) bool {
+	return p.user.KeyMayMatch(extractUserKey(key), filter)
+}
@@ -0,0 +1,57 @@
+package gdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseInternalKey(t *testing.T) {
+	key := MakeInternalKey(nil, []byte("hello"), 12345, kTypeValue)
+
+	parsed, ok := ParseInternalKey(key)
+	if !ok {
+		t.Error("Fails to parse an internal key")
+	}
+
+	if bytes.Compare(parsed.userKey, []byte("hello")) != 0 {
+		t.Error("Wrong user key ", string(parsed.userKey))
+	}
+
+	if parsed.sequence != 12345 || parsed.valueType != kTypeValue {
+		t.Error("Wrong sequence or type ", parsed.sequence, " ", parsed.valueType)
+	}
+
+	if _, ok := ParseInternalKey([]byte("short")); ok {
+		t.Error("A short key should not be parsed")
+	}
+}
+
+func TestInternalKeyOrder(t *testing.T) {
+	c := MakeInternalKeyComparator(&BytesSkiplistOrder{})
+
+	// keys in increasing order
+	keys := [][]byte{
+		MakeInternalKey(nil, []byte("a"), 100, kTypeValue),
+		MakeInternalKey(nil, []byte("a"), 100, kTypeDeletion),
+		MakeInternalKey(nil, []byte("a"), 99, kTypeValue),
+		MakeInternalKey(nil, []byte("a"), 1, kTypeValue),
+		MakeInternalKey(nil, []byte("ab"), kMaxSequenceNumber, kTypeValue),
+		MakeInternalKey(nil, []byte("b"), 1000, kTypeDeletion),
+	}
+
+	for i := 0; i < len(keys); i++ {
+		for j := 0; j < len(keys); j++ {
+			expect := 0
+			switch {
+			case i < j:
+				expect = -1
+			case i > j:
+				expect = 1
+			}
+
+			if c.Compare(keys[i], keys[j]) != expect {
+				t.Error("Wrong order between key ", i, " and key ", j)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package gdb
+
+import "fmt"
+
+// name of a table file with file number @number
+func tableFileName(name string, number uint64) string {
+	return fmt.Sprintf("%s/table_%d.tbl", name, number)
+}
+
+// name of a write ahead log file with file number @number
+func walFileName(name string, number uint64) string {
+	return fmt.Sprintf("%s/wal_%d.log", name, number)
+}
+
+// name of the file recording that log file @fname has been rewritten
+// by ConvertDB
+func convertedLogFileName(fname string) string {
+	return fname + ".converted"
+}
+
+// name of the file holding format version of db @name
+func formatFileName(name string) string {
+	return fmt.Sprintf("%s/format", name)
+}
@@ -0,0 +1,120 @@
+package gdb
+
+// A filter block holds a filter for each leaf block of a table, in the
+// same order as entries in the index block. Like other blocks, integers
+// are saved in little endian byte order and aligned to 4 bytes. The layout of
+// a filter block:
+//
+//	filter 0, filter 1, ... filter n-1, padding
+//	start offsets of filters : 4 bytes each
+//	end offset of last filter: 4 bytes
+//	number of filters        : 4 bytes
+//	name of filter policy, padding
+//	length of name           : 4 bytes
+type filterBlockBuilder struct {
+	policy  FilterPolicy
+	keys    [][]byte
+	filters []byte
+	offsets []uint32
+}
+
+func makeFilterBlockBuilder(policy FilterPolicy) *filterBlockBuilder {
+	ret := &filterBlockBuilder{}
+	ret.policy = policy
+	return ret
+}
+
+// add a key of current leaf block
+func (b *filterBlockBuilder) addKey(key []byte) {
+	b.keys = append(b.keys, key)
+}
+
+// build a filter for keys added since last call
+func (b *filterBlockBuilder) finishBlock() {
+	b.offsets = append(b.offsets, uint32(len(b.filters)))
+	b.filters = append(b.filters, b.policy.CreateFilter(b.keys)...)
+	b.keys = b.keys[:0]
+}
+
+// return content of the filter block
+func (b *filterBlockBuilder) finish() []byte {
+	end := uint32(len(b.filters))
+
+	ret := padTo4(b.filters)
+	for _, off := range b.offsets {
+		ret = EncodeUint32(ret, off)
+	}
+	ret = EncodeUint32(ret, end)
+	ret = EncodeUint32(ret, uint32(len(b.offsets)))
+
+	name := b.policy.Name()
+	ret = padTo4(append(ret, name...))
+	ret = EncodeUint32(ret, uint32(len(name)))
+	return ret
+}
+
+func padTo4(data []byte) []byte {
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+type filterBlockReader struct {
+	policy  FilterPolicy
+	data    []byte
+	offsets []byte
+	num     int
+}
+
+// Parse a filter block. Return nil if the block is malformed, or it
+// is not built by a policy of the same name as @policy
+func makeFilterBlockReader(policy FilterPolicy, data []byte) *filterBlockReader {
+	if len(data) < 8 {
+		return nil
+	}
+
+	end := len(data) - 4
+	nameLen32, _ := DecodeUint32(data[end:])
+	nameLen := int(nameLen32)
+	padded := (nameLen + 3) &^ 3
+	if padded > end-4 {
+		return nil
+	}
+
+	name := data[end-padded : end-padded+nameLen]
+	if string(name) != policy.Name() {
+		return nil
+	}
+
+	end = end - padded - 4
+	num32, _ := DecodeUint32(data[end:])
+	num := int(num32)
+	if (num+1)*4 > end {
+		return nil
+	}
+
+	ret := &filterBlockReader{}
+	ret.policy = policy
+	ret.num = num
+	ret.offsets = data[end-(num+1)*4 : end]
+	ret.data = data[:end-(num+1)*4]
+	return ret
+}
+
+// return false if @key is definitely not in the leaf block @idx
+func (r *filterBlockReader) keyMayMatch(idx int, key []byte) bool {
+	if idx < 0 || idx >= r.num {
+		// take errors as potential matches
+		return true
+	}
+
+	start, _ := DecodeUint32(r.offsets[idx*4:])
+	limit, _ := DecodeUint32(r.offsets[idx*4+4:])
+
+	if start > limit || limit > uint32(len(r.data)) {
+		return true
+	}
+
+	return r.policy.KeyMayMatch(key, r.data[start:limit])
+}
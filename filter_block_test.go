@@ -0,0 +1,83 @@
+package gdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilterBlockPerLeafBlock(t *testing.T) {
+	policy := MakeBloomFilterPolicy(10)
+	builder := makeFilterBlockBuilder(policy)
+
+	// 3 blocks, the second one holds no key
+	builder.addKey([]byte("apple"))
+	builder.addKey([]byte("banana"))
+	builder.finishBlock()
+	builder.finishBlock()
+	builder.addKey([]byte("cherry"))
+	builder.finishBlock()
+
+	reader := makeFilterBlockReader(policy, builder.finish())
+	if reader == nil {
+		t.Fatal("Fails to parse filter block")
+	}
+
+	expects := []struct {
+		idx   int
+		key   string
+		match bool
+	}{
+		{0, "apple", true},
+		{0, "banana", true},
+		{1, "apple", false},
+		{2, "cherry", true},
+		// out of range is taken as a match
+		{3, "apple", true},
+	}
+
+	for _, e := range expects {
+		if reader.keyMayMatch(e.idx, []byte(e.key)) != e.match {
+			t.Error("Unexpected match of ", e.key, " in block ", e.idx)
+		}
+	}
+
+	// filters of blocks are not mixed up
+	matches := 0
+	for i := 0; i < 100; i++ {
+		if reader.keyMayMatch(2, []byte(fmt.Sprintf("missing%d", i))) {
+			matches++
+		}
+	}
+	if reader.keyMayMatch(2, []byte("apple")) {
+		matches++
+	}
+	if matches > 5 {
+		t.Error("Too many false positives in block 2: ", matches)
+	}
+}
+
+type otherFilterPolicy struct {
+	FilterPolicy
+}
+
+func (p otherFilterPolicy) Name() string {
+	return "other"
+}
+
+func TestFilterBlockPolicyName(t *testing.T) {
+	policy := MakeBloomFilterPolicy(10)
+	builder := makeFilterBlockBuilder(policy)
+	for i := 0; i < 100; i++ {
+		builder.addKey([]byte(fmt.Sprintf("key%d", i)))
+	}
+	builder.finishBlock()
+	data := builder.finish()
+
+	if makeFilterBlockReader(otherFilterPolicy{policy}, data) != nil {
+		t.Error("Filter block is used by a policy of another name")
+	}
+
+	if makeFilterBlockReader(policy, data[:len(data)-1]) != nil {
+		t.Error("Truncated filter block is used")
+	}
+}
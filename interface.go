@@ -10,6 +10,13 @@ type Iterator interface {
 	Prev()
 	Key() []byte
 	Value() []byte
+	// Return the first error met by the iterator. An iterator that
+	// turns invalid because of an error has not reached the end of
+	// data, callers scanning all entries must check it
+	Status() Status
+	// Unpin tables and blocks held by the iterator. The iterator must
+	// not be used after it is released, releasing it again does nothing
+	Release()
 }
 
 // A pool style allocator that does increamental allocation and
@@ -29,8 +36,10 @@ type Comparator interface {
 type Status interface {
 	Ok() bool
 	IsNotFound() bool
+	IsDeleted() bool
 	IsCorruption() bool
 	IsIoError() bool
+	IsInvalidArgument() bool
 	ToString() string
 }
 
@@ -50,33 +59,50 @@ type Env interface {
 	RenameFile(src string, target string) Status
 }
 
-// define a range [start, limit), note @limit is not included in
-// the range
+// define a range [Start, Limit), note @Limit is not included in
+// the range. A nil Start or Limit means the range is unbounded on
+// that side
 type Range struct {
-	start []byte
-	limit []byte
+	Start []byte
+	Limit []byte
 }
 
 // DB interface
 type DB interface {
 	Put(opt WriteOptions, key, value []byte) Status
 	Delete(opt WriteOptions, key []byte) Status
-	Write(opt WriteOptions, updates WriteBatch) Status
-	Get(opt ReadOptions, key, value []byte) Status
+	Write(opt WriteOptions, updates *WriteBatch) Status
+	Get(opt ReadOptions, key []byte) ([]byte, Status)
 	NewIterator(opt ReadOptions) Iterator
 	GetSnapshot() Snapshot
 	ReleaseSnapshot(snap Snapshot)
-	GetApproximateSizes(ranges []Range) []uint64
-	CompactRange(start, limit []byte)
+	GetApproximateSizes(opt SizeApproximationOptions, ranges []Range) []uint64
+	CompactRange(opt CompactRangeOptions, start, limit []byte) Status
+	Close() Status
+}
+
+// A policy to build a small filter from the keys of a table. The
+// filter tells if a key may be in the table without reading it
+type FilterPolicy interface {
+	// name of the policy, filters built by a policy can only be read
+	// by a policy of the same name
+	Name() string
+	// return a filter for a list of keys
+	CreateFilter(keys [][]byte) []byte
+	// return false if @key is definitely not in the list of keys
+	// that @filter is built from
+	KeyMayMatch(key, filter []byte) bool
 }
 
-type WriteBatch interface {
+// Callbacks to walk through updates in a WriteBatch
+type WriteBatchHandler interface {
 	Put(key, value []byte)
 	Delete(key []byte)
-	NewIterator() Iterator
 }
 
+// A consistent read only view of the DB at a point in time
 type Snapshot interface {
+	Sequence() uint64
 }
 
 type SequentialFile interface {
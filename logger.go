@@ -1,14 +1,15 @@
 package gdb
 
 import (
+	"encoding/binary"
 	"hash/crc32"
-	"unsafe"
 )
 
 const (
 	// size of a log block
 	kBlockSize = 32768
-	// header includes checksum (4 bytes), type (1 byte), length (2 bytes)
+	// header includes checksum (4 bytes), type (1 byte), length (2 bytes),
+	// integers are in little endian byte order
 	kHeaderSize = 4 + 1 + 2
 
 	// A single, full record
@@ -26,8 +27,9 @@ type Writer struct {
 
 func (w *Writer) AddRecord(record []byte) Status {
 	header := [kHeaderSize]byte{}
+	firstIter := true
 
-	for firstIter := true; true; firstIter = false {
+	for true {
 		off := w.file.Size()
 		offInBlock := int(off % kBlockSize)
 		availInBlock := kBlockSize - offInBlock
@@ -35,8 +37,7 @@ func (w *Writer) AddRecord(record []byte) Status {
 
 		switch {
 		case totalBytes <= availInBlock:
-			p32 := (*uint32)(unsafe.Pointer(&header[0]))
-			*p32 = crc32.ChecksumIEEE(record)
+			binary.LittleEndian.PutUint32(header[0:], crc32.ChecksumIEEE(record))
 
 			if firstIter {
 				// In most case, entire record fit into a block
@@ -46,8 +47,7 @@ func (w *Writer) AddRecord(record []byte) Status {
 				header[4] = kLastType
 			}
 
-			p16 := (*uint16)(unsafe.Pointer(&header[5]))
-			*p16 = uint16(totalBytes)
+			binary.LittleEndian.PutUint16(header[5:], uint16(totalBytes))
 
 			s := w.file.Append(header[:])
 			if !s.Ok() {
@@ -59,8 +59,7 @@ func (w *Writer) AddRecord(record []byte) Status {
 		case availInBlock > kHeaderSize:
 			fragment := availInBlock - kHeaderSize
 
-			p32 := (*uint32)(unsafe.Pointer(&header[0]))
-			*p32 = crc32.ChecksumIEEE(record[:fragment])
+			binary.LittleEndian.PutUint32(header[0:], crc32.ChecksumIEEE(record[:fragment]))
 
 			if firstIter {
 				header[4] = kFirstType
@@ -68,8 +67,7 @@ func (w *Writer) AddRecord(record []byte) Status {
 				header[4] = kMiddleType
 			}
 
-			p16 := (*uint16)(unsafe.Pointer(&header[5]))
-			*p16 = uint16(availInBlock)
+			binary.LittleEndian.PutUint16(header[5:], uint16(availInBlock))
 
 			s := w.file.Append(header[:])
 			if !s.Ok() {
@@ -82,6 +80,7 @@ func (w *Writer) AddRecord(record []byte) Status {
 			}
 
 			record = record[fragment:]
+			firstIter = false
 
 		case firstIter:
 			// if there is too little space in current block,
@@ -112,12 +111,19 @@ type Reader struct {
 	checksum bool
 }
 
+// Read next record from the log file. @scratch is used to hold the
+// record, a bigger buffer is allocated if the record does not fit
 func (r *Reader) ReadRecord(scratch []byte) (ret []byte, status int) {
+	return r.readRecord(scratch, littleEndian)
+}
+
+// read next record from a log file whose headers are decoded by @d
+func (r *Reader) readRecord(scratch []byte, d decoder) (ret []byte, status int) {
 	header := [kHeaderSize]byte{}
-	buffer := scratch
-	size := 0
+	buffer := scratch[:0]
+	firstIter := true
 
-	for firstIter := true; true; firstIter = false {
+	for true {
 		offInBlock := r.off % kBlockSize
 		availInBlock := int(kBlockSize - offInBlock)
 
@@ -137,35 +143,44 @@ func (r *Reader) ReadRecord(scratch []byte) (ret []byte, status int) {
 				status = ReadStatusCorruption
 				return
 			}
+			r.off = r.off + kHeaderSize
 
-			p16 := (*uint16)(unsafe.Pointer(&header[5]))
-			totalBytes := int(*p16)
+			totalBytes := int(d.order.Uint16(header[5:]))
 
-			if totalBytes <= kHeaderSize || totalBytes > availInBlock {
+			if totalBytes < kHeaderSize || totalBytes > availInBlock {
 				status = ReadStatusCorruption
 				return
 			}
 
 			toRead := totalBytes - kHeaderSize
-			size = size + toRead
+			size := len(buffer)
+
+			// grow the buffer if the record does not fit
+			if cap(buffer) < size+toRead {
+				newBuffer := make([]byte, size, 2*cap(buffer)+toRead)
+				copy(newBuffer, buffer)
+				buffer = newBuffer
+			}
 
-			tmp, s = r.file.Read(buffer[:toRead])
+			tmp, s = r.file.Read(buffer[size : size+toRead])
 			if !s.Ok() || len(tmp) != toRead {
 				status = ReadStatusCorruption
 				return
 			}
+			r.off = r.off + int64(toRead)
+			buffer = buffer[:size+toRead]
 
-			p32 := (*uint32)(unsafe.Pointer(&header[5]))
 			cksum := crc32.ChecksumIEEE(tmp)
 
-			if cksum != *p32 {
+			if r.checksum && cksum != d.order.Uint32(header[0:]) {
 				status = ReadStatusCorruption
+				return
 			}
 
 			switch int(header[4]) {
 			case kFullType:
 				if firstIter {
-					ret, status = tmp, ReadStatusOk
+					ret, status = buffer, ReadStatusOk
 				} else {
 					status = ReadStatusCorruption
 				}
@@ -175,21 +190,36 @@ func (r *Reader) ReadRecord(scratch []byte) (ret []byte, status int) {
 				if firstIter {
 					status = ReadStatusCorruption
 				} else {
-					ret, status = scratch[:size], ReadStatusOk
+					ret, status = buffer, ReadStatusOk
 				}
 				return
 
+			case kFirstType:
+				if !firstIter {
+					status = ReadStatusCorruption
+					return
+				}
+
+			case kMiddleType:
+				if firstIter {
+					status = ReadStatusCorruption
+					return
+				}
+
 			default:
-				// continue reading
-				buffer = buffer[toRead:]
+				status = ReadStatusCorruption
+				return
 			}
 
+			firstIter = false
+
 		default:
 			s := r.file.Skip(int64(availInBlock))
 			if !s.Ok() {
 				status = ReadStatusCorruption
 				return
 			}
+			r.off = r.off + int64(availInBlock)
 		}
 	}
 
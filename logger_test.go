@@ -203,3 +203,64 @@ func TestReaderWriterAcrossMultiBlock(t *testing.T) {
 		t.Error("Suppose to end at this point")
 	}
 }
+
+func TestReaderWriterBlockPadding(t *testing.T) {
+	root := "/tmp/logger_test/ReaderWriterBlockPadding"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	name := strings.Join([]string{root, "log"}, "/")
+	wf := MakeLocalWritableFile(name)
+
+	if wf == nil {
+		t.Error("Fails to create a new log file ", name)
+	}
+
+	writer := Writer{wf}
+
+	// first record leaves less than a header at the end of the block,
+	// so the writer has to pad the block before the second record
+	lowVal, highVal := uint8('a'), uint8('z')
+	firstSize := kBlockSize - kHeaderSize - 3
+
+	records := [][]byte{
+		MakeRandomSlice(lowVal, highVal, firstSize, firstSize+1, 1)[0],
+		[]byte("after padding"),
+		MakeRandomSlice(lowVal, highVal, kBlockSize, kBlockSize+1, 1)[0],
+	}
+
+	for _, r := range records {
+		ok := writer.AddRecord(r)
+		if !ok.Ok() {
+			t.Error("Fails to append a record!")
+		}
+	}
+
+	wf.Close()
+
+	rf := MakeLocalSequentialFile(name)
+	if rf == nil {
+		t.Error("Fail to open a file for read")
+	}
+
+	// the buffer is too small for the last record on purpose
+	reader := Reader{rf, int64(0), true}
+	buf := make([]byte, 1024)
+
+	for i, r := range records {
+		ret, status := reader.ReadRecord(buf)
+		if status != ReadStatusOk {
+			t.Error("Fails to read from a log file")
+		}
+
+		if bytes.Compare(ret, r) != 0 {
+			t.Error("Fails to read the exactly same record", i)
+		}
+	}
+
+	_, status := reader.ReadRecord(buf)
+	if status != ReadStatusEOF {
+		t.Error("Suppose to end at this point")
+	}
+}
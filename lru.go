@@ -1,108 +1,323 @@
 package gdb
 
-// This implements a LRU cache algorithm.
+import (
+	"sync"
+)
+
+const (
+	// a cache is split into shards of at least this many bytes
+	kMinLruShardSize = 512 * 1024
+	kMaxLruShardBits = 6
+)
+
+// This implements a LRU cache algorithm. Each entry is charged by a
+// size given by the caller, least recently used entries are evicted
+// once the charges exceed the capacity. Keys are hashed to shards, each
+// with its own lock, so that the cache can be used by many goroutines.
+//
+// An entry returned by Insert or Lookup is pinned by the handle until
+// the handle is released. Pinned entries are never evicted but still
+// count against the capacity. An entry that leaves the cache, by
+// eviction, Erase, Prune or being replaced, is passed to its deleter
+// once it is no longer pinned
 type LRU struct {
-	// lru elements that are in use
-	active *LruEntry
-	// how many elements in the cache
-	numElements int
-	// how many elements should be in cache, older ones will be purged
-	maxElements int
-	// make entries addressable by keys
-	m map[string]*LruEntry
+	shards []lruShard
+	// number of shards minus one
+	mask uint32
 }
 
-// create a new LRU cache
-func NewLRU(maxElements int) *LRU {
-	return &LRU{
-		maxElements: maxElements,
-		m: make(map[string]*LruEntry),
+// create a new LRU cache holding entries charged by up to @capacity in
+// total, the number of shards depends on the capacity
+func NewLRU(capacity int) *LRU {
+	bits := 0
+	for numShards := capacity / kMinLruShardSize; numShards > 1 && bits < kMaxLruShardBits; numShards >>= 1 {
+		bits++
 	}
+	return NewShardedLRU(capacity, bits)
 }
 
-// save an entry which can be addressed by "Key" in LRU cache
-func (l *LRU) Put(key []byte, value interface{}) {
-	var entry *LruEntry
-	if l.numElements < l.maxElements {
-		entry = &LruEntry{
-			key: key,
-			value: value,
-		}
-	} else {
-		// reuse last entry
-		entry = l.active.prev
-		l.Del(entry.key)
-		entry.key = key
-		entry.value = value
+// create a new LRU cache of 2^@numShardBits shards, sharing @capacity
+// evenly
+func NewShardedLRU(capacity int, numShardBits int) *LRU {
+	numShards := 1 << uint(numShardBits)
+	l := &LRU{}
+	l.shards = make([]lruShard, numShards)
+	l.mask = uint32(numShards - 1)
+
+	perShard := (capacity + numShards - 1) / numShards
+	for i := range l.shards {
+		l.shards[i].init(perShard)
 	}
+	return l
+}
 
-	// Even if we reuse an entry, a call to Del() above decreases the total
-	// counter. So we have to increase the counter for both case here
-	l.numElements++
+func (l *LRU) shard(key []byte) *lruShard {
+	return &l.shards[hashBytes(key, 0)&l.mask]
+}
 
-	// setup map
-	l.m[string(key)] = entry
+// save an entry which can be addressed by @key in LRU cache, charged
+// by @charge. The entry is not pinned
+func (l *LRU) Put(key []byte, value interface{}, charge int) {
+	l.Release(l.Insert(key, value, charge, nil))
+}
 
-	l.pushFront(entry)
+// save an entry which can be addressed by @key in LRU cache, charged
+// by @charge, replacing an old entry of the same key. @deleter, if
+// not nil, is called once the entry leaves the cache and is no longer
+// pinned. The returned handle pins the entry, and must be released
+func (l *LRU) Insert(key []byte, value interface{}, charge int,
+	deleter func(key []byte, value interface{})) *LruEntry {
+	return l.shard(key).insert(key, value, charge, deleter)
 }
 
 // retrieve a cache entry, if it is not in cache yet, hit will be false
 func (l *LRU) Get(key []byte) (value interface{}, hit bool) {
-	var entry *LruEntry
-	entry, hit = l.m[string(key)]
-	if hit {
-		value = entry.value
-		l.Del(key)
-		l.numElements++
-		l.m[string(key)] = entry
-		l.pushFront(entry)
+	entry := l.Lookup(key)
+	if entry == nil {
+		return
+	}
+
+	value = entry.value
+	l.Release(entry)
+	return value, true
+}
+
+// find an entry by @key, return nil if it is not in cache. Otherwise
+// the entry is pinned, and the returned handle must be released
+func (l *LRU) Lookup(key []byte) *LruEntry {
+	return l.shard(key).lookup(key)
+}
+
+// unpin an entry returned by Insert or Lookup
+func (l *LRU) Release(entry *LruEntry) {
+	l.shard(entry.key).release(entry)
+}
+
+// remove an entry indexed by @key. If it is pinned, it stays valid
+// until released
+func (l *LRU) Erase(key []byte) {
+	l.shard(key).erase(key)
+}
+
+// remove all entries that are not pinned
+func (l *LRU) Prune() {
+	for i := range l.shards {
+		l.shards[i].prune()
+	}
+}
+
+// return total charges of entries in cache, including pinned ones
+func (l *LRU) Usage() int {
+	ret := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mutex.Lock()
+		ret = ret + s.usage
+		s.mutex.Unlock()
+	}
+	return ret
+}
+
+// return total charges of pinned entries in cache
+func (l *LRU) PinnedUsage() int {
+	ret := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mutex.Lock()
+		ret = ret + s.pinned
+		s.mutex.Unlock()
+	}
+	return ret
+}
+
+// return number of lookups that find an entry, and those that do not
+func (l *LRU) Stats() (hits, misses int64) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mutex.Lock()
+		hits = hits + s.hits
+		misses = misses + s.misses
+		s.mutex.Unlock()
 	}
 	return
 }
 
-// remove an entry indexed by "key"
-func (l *LRU) Del(key []byte) {
-	strKey := string(key)
-	entry, found := l.m[strKey]
+// a shard of LRU cache. An entry in cache is either in the lru list if
+// only the cache refers to it, or in the inUse list if it is pinned
+type lruShard struct {
+	mutex    sync.Mutex
+	capacity int
+	usage    int
+	pinned   int
+	// dummy heads of circular lists, newest entries first
+	lru   LruEntry
+	inUse LruEntry
+	// make entries addressable by keys
+	m map[string]*LruEntry
+	// entries to pass to deleters once the mutex is released
+	dead []*LruEntry
+
+	hits, misses int64
+}
+
+func (s *lruShard) init(capacity int) {
+	s.capacity = capacity
+	s.lru.next, s.lru.prev = &s.lru, &s.lru
+	s.inUse.next, s.inUse.prev = &s.inUse, &s.inUse
+	s.m = make(map[string]*LruEntry)
+}
+
+// release mutex and call deleters of entries dropped meanwhile, so
+// that a deleter may use the cache
+func (s *lruShard) unlock() {
+	dead := s.dead
+	s.dead = nil
+	s.mutex.Unlock()
+
+	for _, entry := range dead {
+		entry.deleter(entry.key, entry.value)
+	}
+}
+
+func (s *lruShard) insert(key []byte, value interface{}, charge int,
+	deleter func(key []byte, value interface{})) *LruEntry {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	entry := &LruEntry{
+		key:     append([]byte(nil), key...),
+		value:   value,
+		charge:  charge,
+		deleter: deleter,
+		refs:    2, // one for the cache, one for the handle
+		inCache: true,
+	}
+
+	if old, ok := s.m[string(key)]; ok {
+		s.remove(old)
+	}
+
+	pushFront(&s.inUse, entry)
+	s.m[string(key)] = entry
+	s.usage = s.usage + charge
+	s.pinned = s.pinned + charge
+	s.evict()
+	return entry
+}
+
+func (s *lruShard) lookup(key []byte) *LruEntry {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	entry, found := s.m[string(key)]
 	if !found {
-		return
+		s.misses++
+		return nil
 	}
 
-	if l.active == entry {
-		if entry.next != entry {
-			l.active = entry.next
-		} else {
-			l.active = nil
-		}
+	s.hits++
+	s.ref(entry)
+	return entry
+}
+
+func (s *lruShard) release(entry *LruEntry) {
+	s.mutex.Lock()
+	defer s.unlock()
+	s.unref(entry)
+	s.evict()
+}
+
+func (s *lruShard) erase(key []byte) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if entry, found := s.m[string(key)]; found {
+		s.remove(entry)
 	}
+}
+
+func (s *lruShard) prune() {
+	s.mutex.Lock()
+	defer s.unlock()
 
-	if entry.next != entry {
-		entry.next.prev = entry.prev
-		entry.prev.next = entry.next
+	for s.lru.next != &s.lru {
+		s.remove(s.lru.next)
 	}
-	delete(l.m, strKey)
-	l.numElements--
 }
 
-// insert an entry at the beginning
-func (l *LRU) pushFront(entry *LruEntry) {
-	if l.active != nil {
-		entry.next = l.active
-		entry.prev = l.active.prev
+// drop least recently used entries that are not pinned until the usage
+// is within capacity
+func (s *lruShard) evict() {
+	for s.usage > s.capacity && s.lru.prev != &s.lru {
+		s.remove(s.lru.prev)
+	}
+}
 
-		l.active.prev = entry
-		entry.prev.next = entry
-	} else {
-		entry.next = entry
-		entry.prev = entry
+func (s *lruShard) ref(entry *LruEntry) {
+	if entry.refs == 1 && entry.inCache {
+		unlink(entry)
+		pushFront(&s.inUse, entry)
+		s.pinned = s.pinned + entry.charge
 	}
+	entry.refs++
+}
 
-	l.active = entry
+func (s *lruShard) unref(entry *LruEntry) {
+	entry.refs--
+	switch {
+	case entry.refs < 0:
+		panic("lru entry is released too many times")
+	case entry.refs == 0:
+		if entry.deleter != nil {
+			s.dead = append(s.dead, entry)
+		}
+	case entry.refs == 1 && entry.inCache:
+		unlink(entry)
+		pushFront(&s.lru, entry)
+		s.pinned = s.pinned - entry.charge
+	}
 }
 
-// define the element of a double linked list
+// take @entry out of cache, it is gone once no longer pinned
+func (s *lruShard) remove(entry *LruEntry) {
+	unlink(entry)
+	delete(s.m, string(entry.key))
+	if entry.refs > 1 {
+		s.pinned = s.pinned - entry.charge
+	}
+	entry.inCache = false
+	s.usage = s.usage - entry.charge
+	s.unref(entry)
+}
+
+// insert an entry at the beginning of list @head
+func pushFront(head, entry *LruEntry) {
+	entry.next = head.next
+	entry.prev = head
+	head.next.prev = entry
+	head.next = entry
+}
+
+func unlink(entry *LruEntry) {
+	entry.next.prev = entry.prev
+	entry.prev.next = entry.next
+	entry.next, entry.prev = nil, nil
+}
+
+// define the element of a double linked list, it also serves as the
+// handle of a pinned entry
 type LruEntry struct {
 	prev, next *LruEntry
-	key []byte
-	value interface{}
+	key        []byte
+	value      interface{}
+	charge     int
+	deleter    func(key []byte, value interface{})
+	// number of handles, plus one if it is in cache
+	refs    int
+	inCache bool
+}
+
+// return the value of a pinned entry
+func (e *LruEntry) Value() interface{} {
+	return e.value
 }
@@ -2,18 +2,19 @@ package gdb
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 )
 
 func TestLruUnbounded(t *testing.T) {
 	vals := [...]int{5, 6, 7, 8, 9, 10}
 	lru := NewLRU(len(vals) + 1)
-	for _,v := range vals {
+	for _, v := range vals {
 		s := fmt.Sprintf("%d", v)
-		lru.Put([]byte(s), v)
+		lru.Put([]byte(s), v, 1)
 	}
 
-	for _,v := range vals {
+	for _, v := range vals {
 		s := fmt.Sprintf("%d", v)
 		val, found := lru.Get([]byte(s))
 		if !found {
@@ -29,12 +30,12 @@ func TestLruUnbounded(t *testing.T) {
 func TestLruEviction(t *testing.T) {
 	vals := [...]int{5, 6, 7, 8, 9, 10, 12}
 	lru := NewLRU(4)
-	for _,v := range vals {
+	for _, v := range vals {
 		s := fmt.Sprintf("%d", v)
-		lru.Put([]byte(s), v)
+		lru.Put([]byte(s), v, 1)
 	}
 
-	for i := 0; i < len(vals) - 4; i++ {
+	for i := 0; i < len(vals)-4; i++ {
 		v := vals[i]
 		s := fmt.Sprintf("%d", v)
 		_, found := lru.Get([]byte(s))
@@ -83,12 +84,12 @@ func TestLruRefresh(t *testing.T) {
 	}
 
 	lru := NewLRU(3)
-	for _,v := range actions {
+	for _, v := range actions {
 		s := fmt.Sprintf("%d", v.val)
 		if v.add {
-			lru.Put([]byte(s), v.val)
+			lru.Put([]byte(s), v.val, 1)
 		} else {
-			val,found := lru.Get([]byte(s))
+			val, found := lru.Get([]byte(s))
 			if v.present {
 				if !found {
 					t.Error("Fails to find entry ", v.val)
@@ -105,3 +106,116 @@ func TestLruRefresh(t *testing.T) {
 		}
 	}
 }
+
+func TestLruCharge(t *testing.T) {
+	lru := NewLRU(100)
+	lru.Put([]byte("a"), 1, 60)
+	lru.Put([]byte("b"), 2, 30)
+	lru.Put([]byte("c"), 3, 30)
+
+	// the oldest entry is evicted to make room
+	if _, found := lru.Get([]byte("a")); found {
+		t.Error("The entry should be evicted")
+	}
+	if lru.Usage() != 60 {
+		t.Error("Unexpected usage ", lru.Usage())
+	}
+
+	// an entry larger than the capacity does not stay
+	lru.Put([]byte("d"), 4, 200)
+	if _, found := lru.Get([]byte("d")); found || lru.Usage() != 0 {
+		t.Error("Oversized entry stays in cache ", lru.Usage())
+	}
+}
+
+func TestLruPinnedEntries(t *testing.T) {
+	deleted := make(map[string]int)
+	deleter := func(key []byte, value interface{}) {
+		deleted[string(key)] = value.(int)
+	}
+
+	lru := NewLRU(100)
+	h := lru.Insert([]byte("a"), 1, 80, deleter)
+	lru.Release(lru.Insert([]byte("b"), 2, 80, deleter))
+
+	// the pinned entry survives, the other one is evicted
+	if _, found := lru.Get([]byte("a")); !found || lru.PinnedUsage() != 80 {
+		t.Error("Pinned entry is evicted")
+	}
+	if deleted["b"] != 2 || len(deleted) != 1 {
+		t.Error("Deleter is not called for evicted entry ", deleted)
+	}
+
+	// erase takes effect once the entry is released
+	lru.Erase([]byte("a"))
+	if _, found := lru.Get([]byte("a")); found || lru.Usage() != 0 {
+		t.Error("Erased entry is still in cache")
+	}
+	if _, found := deleted["a"]; found || h.Value().(int) != 1 {
+		t.Error("Pinned entry is deleted")
+	}
+	lru.Release(h)
+	if deleted["a"] != 1 {
+		t.Error("Deleter is not called for released entry")
+	}
+}
+
+func TestLruPrune(t *testing.T) {
+	numDeleted := 0
+	deleter := func(key []byte, value interface{}) {
+		numDeleted++
+	}
+
+	lru := NewShardedLRU(1000, 2)
+	for i := 0; i < 10; i++ {
+		lru.Release(lru.Insert([]byte(fmt.Sprintf("%d", i)), i, 1, deleter))
+	}
+	h := lru.Insert([]byte("pinned"), 0, 1, deleter)
+
+	lru.Prune()
+	if numDeleted != 10 || lru.Usage() != 1 {
+		t.Error("Unexpected prune ", numDeleted, " ", lru.Usage())
+	}
+	if _, found := lru.Get([]byte("pinned")); !found {
+		t.Error("Pinned entry is pruned")
+	}
+	lru.Release(h)
+
+	if hits, misses := lru.Stats(); hits != 1 || misses != 0 {
+		t.Error("Unexpected stats ", hits, " ", misses)
+	}
+}
+
+func TestLruConcurrentAccess(t *testing.T) {
+	lru := NewShardedLRU(1000, 4)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("%d", (i*7+g)%300))
+				if h := lru.Lookup(key); h != nil {
+					if h.Value().(string) != string(key) {
+						t.Error("Value mismatch")
+					}
+					lru.Release(h)
+				} else {
+					lru.Put(key, string(key), 5)
+				}
+				if i%100 == 0 {
+					lru.Erase(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if lru.Usage() > 1000 || lru.PinnedUsage() != 0 {
+		t.Error("Unexpected usage ", lru.Usage(), " ", lru.PinnedUsage())
+	}
+	if hits, misses := lru.Stats(); hits+misses != 8*2000 {
+		t.Error("Unexpected stats ", hits, " ", misses)
+	}
+}
@@ -0,0 +1,105 @@
+package gdb
+
+// MemTable holds recent updates in memory before they are written
+// into a table file. Entries are keyed by internal keys, so every
+// update of a key is kept as a separate entry. Keys and values are
+// copied into memory owned by the memtable, so callers are free to
+// reuse their buffers.
+//
+// Add must not be called by more than one writer at a time, while
+// AddConcurrently may be called by any number of writers. Readers do
+// not need any lock in either case
+type MemTable struct {
+	list       *Skiplist
+	comparator *InternalKeyComparator
+	refs       int
+	// internal key being added by Add
+	scratch []byte
+}
+
+// Create a memtable. Its memory is charged to @manager unless it is
+// nil
+func MakeMemTable(c *InternalKeyComparator, manager *WriteBufferManager) *MemTable {
+	ret := &MemTable{}
+	ret.comparator = c
+	ret.list = MakeSkiplist(c, manager)
+	return ret
+}
+
+// Add an entry into memtable. @tag is either kTypeValue or
+// kTypeDeletion
+func (m *MemTable) Add(seq uint64, tag uint8, key, value []byte) {
+	m.scratch = MakeInternalKey(m.scratch[:0], key, seq, tag)
+	m.list.Put(m.scratch, value)
+}
+
+// Same as Add, but safe to be called by multiple writers at the same
+// time
+func (m *MemTable) AddConcurrently(seq uint64, tag uint8, key, value []byte) {
+	k := MakeInternalKey(nil, key, seq, tag)
+	m.list.PutConcurrently(k, value)
+}
+
+// Look up the newest version of a key whose sequence number is not
+// greater than @seq. If such an entry is found, return its tag and
+// value. The returned value points to memory owned by memtable
+func (m *MemTable) Get(key []byte, seq uint64) (tag uint8, value []byte, found bool) {
+	lookup := MakeInternalKey(nil, key, seq, kValueTypeForSeek)
+
+	iter := m.list.NewIterator(nil)
+	iter.Seek(lookup)
+	if !iter.Valid() {
+		return
+	}
+
+	parsed, ok := ParseInternalKey(iter.Key())
+	if !ok || m.comparator.user.Compare(parsed.userKey, key) != 0 {
+		return
+	}
+
+	tag, value, found = parsed.valueType, iter.Value(), true
+	return
+}
+
+// Return an iterator over the memtable. Keys returned by the iterator
+// are internal keys
+func (m *MemTable) NewIterator() Iterator {
+	return m.list.NewIterator(nil)
+}
+
+// Return true if nothing has been added into the memtable
+func (m *MemTable) Empty() bool {
+	return m.list.Len() == 0
+}
+
+// Return number of bytes held by the memtable
+func (m *MemTable) ApproximateMemoryUsage() int {
+	return m.list.MemoryReserved()
+}
+
+// Called when the memtable is switched for a new one and takes no
+// more writes
+func (m *MemTable) MarkImmutable() {
+	m.list.MarkImmutable()
+}
+
+// Memtables are shared by the db and its iterators, the last one to
+// drop its reference releases the memory
+func (m *MemTable) Ref() {
+	m.refs++
+}
+
+func (m *MemTable) Unref() {
+	m.refs--
+	switch {
+	case m.refs == 0:
+		m.Release()
+	case m.refs < 0:
+		panic("memtable reference becomes negative!")
+	}
+}
+
+// release all memory held by the memtable
+func (m *MemTable) Release() {
+	m.list.Release()
+}
@@ -0,0 +1,88 @@
+package gdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemTableVersions(t *testing.T) {
+	mem := MakeMemTable(MakeInternalKeyComparator(&BytesSkiplistOrder{}), nil)
+	defer mem.Release()
+
+	key := []byte("key")
+	mem.Add(1, kTypeValue, key, []byte("v1"))
+	mem.Add(2, kTypeValue, key, []byte("v2"))
+	mem.Add(3, kTypeDeletion, key, nil)
+	mem.Add(4, kTypeValue, []byte("other"), []byte("v4"))
+
+	// each sequence number sees the newest version not after it
+	expects := []struct {
+		seq   uint64
+		tag   uint8
+		value string
+	}{
+		{1, kTypeValue, "v1"},
+		{2, kTypeValue, "v2"},
+		{3, kTypeDeletion, ""},
+		{4, kTypeDeletion, ""},
+	}
+
+	for _, e := range expects {
+		tag, value, found := mem.Get(key, e.seq)
+		if !found {
+			t.Error("Fails to find key at sequence ", e.seq)
+			continue
+		}
+
+		if tag != e.tag || string(value) != e.value {
+			t.Error("Wrong entry at sequence ", e.seq, ": ", string(value))
+		}
+	}
+
+	if _, _, found := mem.Get(key, 0); found {
+		t.Error("No version should be visible at sequence 0")
+	}
+
+	if _, _, found := mem.Get([]byte("missing"), 4); found {
+		t.Error("Should not find a missing key")
+	}
+}
+
+func TestMemTableAddConcurrently(t *testing.T) {
+	const numWriters = 8
+	const numPerWriter = 2000
+
+	mem := MakeMemTable(MakeInternalKeyComparator(&BytesSkiplistOrder{}), nil)
+	defer mem.Release()
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numPerWriter; i++ {
+				seq := uint64(w*numPerWriter + i + 1)
+				key := []byte(fmt.Sprintf("key%06d", i))
+				mem.AddConcurrently(seq, kTypeValue, key, key)
+
+				// read back while other writers are adding
+				tag, value, found := mem.Get(key, seq)
+				if !found || tag != kTypeValue || string(value) != string(key) {
+					t.Error("Fails to get key ", string(key), " at ", seq)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	count := 0
+	iter := mem.NewIterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		count++
+	}
+	if count != numWriters*numPerWriter {
+		t.Error("Expect ", numWriters*numPerWriter, " entries, got ", count)
+	}
+}
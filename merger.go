@@ -0,0 +1,193 @@
+package gdb
+
+import (
+	"container/heap"
+)
+
+// MergingIterator yields the union of entries from a set of child
+// iterators in the order of a comparator. Valid children are kept in
+// a heap, so moving the iterator costs O(log N) for N children.
+// Moving forward uses a min heap and moving backward a max heap. When
+// the direction changes, all children are repositioned around the
+// current key
+type MergingIterator struct {
+	children []Iterator
+	heap     mergingHeap
+	forward  bool
+}
+
+// Create an iterator over the union of @children, ordered by @c
+func MakeMergingIterator(children []Iterator, c Comparator) *MergingIterator {
+	ret := &MergingIterator{}
+	ret.children = children
+	ret.heap.order = c
+	ret.heap.iters = make([]Iterator, 0, len(children))
+	ret.forward = true
+	return ret
+}
+
+// Rebuild the heap from valid children. Must be called after children
+// are repositioned
+func (it *MergingIterator) rebuild(forward bool) {
+	it.forward = forward
+	it.heap.reverse = !forward
+	it.heap.iters = it.heap.iters[:0]
+	for _, child := range it.children {
+		if child.Valid() {
+			it.heap.iters = append(it.heap.iters, child)
+		}
+	}
+	heap.Init(&it.heap)
+}
+
+// Update the heap after the child on top of it moves
+func (it *MergingIterator) fixTop() {
+	if it.heap.iters[0].Valid() {
+		heap.Fix(&it.heap, 0)
+	} else {
+		heap.Pop(&it.heap)
+	}
+}
+
+func (it *MergingIterator) Valid() bool {
+	return len(it.heap.iters) > 0
+}
+
+func (it *MergingIterator) SeekToFirst() {
+	for _, child := range it.children {
+		child.SeekToFirst()
+	}
+	it.rebuild(true)
+}
+
+func (it *MergingIterator) SeekToLast() {
+	for _, child := range it.children {
+		child.SeekToLast()
+	}
+	it.rebuild(false)
+}
+
+func (it *MergingIterator) Seek(key []byte) {
+	for _, child := range it.children {
+		child.Seek(key)
+	}
+	it.rebuild(true)
+}
+
+func (it *MergingIterator) Next() {
+	current := it.heap.iters[0]
+
+	if !it.forward {
+		// other children are positioned before the current key, move
+		// them to the first entry after it
+		key := current.Key()
+		for _, child := range it.children {
+			if child == current {
+				continue
+			}
+
+			child.Seek(key)
+			if child.Valid() && it.heap.order.Compare(child.Key(), key) == 0 {
+				child.Next()
+			}
+		}
+
+		current.Next()
+		it.rebuild(true)
+		return
+	}
+
+	current.Next()
+	it.fixTop()
+}
+
+func (it *MergingIterator) Prev() {
+	current := it.heap.iters[0]
+
+	if it.forward {
+		// other children are positioned after the current key, move
+		// them to the last entry before it
+		key := current.Key()
+		for _, child := range it.children {
+			if child == current {
+				continue
+			}
+
+			child.Seek(key)
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+
+		current.Prev()
+		it.rebuild(false)
+		return
+	}
+
+	current.Prev()
+	it.fixTop()
+}
+
+func (it *MergingIterator) Key() []byte {
+	return it.heap.iters[0].Key()
+}
+
+func (it *MergingIterator) Value() []byte {
+	return it.heap.iters[0].Value()
+}
+
+// Release all children
+func (it *MergingIterator) Release() {
+	it.heap.iters = it.heap.iters[:0]
+	for _, child := range it.children {
+		child.Release()
+	}
+}
+
+// A child that fails turns invalid and drops out of the heap, so the
+// merged iterator fails if any child does
+func (it *MergingIterator) Status() Status {
+	for _, child := range it.children {
+		if s := child.Status(); !s.Ok() {
+			return s
+		}
+	}
+	return MakeStatusOk()
+}
+
+// A heap of iterators ordered by their current keys. The smallest key
+// is on top, or the largest one if @reverse is true
+type mergingHeap struct {
+	iters   []Iterator
+	order   Comparator
+	reverse bool
+}
+
+func (h *mergingHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h *mergingHeap) Less(i, j int) bool {
+	r := h.order.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if h.reverse {
+		return r > 0
+	}
+	return r < 0
+}
+
+func (h *mergingHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *mergingHeap) Push(x interface{}) {
+	h.iters = append(h.iters, x.(Iterator))
+}
+
+func (h *mergingHeap) Pop() interface{} {
+	last := len(h.iters) - 1
+	ret := h.iters[last]
+	h.iters = h.iters[:last]
+	return ret
+}
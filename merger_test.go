@@ -0,0 +1,112 @@
+package gdb
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// build children holding keys 0..n-1 in a round robin way, return
+// the children and all keys in order
+func makeMergingTestChildren(numChildren, n int) ([]Iterator, []string) {
+	lists := make([]*Skiplist, numChildren)
+	for i := range lists {
+		lists[i] = MakeSkiplist()
+	}
+
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%06d", i*2)
+		keys = append(keys, key)
+		lists[i%numChildren].Put([]byte(key), []byte(key))
+	}
+
+	children := make([]Iterator, numChildren)
+	for i, l := range lists {
+		children[i] = l.NewIterator(nil)
+	}
+	return children, keys
+}
+
+func TestMergingIteratorScan(t *testing.T) {
+	children, keys := makeMergingTestChildren(3, 100)
+	iter := MakeMergingIterator(children, &BytesSkiplistOrder{})
+
+	idx := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if string(iter.Key()) != keys[idx] || string(iter.Value()) != keys[idx] {
+			t.Fatal("key mismatch ", string(iter.Key()), " expect ", keys[idx])
+		}
+		idx++
+	}
+	if idx != len(keys) {
+		t.Error("Forward scan returns ", idx, " keys")
+	}
+
+	idx = len(keys) - 1
+	for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+		if string(iter.Key()) != keys[idx] {
+			t.Fatal("key mismatch ", string(iter.Key()), " expect ", keys[idx])
+		}
+		idx--
+	}
+	if idx != -1 {
+		t.Error("Backward scan stops at ", idx)
+	}
+}
+
+func TestMergingIteratorEmptyChildren(t *testing.T) {
+	children := []Iterator{
+		MakeSkiplist().NewIterator(nil),
+		MakeSkiplist().NewIterator(nil),
+	}
+	iter := MakeMergingIterator(children, &BytesSkiplistOrder{})
+
+	iter.SeekToFirst()
+	if iter.Valid() {
+		t.Error("Iterator over empty children is valid")
+	}
+
+	iter.Seek([]byte("key"))
+	if iter.Valid() {
+		t.Error("Iterator over empty children is valid after seek")
+	}
+}
+
+func TestMergingIteratorSwitchDirection(t *testing.T) {
+	children, keys := makeMergingTestChildren(4, 200)
+	iter := MakeMergingIterator(children, &BytesSkiplistOrder{})
+
+	rnd := rand.New(rand.NewSource(1))
+
+	// follow the iterator with an index into @keys
+	idx := 0
+	iter.SeekToFirst()
+	for step := 0; step < 5000; step++ {
+		switch rnd.Intn(4) {
+		case 0, 1:
+			iter.Next()
+			idx++
+		case 2:
+			iter.Prev()
+			idx--
+		default:
+			// seek to a key between existing keys
+			n := rnd.Intn(2 * len(keys))
+			iter.Seek([]byte(fmt.Sprintf("key%06d", n)))
+			idx = (n + 1) / 2
+		}
+
+		if idx < 0 || idx >= len(keys) {
+			if iter.Valid() {
+				t.Fatal("Iterator should be invalid at step ", step)
+			}
+			idx = rnd.Intn(len(keys))
+			iter.Seek([]byte(keys[idx]))
+		}
+
+		if !iter.Valid() || string(iter.Key()) != keys[idx] {
+			t.Fatal("Iterator is not at ", keys[idx], " at step ", step)
+		}
+	}
+}
@@ -23,8 +23,12 @@ const (
 
 type PoolAllocator struct {
 	bytesPerAlloc int
-	pool          [][]byte
-	current       []byte
+	// all mmapped blocks, including the one being carved
+	pool [][]byte
+	// unused space of the last block
+	current []byte
+	// bytes handed out
+	used int
 }
 
 // takes 0 or 1 parameters. If there is no parameter, the default
@@ -41,8 +45,7 @@ func MakePoolAllocator(bytes ...int) *PoolAllocator {
 		panic("init only takes 0 or 1 parameter!")
 	}
 
-	ret.pool = make([][]byte, kNumBlocks)
-	ret.current, _ = MmapAlloc(ret.bytesPerAlloc)
+	ret.pool = make([][]byte, 0, kNumBlocks)
 	return ret
 }
 
@@ -52,19 +55,41 @@ func (a *PoolAllocator) Allocate(size int) []byte {
 	if len(a.current) >= size {
 		ret := a.current[:size]
 		a.current = a.current[size:]
+		a.used = a.used + size
 		return ret
-	} else if len(a.current) > a.bytesPerAlloc {
+	} else if size > a.bytesPerAlloc {
 		panic("Too big allocation")
 	} else {
-		a.pool = append(a.pool, a.current)
-		a.current, _ = MmapAlloc(a.bytesPerAlloc)
+		block, err := MmapAlloc(a.bytesPerAlloc)
+		if err != nil {
+			panic("Fails to mmap a block")
+		}
+
+		// the rest of the previous block is wasted
+		a.pool = append(a.pool, block)
+		a.current = block
 		return a.Allocate(size)
 	}
 }
 
-// release all memories that has been allocated
+// Return number of bytes handed out by Allocate
+func (a *PoolAllocator) MemoryUsage() int {
+	return a.used
+}
+
+// Return number of bytes mmapped by the allocator
+func (a *PoolAllocator) Reserved() int {
+	return len(a.pool) * a.bytesPerAlloc
+}
+
+// release all memories that has been allocated. The allocator can
+// be used again afterwards
 func (a *PoolAllocator) DeallocateAll() {
-	for _, a := range a.pool {
-		MmapDealloc(a)
+	for _, block := range a.pool {
+		MmapDealloc(block)
 	}
+
+	a.pool = a.pool[:0]
+	a.current = nil
+	a.used = 0
 }
@@ -66,3 +66,33 @@ func TestManyPoolAllocDealloc(t *testing.T) {
 
 	mp.DeallocateAll()
 }
+
+func TestPoolAllocMemoryUsage(t *testing.T) {
+	mp := MakePoolAllocator(4096)
+	if mp.MemoryUsage() != 0 || mp.Reserved() != 0 {
+		t.Error("Fresh allocator holds memory")
+	}
+
+	mp.Allocate(1000)
+	mp.Allocate(3000)
+	if mp.MemoryUsage() != 4000 || mp.Reserved() != 4096 {
+		t.Error("Unexpected usage ", mp.MemoryUsage(), " ", mp.Reserved())
+	}
+
+	// does not fit into the rest of the first block
+	mp.Allocate(100)
+	if mp.MemoryUsage() != 4100 || mp.Reserved() != 8192 {
+		t.Error("Unexpected usage ", mp.MemoryUsage(), " ", mp.Reserved())
+	}
+
+	mp.DeallocateAll()
+	if mp.MemoryUsage() != 0 || mp.Reserved() != 0 {
+		t.Error("Memory is not released ", mp.MemoryUsage(), " ", mp.Reserved())
+	}
+
+	x := mp.Allocate(512)
+	if len(x) != 512 || mp.Reserved() != 4096 {
+		t.Error("Fails to allocate after deallocation")
+	}
+	mp.DeallocateAll()
+}
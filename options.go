@@ -1,10 +1,200 @@
 package gdb
 
+const (
+	kDefaultWriteBufferSize      = 4 * 1024 * 1024
+	kDefaultMaxOpenFiles         = 1000
+	kDefaultBlockSize            = 4 * 1024
+	kDefaultBlockRestartInterval = 8
+	kDefaultBlockCacheCapacity   = 8 * 1024 * 1024
+	kDefaultMaxCompressionRatio  = 0.875
+)
+
+// How blocks are compressed in table files. The type of a block is
+// saved in its trailer, so tables written with any type can be read
+type CompressionType int
+
+const (
+	NoCompression CompressionType = iota
+	// Snappy block format
+	SnappyCompression
+	// LZ4 block format, preceded by the size of the raw block
+	LZ4Compression
+	// raw DEFLATE stream of compress/flate
+	FlateCompression
+)
+
+// How blocks in table files are checksummed
+type ChecksumType int
+
+const (
+	CRC32CChecksum ChecksumType = iota
+	XXHashChecksum
+)
+
+// Options to open a db. The zero value of a field means its default
 type Options struct {
+	// Order of user keys. Defaults to lexicographic byte order. The
+	// same comparator must be used every time a db is opened
+	Comparator Comparator
+
+	// Access to file system. Defaults to NativeEnv
+	Env Env
+
+	// Create the db if it does not exist
+	CreateIfMissing bool
+
+	// Fail to open if the db already exists
+	ErrorIfExists bool
+
+	// Fail on any sign of data corruption, instead of skipping
+	// the damaged data
+	ParanoidChecks bool
+
+	// Amount of data to build up in memtable before it is written
+	// into a table file. Defaults to kDefaultWriteBufferSize
+	WriteBufferSize int
+
+	// Number of table files that can be kept open. Defaults to
+	// kDefaultMaxOpenFiles
+	MaxOpenFiles int
+
+	// Approximate size of data in a leaf block of table files.
+	// Defaults to kDefaultBlockSize
+	BlockSize int
+
+	// Number of keys between full keys in a leaf block, other keys
+	// are encoded against the previous key. Defaults to
+	// kDefaultBlockRestartInterval
+	BlockRestartInterval int
+
+	// Number of bytes of table blocks kept in memory to save reads
+	// from table files. Defaults to kDefaultBlockCacheCapacity, a
+	// negative value turns block cache off
+	BlockCacheCapacity int
+
+	// Compression of leaf blocks in new table files. Defaults to
+	// NoCompression
+	Compression CompressionType
+
+	// A compressed block is kept only if its size is at most this
+	// fraction of the raw block, otherwise the raw block is written.
+	// Defaults to kDefaultMaxCompressionRatio
+	MaxCompressionRatio float64
+
+	// Checksum of blocks in new table files. Defaults to CRC32CChecksum.
+	// Tables written with any checksum type can be read
+	Checksum ChecksumType
+
+	// Filter to skip table reads for keys that are not in a table.
+	// Nil means no filter
+	FilterPolicy FilterPolicy
+
+	// If not nil, memory of memtables is charged to it, and memtables
+	// are flushed early when it is over budget. The same manager can
+	// be shared by many dbs to cap their total memtable memory
+	WriteBufferManager *WriteBufferManager
+}
+
+// Return options with all fields set to their defaults
+func MakeOptions() Options {
+	ret := Options{}
+	ret.fillDefaults()
+	return ret
+}
+
+// replace zero values with defaults
+func (opt *Options) fillDefaults() {
+	if opt.Comparator == nil {
+		opt.Comparator = &BytesSkiplistOrder{}
+	}
+	if opt.Env == nil {
+		opt.Env = NativeEnv{}
+	}
+	if opt.WriteBufferSize == 0 {
+		opt.WriteBufferSize = kDefaultWriteBufferSize
+	}
+	if opt.MaxOpenFiles == 0 {
+		opt.MaxOpenFiles = kDefaultMaxOpenFiles
+	}
+	if opt.BlockSize == 0 {
+		opt.BlockSize = kDefaultBlockSize
+	}
+	if opt.BlockRestartInterval == 0 {
+		opt.BlockRestartInterval = kDefaultBlockRestartInterval
+	}
+	if opt.BlockCacheCapacity == 0 {
+		opt.BlockCacheCapacity = kDefaultBlockCacheCapacity
+	}
+	if opt.MaxCompressionRatio == 0 {
+		opt.MaxCompressionRatio = kDefaultMaxCompressionRatio
+	}
+}
+
+// Fill in defaults of @opt, return an invalid argument status if the
+// options do not make sense
+func sanitizeOptions(opt Options) (Options, Status) {
+	opt.fillDefaults()
+
+	switch {
+	case opt.ErrorIfExists && !opt.CreateIfMissing:
+		return opt, MakeStatusInvalidArgument("ErrorIfExists requires CreateIfMissing")
+	case opt.WriteBufferSize < 64*1024:
+		return opt, MakeStatusInvalidArgument("WriteBufferSize is less than 64KB")
+	case opt.MaxOpenFiles < 0:
+		return opt, MakeStatusInvalidArgument("MaxOpenFiles is negative")
+	case opt.BlockSize < 0:
+		return opt, MakeStatusInvalidArgument("BlockSize is negative")
+	case opt.BlockSize > opt.WriteBufferSize:
+		return opt, MakeStatusInvalidArgument("BlockSize is larger than WriteBufferSize")
+	case opt.BlockRestartInterval < 0:
+		return opt, MakeStatusInvalidArgument("BlockRestartInterval is negative")
+	case opt.Compression < NoCompression || opt.Compression > FlateCompression:
+		return opt, MakeStatusInvalidArgument("unknown compression type")
+	case opt.MaxCompressionRatio < 0 || opt.MaxCompressionRatio > 1:
+		return opt, MakeStatusInvalidArgument("MaxCompressionRatio is not between 0 and 1")
+	case opt.Checksum != CRC32CChecksum && opt.Checksum != XXHashChecksum:
+		return opt, MakeStatusInvalidArgument("unknown checksum type")
+	}
+
+	return opt, MakeStatusOk()
 }
 
 type ReadOptions struct {
+	// Verify checksums of all data read from table files. Checksums
+	// are always verified if Options.ParanoidChecks is set
+	VerifyChecksums bool
+
+	// Keep blocks read from table files out of block cache. Bulk
+	// scans may want to set it, so that they do not push out blocks
+	// used by other reads
+	DontFillCache bool
+
+	// If not nil, read as of the state of the snapshot. Otherwise,
+	// read the latest state
+	Snapshot Snapshot
+}
+
+// Return read options with default values
+func MakeReadOptions() ReadOptions {
+	return ReadOptions{}
 }
 
 type WriteOptions struct {
+	// Sync write ahead log to disk before the write returns. Without
+	// it, recent writes may be lost if the machine crashes, but not
+	// if only the process crashes
+	Sync bool
+}
+
+type CompactRangeOptions struct {
+	// Level that compacted data ends up in. Nil means the deepest
+	// level holding data in the range. A level beyond the last level
+	// means the last level
+	TargetLevel *int
+}
+
+type SizeApproximationOptions struct {
+	// If true, data in memtables that has not been written into table
+	// files is counted as well
+	IncludeMemtable bool
 }
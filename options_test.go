@@ -0,0 +1,57 @@
+package gdb
+
+import (
+	"testing"
+)
+
+func TestSanitizeOptionsDefaults(t *testing.T) {
+	opt, s := sanitizeOptions(Options{CreateIfMissing: true})
+	if !s.Ok() {
+		t.Fatal("Default options are rejected ", s.ToString())
+	}
+
+	if opt.Comparator == nil || opt.Env == nil {
+		t.Error("Comparator or Env is not filled in")
+	}
+
+	if opt.WriteBufferSize != kDefaultWriteBufferSize ||
+		opt.MaxOpenFiles != kDefaultMaxOpenFiles ||
+		opt.BlockSize != kDefaultBlockSize ||
+		opt.BlockRestartInterval != kDefaultBlockRestartInterval ||
+		opt.BlockCacheCapacity != kDefaultBlockCacheCapacity ||
+		opt.MaxCompressionRatio != kDefaultMaxCompressionRatio {
+		t.Error("Bad defaults ", opt)
+	}
+
+	if !opt.CreateIfMissing {
+		t.Error("Explicit option is overwritten")
+	}
+
+	if MakeReadOptions().DontFillCache {
+		t.Error("Read options do not fill cache by default")
+	}
+}
+
+func TestSanitizeOptionsInvalid(t *testing.T) {
+	bad := []Options{
+		{ErrorIfExists: true},
+		{WriteBufferSize: 1024},
+		{WriteBufferSize: -1},
+		{MaxOpenFiles: -1},
+		{BlockSize: -1},
+		{BlockSize: 8 * 1024 * 1024},
+		{BlockRestartInterval: -1},
+		{Compression: CompressionType(100)},
+		{Compression: CompressionType(-1)},
+		{MaxCompressionRatio: -0.5},
+		{MaxCompressionRatio: 1.5},
+		{Checksum: ChecksumType(100)},
+	}
+
+	for _, opt := range bad {
+		_, s := sanitizeOptions(opt)
+		if !s.IsInvalidArgument() {
+			t.Error("Options should be rejected ", opt)
+		}
+	}
+}
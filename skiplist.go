@@ -2,6 +2,8 @@ package gdb
 
 import (
 	"bytes"
+	"sync"
+	"sync/atomic"
 )
 
 type BytesSkiplistOrder struct {
@@ -11,35 +13,51 @@ func (x BytesSkiplistOrder) Compare(a, b []byte) int {
 	return bytes.Compare(a, b)
 }
 
+// Skiplist is safe for a single writer calling Put and any number of
+// concurrent readers without locking. A node is fully built before it
+// is linked into a level with an atomic store, and nodes are linked
+// from the bottom level up, so a reader either misses a new node or
+// sees it completely. Multiple writers may insert at the same time with
+// PutConcurrently, which links nodes with compare-and-swap. Put and
+// PutConcurrently must not be mixed on the same skiplist.
+//
+// Nodes, keys and values are all kept in an arena, which is released
+// as a whole by Release
 type Skiplist struct {
-	levels    []skiplistNode
-	allocator *skiplistNodeAllocator
-	gen       *randomGenerator
-	order     Comparator
-	numNodes  int
+	arena *arena
+	// offset of a node without key, which heads all levels
+	head     uint64
+	gen      *randomGenerator
+	order    Comparator
+	numNodes int64
+	// protects arena and gen in PutConcurrently
+	mutex sync.Mutex
 }
 
 // Create a new skiplist. It can take up to 2 parameters:
 // First optional parameter (Comparator): the customized comparator
-// Second optional parameter (Allocator): a customized byte allocator
+// Second optional parameter (*WriteBufferManager): the manager that
+// memory of the skiplist is charged to
 func MakeSkiplist(args ...interface{}) *Skiplist {
 	ret := Skiplist{}
 
+	var manager *WriteBufferManager
 	switch len(args) {
 	case 0:
 		ret.order = &BytesSkiplistOrder{}
-		ret.allocator = makeNodeAllocator()
 	case 1:
 		ret.order = args[0].(Comparator)
-		ret.allocator = makeNodeAllocator()
 	case 2:
 		ret.order = args[0].(Comparator)
-		ret.allocator = makeNodeAllocator(args[1].(*PoolAllocator))
+		manager, _ = args[1].(*WriteBufferManager)
 	default:
-		panic("args is either 0 or 1")
+		panic("args is 0, 1 or 2")
 	}
 
-	ret.levels = make([]skiplistNode, maxLevel+1)
+	ret.arena = makeArena(manager)
+	ret.head = ret.arena.allocate(skiplistNodeSize(maxLevel, 0, 0))
+	makeSkiplistNode(ret.arena, ret.head, maxLevel, nil, nil)
+
 	ret.gen = makeRandomGenerator()
 	ret.numNodes = 0
 	return &ret
@@ -47,210 +65,204 @@ func MakeSkiplist(args ...interface{}) *Skiplist {
 
 // insert a key value pair into skip list. If the key is already
 // in the list, the entry will not be updated. The orginal value
-// of the key will be returned
+// of the key will be returned. Both @key and @val are copied into
+// the skiplist
 func (a *Skiplist) Put(key []byte, val []byte) (old []byte, ok bool) {
-	prevList, found := a.trace(key)
+	prevList, next, found := a.trace(key)
 	if found {
-		leaf := prevList[0].(*skiplistLeafNode)
-		ok, old = false, leaf.value
+		ok, old = false, a.node(next).value()
 		return
 	}
 
-	height := a.gen.get() + 1
-	var child skiplistNode
-
-	for i := 0; i < height; i++ {
-		var newNode skiplistNode
-		if i == 0 {
-			newLeaf := a.allocator.newLeaf()
-			newLeaf.value = val
-			newNode = newLeaf
-		} else {
-			newPointer := a.allocator.newPointer()
-			newNode = newPointer
-		}
+	offset, node := a.newNode(key, val, a.gen.get()+1)
+	for i := 0; i < node.height(); i++ {
+		// publish the node after it is fully built
+		node.setNext(i, prevList[i].getNext(i))
+		prevList[i].setNext(i, offset)
+	}
 
-		newNode.setKey(key)
+	atomic.AddInt64(&a.numNodes, 1)
+	ok = true
+	return
+}
 
-		if prevList[i] != nil {
-			newNode.setNext(prevList[i].getNext())
-			prevList[i].setNext(newNode)
-		} else {
-			newNode.setNext(a.levels[i])
-			a.levels[i] = newNode
-		}
+// Same as Put, but safe to be called by multiple writers at the same
+// time. If a writer finds the predecessor of a level changed under it,
+// it searches forward from the old predecessor and retries
+func (a *Skiplist) PutConcurrently(key []byte, val []byte) (old []byte, ok bool) {
+	prevList, next, found := a.trace(key)
+	if found {
+		ok, old = false, a.node(next).value()
+		return
+	}
 
-		if child != nil {
-			newNode.setChild(child)
-		}
+	a.mutex.Lock()
+	offset, node := a.newNode(key, val, a.gen.get()+1)
+	a.mutex.Unlock()
+
+	for i := 0; i < node.height(); i++ {
+		prev := prevList[i]
+		for true {
+			next := prev.getNext(i)
+			if next != 0 {
+				nextNode := a.node(next)
+				r := a.order.Compare(nextNode.key(), key)
+				if r < 0 {
+					prev = nextNode
+					continue
+				}
+
+				// another writer has inserted the same key, nothing
+				// has been linked yet since level 0 goes first
+				if r == 0 {
+					ok, old = false, nextNode.value()
+					return
+				}
+			}
 
-		child = newNode
+			node.setNext(i, next)
+			if prev.casNext(i, next, offset) {
+				break
+			}
+		}
 	}
 
+	atomic.AddInt64(&a.numNodes, 1)
 	ok = true
 	return
 }
 
+// allocate and build a node of @height levels, return its offset and
+// the node
+func (a *Skiplist) newNode(key, val []byte, height int) (uint64, skiplistNode) {
+	offset := a.arena.allocate(skiplistNodeSize(height, len(key), len(val)))
+	return offset, makeSkiplistNode(a.arena, offset, height, key, val)
+}
+
+func (a *Skiplist) node(offset uint64) skiplistNode {
+	return getSkiplistNode(a.arena, offset)
+}
+
 // Look up a key in the skiplist. Return the corresponding value and true
 // if the key is in the skiplist. Otherwise return an empty slice and
 // false
 func (a *Skiplist) Get(key []byte) (value []byte, ok bool) {
-	prevList, ok := a.trace(key)
+	_, next, ok := a.trace(key)
 	if ok {
-		leaf := prevList[0].(*skiplistLeafNode)
-		value, ok = leaf.value, true
+		value, ok = a.node(next).value(), true
 	} else {
 		ok = false
 	}
 	return
 }
 
+// Return number of entries in the skiplist
+func (a *Skiplist) Len() int {
+	return int(atomic.LoadInt64(&a.numNodes))
+}
+
+// Return number of bytes taken by nodes, keys and values of the
+// skiplist
+func (a *Skiplist) MemoryUsage() int {
+	return a.arena.memoryUsage()
+}
+
+// Return number of bytes of memory held by the skiplist, including
+// space reserved for later entries
+func (a *Skiplist) MemoryReserved() int {
+	return a.arena.memoryReserved()
+}
+
+// No more entries will be put into the skiplist
+func (a *Skiplist) MarkImmutable() {
+	a.arena.markImmutable()
+}
+
+// Release all memory held by the skiplist. The skiplist and its
+// iterators must not be used afterwards
+func (a *Skiplist) Release() {
+	a.arena.deallocateAll()
+}
+
 func (a *Skiplist) NewIterator(opt *ReadOptions) Iterator {
 	return makeSkiplistIter(a)
 }
 
-// Find out nodes in all levels that point a key either before @key or
-// exactly point to @key. Return true if @key is in the skip list,
-// otherwise false
-func (a *Skiplist) trace(key []byte) (ret []skiplistNode, found bool) {
-	numLevels := len(a.levels)
-	ret = make([]skiplistNode, numLevels)
-	var prev skiplistNode
-
-	for cur, i := a.levels[numLevels-1], numLevels-1; i >= 0; {
-		if cur == nil {
-			i--
-			if i >= 0 {
-				cur = a.levels[i]
-			} else {
+// Find out nodes in all levels that are immediately before @key. A
+// node may be the head. Also return offset of the first node not less
+// than @key, and true if its key equals @key. The offset must be used
+// instead of reading the link again, since other writers may have
+// inserted nodes before it since then
+func (a *Skiplist) trace(key []byte) (ret []skiplistNode, next uint64, found bool) {
+	ret = make([]skiplistNode, maxLevel)
+
+	cur := a.node(a.head)
+	for i := maxLevel - 1; i >= 0; i-- {
+		found = false
+		for true {
+			next = cur.getNext(i)
+			if next == 0 {
 				break
 			}
-			continue
-		}
 
-		switch a.order.Compare(cur.getKey(), key) {
-		case -1:
-			prev = cur
-			cur = cur.getNext()
-			if cur == nil {
-				ret[i] = prev
-				i--
-				cur = prev.getChild()
-				prev = nil
-			}
-		case 0:
-			found = true
-			ret[i] = cur
-			i--
-			cur = cur.getChild()
-			prev = nil
-		case 1:
-			ret[i] = prev
-			i--
-			if prev != nil {
-				cur = prev.getChild()
-				prev = nil
-			} else if i >= 0 {
-				cur = a.levels[i]
+			nextNode := a.node(next)
+			r := a.order.Compare(nextNode.key(), key)
+			if r >= 0 {
+				found = r == 0
+				break
 			}
-		default:
-			panic("Invaid comparison value")
+			cur = nextNode
 		}
+
+		ret[i] = cur
 	}
 
 	return
 }
 
-func (a *Skiplist) traceBackward(key []byte) []skiplistNode {
-	numLevels := len(a.levels)
-	ret := make([]skiplistNode, numLevels)
-	var prev skiplistNode
-
-	for cur, i := a.levels[numLevels-1], numLevels-1; i >= 0; {
-		if cur == nil {
-			i--
-			if i >= 0 {
-				cur = a.levels[i]
-			} else {
+// Return offset of the node immediately before @key, or 0 if there
+// is none
+func (a *Skiplist) locateBefore(key []byte) uint64 {
+	var ret uint64
+
+	cur := a.node(a.head)
+	for i := maxLevel - 1; i >= 0; i-- {
+		for true {
+			next := cur.getNext(i)
+			if next == 0 {
 				break
 			}
-			continue
-		}
 
-		switch a.order.Compare(cur.getKey(), key) {
-		case -1:
-			prev = cur
-			cur = cur.getNext()
-			if cur == nil {
-				ret[i] = prev
-				i--
-				cur = prev.getChild()
-				prev = nil
-			}
-		case 0:
-			fallthrough
-		case 1:
-			ret[i] = prev
-			i--
-			if prev != nil {
-				cur = prev.getChild()
-				prev = nil
-			} else if i >= 0 {
-				cur = a.levels[i]
+			nextNode := a.node(next)
+			if a.order.Compare(nextNode.key(), key) >= 0 {
+				break
 			}
-		default:
-			panic("Invaid comparison value")
+			ret, cur = next, nextNode
 		}
 	}
 
 	return ret
 }
 
-func (a *Skiplist) locateLast() skiplistNode {
-	numLevels := len(a.levels)
-	ret := make([]skiplistNode, numLevels)
-	var prev skiplistNode
-
-	for cur, i := a.levels[numLevels-1], numLevels-1; i >= 0; {
-		if cur == nil {
-			i--
-			if i >= 0 {
-				cur = a.levels[i]
-			} else {
-				break
-			}
-			continue
-		}
+// Return offset of the last node, or 0 if the list is empty
+func (a *Skiplist) locateLast() uint64 {
+	var ret uint64
 
-		switch {
-		case cur.getNext() != nil:
-			prev = cur
-			cur = cur.getNext()
-			if cur == nil {
-				ret[i] = prev
-				i--
-				cur = prev.getChild()
-				prev = nil
-			}
-		default:
-			ret[i] = cur
-			i--
-			if prev != nil {
-				cur = prev.getChild()
-				prev = nil
-			} else if i >= 0 {
-				cur = a.levels[i]
-			}
+	cur := a.node(a.head)
+	for i := maxLevel - 1; i >= 0; i-- {
+		for next := cur.getNext(i); next != 0; next = cur.getNext(i) {
+			ret, cur = next, a.node(next)
 		}
 	}
 
-	return ret[0]
+	return ret
 }
 
 // Iterator class for skiplist
 type skiplistIter struct {
 	slist *Skiplist
-	cur   skiplistNode
+	cur   uint64
+	node  skiplistNode
 }
 
 func makeSkiplistIter(s *Skiplist) *skiplistIter {
@@ -259,41 +271,52 @@ func makeSkiplistIter(s *Skiplist) *skiplistIter {
 	return ret
 }
 
+// position the iterator on the node at @offset
+func (a *skiplistIter) moveTo(offset uint64) {
+	a.cur = offset
+	if offset != 0 {
+		a.node = a.slist.node(offset)
+	} else {
+		a.node = nil
+	}
+}
+
 func (a *skiplistIter) Valid() bool {
-	return a.cur != nil
+	return a.cur != 0
 }
 
 func (a *skiplistIter) SeekToFirst() {
-	a.cur = a.slist.levels[0]
+	a.moveTo(a.slist.node(a.slist.head).getNext(0))
 }
 
 func (a *skiplistIter) SeekToLast() {
-	a.cur = a.slist.locateLast()
+	a.moveTo(a.slist.locateLast())
 }
 
 func (a *skiplistIter) Seek(key []byte) {
-	traces, match := a.slist.trace(key)
-	if match {
-		a.cur = traces[0]
-	} else if traces[0] != nil {
-		a.cur = traces[0].getNext()
-	}
+	_, next, _ := a.slist.trace(key)
+	a.moveTo(next)
 }
 
 func (a *skiplistIter) Next() {
-	a.cur = a.cur.getNext()
+	a.moveTo(a.node.getNext(0))
 }
 
 func (a *skiplistIter) Prev() {
-	key := a.cur.getKey()
-	a.cur = a.slist.traceBackward(key)[0]
+	a.moveTo(a.slist.locateBefore(a.node.key()))
 }
 
 func (a *skiplistIter) Key() []byte {
-	return a.cur.getKey()
+	return a.node.key()
 }
 
 func (a *skiplistIter) Value() []byte {
-	leaf := a.cur.(*skiplistLeafNode)
-	return leaf.value
+	return a.node.value()
+}
+
+func (a *skiplistIter) Status() Status {
+	return MakeStatusOk()
+}
+
+func (a *skiplistIter) Release() {
 }
@@ -1,138 +1,91 @@
 package gdb
 
 import (
+	"encoding/binary"
 	"sync/atomic"
 	"unsafe"
 )
 
-// general interface for a skiplistNode in skip list
-type skiplistNode interface {
-	getKey() []byte
-	getNext() skiplistNode
-	getChild() skiplistNode
-	setKey(key []byte)
-	setNext(next skiplistNode)
-	setChild(child skiplistNode)
-}
-
-// The real skiplistNode in a skip list
-type skiplistLeafNode struct {
-	key   []byte
-	value []byte
-	next  *skiplistLeafNode
-}
-
-func (a *skiplistLeafNode) getKey() []byte {
-	return a.key
-}
-
-func (a *skiplistLeafNode) getNext() skiplistNode {
-	if a.next != nil {
-		return a.next
-	} else {
-		return nil
-	}
-}
-
-func (a *skiplistLeafNode) getChild() skiplistNode {
-	return nil
-}
-
-func (a *skiplistLeafNode) setKey(key []byte) {
-	a.key = key
-}
-
-func (a *skiplistLeafNode) setNext(next skiplistNode) {
-	var val *skiplistLeafNode
-	if next != nil {
-		val = next.(*skiplistLeafNode)
-	}
-	dst := (*unsafe.Pointer)(unsafe.Pointer(&a.next))
-	atomic.StorePointer(dst, unsafe.Pointer(val))
-}
-
-func (a *skiplistLeafNode) setChild(child skiplistNode) {
-	panic("should not set child on leaf node")
-}
-
-// additional links in a skip list skiplistNode is
-// represented by a skiplistPointerNode
-type skiplistPointerNode struct {
-	key   []byte
-	next  *skiplistPointerNode
-	child skiplistNode
-}
-
-func (a *skiplistPointerNode) getKey() []byte {
-	return a.key
+// A node of skip list lives in arena memory with the layout below.
+// Links are arena offsets of next nodes, 0 means the end of a level:
+//
+//	key length   : 4 bytes
+//	value length : 4 bytes
+//	height       : 4 bytes
+//	padding      : 4 bytes
+//	links        : 8 bytes for each level
+//	key
+//	value
+const kSkiplistNodeHeaderSize = 16
+
+type skiplistNode []byte
+
+// return number of bytes needed by a node
+func skiplistNodeSize(height, keyLen, valueLen int) int {
+	return kSkiplistNodeHeaderSize + 8*height + keyLen + valueLen
+}
+
+// build a node of @height levels at @offset with copies of @key and
+// @value. All links are 0
+func makeSkiplistNode(a *arena, offset uint64, height int, key, value []byte) skiplistNode {
+	size := skiplistNodeSize(height, len(key), len(value))
+	ret := skiplistNode(a.bytesAt(offset)[:size:size])
+
+	binary.BigEndian.PutUint32(ret[0:], uint32(len(key)))
+	binary.BigEndian.PutUint32(ret[4:], uint32(len(value)))
+	binary.BigEndian.PutUint32(ret[8:], uint32(height))
+
+	pos := kSkiplistNodeHeaderSize + 8*height
+	pos = pos + copy(ret[pos:], key)
+	copy(ret[pos:], value)
+	return ret
 }
 
-func (a *skiplistPointerNode) getNext() skiplistNode {
-	if a.next != nil {
-		return a.next
-	} else {
-		return nil
-	}
+// return the node at @offset
+func getSkiplistNode(a *arena, offset uint64) skiplistNode {
+	ret := skiplistNode(a.bytesAt(offset))
+	size := skiplistNodeSize(ret.height(), ret.keyLen(), ret.valueLen())
+	return ret[:size:size]
 }
 
-func (a *skiplistPointerNode) getChild() skiplistNode {
-	return a.child
+func (n skiplistNode) keyLen() int {
+	return int(binary.BigEndian.Uint32(n[0:]))
 }
 
-func (a *skiplistPointerNode) setKey(key []byte) {
-	a.key = key
+func (n skiplistNode) valueLen() int {
+	return int(binary.BigEndian.Uint32(n[4:]))
 }
 
-func (a *skiplistPointerNode) setNext(next skiplistNode) {
-	var val *skiplistPointerNode
-	if next != nil {
-		val = next.(*skiplistPointerNode)
-	}
-	dst := (*unsafe.Pointer)(unsafe.Pointer(&a.next))
-	atomic.StorePointer(dst, unsafe.Pointer(val))
+func (n skiplistNode) height() int {
+	return int(binary.BigEndian.Uint32(n[8:]))
 }
 
-func (a *skiplistPointerNode) setChild(child skiplistNode) {
-	a.child = child
+func (n skiplistNode) key() []byte {
+	start := kSkiplistNodeHeaderSize + 8*n.height()
+	return n[start : start+n.keyLen()]
 }
 
-type skiplistNodeAllocator struct {
-	leafSize    int
-	pointerSize int
-	pool        *PoolAllocator
+func (n skiplistNode) value() []byte {
+	start := kSkiplistNodeHeaderSize + 8*n.height() + n.keyLen()
+	return n[start : start+n.valueLen()]
 }
 
-// init memory pool, must be called after the allocator is created
-func makeNodeAllocator(bytesAlloc ...*PoolAllocator) *skiplistNodeAllocator {
-	x1 := skiplistLeafNode{}
-	x2 := skiplistPointerNode{}
-	ret := &skiplistNodeAllocator{}
-	ret.leafSize = int(unsafe.Sizeof(x1))
-	ret.pointerSize = int(unsafe.Sizeof(x2))
-	switch len(bytesAlloc) {
-	case 0:
-		ret.pool = MakePoolAllocator()
-	case 1:
-		ret.pool = bytesAlloc[0]
-	default:
-		panic("Can only take 0 or 1 parameter")
-	}
-	return ret
+func (n skiplistNode) link(level int) *uint64 {
+	pos := kSkiplistNodeHeaderSize + 8*level
+	return (*uint64)(unsafe.Pointer(&n[pos]))
 }
 
-// allocate a new leaf
-func (a *skiplistNodeAllocator) newLeaf() *skiplistLeafNode {
-	b := a.pool.Allocate(a.leafSize)
-	return (*skiplistLeafNode)(unsafe.Pointer(&b[0]))
+// return offset of the next node in @level
+func (n skiplistNode) getNext(level int) uint64 {
+	return atomic.LoadUint64(n.link(level))
 }
 
-// allocate a new pointer skiplistNode
-func (a *skiplistNodeAllocator) newPointer() *skiplistPointerNode {
-	b := a.pool.Allocate(a.pointerSize)
-	return (*skiplistPointerNode)(unsafe.Pointer(&b[0]))
+func (n skiplistNode) setNext(level int, next uint64) {
+	atomic.StoreUint64(n.link(level), next)
 }
 
-// deallocate all skiplistNodes
-func (a *skiplistNodeAllocator) deallocateAll() {
-	a.pool.DeallocateAll()
+// link @next after the node in @level only if its next node is
+// still @old
+func (n skiplistNode) casNext(level int, old, next uint64) bool {
+	return atomic.CompareAndSwapUint64(n.link(level), old, next)
 }
@@ -3,33 +3,43 @@ package gdb
 import "testing"
 
 func TestAllocateNode(t *testing.T) {
-	alloc := makeNodeAllocator()
-	defer alloc.deallocateAll()
+	a := makeArena(nil)
+	defer a.deallocateAll()
 
 	for i := 0; i < 1000; i++ {
-		l := alloc.newLeaf()
-		if l == nil {
-			t.Error("fails to get a new leaf skiplistNode!")
+		key := []byte("key")
+		offset := a.allocate(skiplistNodeSize(3, len(key), 5))
+		if offset == 0 {
+			t.Fatal("fails to get a new skiplistNode!")
+		}
+
+		node := makeSkiplistNode(a, offset, 3, key, []byte("value"))
+		if string(node.key()) != "key" || string(node.value()) != "value" {
+			t.Error("Wrong content in node ", i)
 		}
 	}
 }
 
 func TestTraverseLeaf(t *testing.T) {
-	alloc := makeNodeAllocator()
-	defer alloc.deallocateAll()
-
-	a := alloc.newLeaf()
-	b := alloc.newLeaf()
-	c := alloc.newLeaf()
+	a := makeArena(nil)
+	defer a.deallocateAll()
 
-	a.next = b
-	b.next = c
+	offsets := make([]uint64, 3)
+	for i := range offsets {
+		offsets[i] = a.allocate(skiplistNodeSize(1, 1, 0))
+		makeSkiplistNode(a, offsets[i], 1, []byte{byte('a' + i)}, nil)
+	}
 
-	var n skiplistNode
-	n = a
-	y := n.getNext().getNext()
+	getSkiplistNode(a, offsets[0]).setNext(0, offsets[1])
+	getSkiplistNode(a, offsets[1]).setNext(0, offsets[2])
 
-	if c != y.(*skiplistLeafNode) {
+	n := getSkiplistNode(a, offsets[0])
+	y := getSkiplistNode(a, n.getNext(0)).getNext(0)
+	if y != offsets[2] || string(getSkiplistNode(a, y).key()) != "c" {
 		t.Error("Fails to traverse as a skiplistNode")
 	}
+
+	if !n.casNext(0, offsets[1], offsets[2]) || n.casNext(0, offsets[1], 0) {
+		t.Error("Compare and swap does not check the old link")
+	}
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -254,3 +256,116 @@ func TestSkiplistScanBackwardMore(t *testing.T) {
 		t.Error("iter should not be valid at this time")
 	}
 }
+
+func makeConcurrentTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+func TestSkiplistConcurrentReaders(t *testing.T) {
+	const numElements = 20000
+	const numReaders = 8
+
+	keys := make([][]byte, numElements)
+	for i := 0; i < numElements; i++ {
+		keys[i] = makeConcurrentTestKey(i)
+	}
+
+	slist := MakeSkiplist()
+	var wg sync.WaitGroup
+	var done int32
+
+	for r := 0; r < numReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&done) == 0 {
+				// a scan always sees sorted keys, each with its value
+				iter := slist.NewIterator(nil)
+				var prev []byte
+				for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+					if prev != nil && bytes.Compare(prev, iter.Key()) >= 0 {
+						t.Error("Keys out of order ", string(prev), " ", string(iter.Key()))
+						return
+					}
+					if bytes.Compare(iter.Key(), iter.Value()) != 0 {
+						t.Error("Wrong value for key ", string(iter.Key()))
+						return
+					}
+					prev = iter.Key()
+				}
+
+				key := keys[rand.Intn(numElements)]
+				if val, ok := slist.Get(key); ok && bytes.Compare(key, val) != 0 {
+					t.Error("Wrong value for key ", string(key))
+					return
+				}
+			}
+		}()
+	}
+
+	// insert in random order from a single writer
+	for _, i := range rand.Perm(numElements) {
+		slist.Put(keys[i], keys[i])
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+
+	for _, key := range keys {
+		val, ok := slist.Get(key)
+		if !ok || bytes.Compare(key, val) != 0 {
+			t.Fatal("Fails to find key ", string(key))
+		}
+	}
+}
+
+func TestSkiplistConcurrentWriters(t *testing.T) {
+	const numElements = 20000
+	const numWriters = 8
+
+	keys := make([][]byte, numElements)
+	for i := 0; i < numElements; i++ {
+		keys[i] = makeConcurrentTestKey(i)
+	}
+
+	slist := MakeSkiplist()
+	var wg sync.WaitGroup
+	var inserted int64
+
+	// every writer tries all keys in its own order, each key is
+	// inserted exactly once
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, i := range rand.Perm(numElements) {
+				if _, ok := slist.PutConcurrently(keys[i], keys[i]); ok {
+					atomic.AddInt64(&inserted, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if inserted != numElements {
+		t.Error("Expect ", numElements, " inserts, got ", inserted)
+	}
+
+	iter := slist.NewIterator(nil)
+	i := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if i >= numElements || bytes.Compare(iter.Key(), keys[i]) != 0 {
+			t.Fatal("Unexpected key ", string(iter.Key()), " at ", i)
+		}
+		i++
+	}
+	if i != numElements {
+		t.Error("Expect ", numElements, " keys, got ", i)
+	}
+
+	for i = numElements - 1; i >= 0; i-- {
+		val, ok := slist.Get(keys[i])
+		if !ok || bytes.Compare(keys[i], val) != 0 {
+			t.Fatal("Fails to find key ", string(keys[i]))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package gdb
+
+// A snapshot pins a sequence number. Reads through a snapshot only
+// see updates whose sequence numbers are not greater than it
+type snapshotImpl struct {
+	sequence uint64
+	prev     *snapshotImpl
+	next     *snapshotImpl
+}
+
+func (s *snapshotImpl) Sequence() uint64 {
+	return s.sequence
+}
+
+// A circular double linked list of live snapshots. Snapshots are
+// created with increasing sequence numbers, so the list is sorted
+type snapshotList struct {
+	head snapshotImpl
+}
+
+func makeSnapshotList() *snapshotList {
+	ret := &snapshotList{}
+	ret.head.prev, ret.head.next = &ret.head, &ret.head
+	return ret
+}
+
+func (l *snapshotList) Empty() bool {
+	return l.head.next == &l.head
+}
+
+// return the snapshot with smallest sequence number. The list
+// must not be empty
+func (l *snapshotList) Oldest() *snapshotImpl {
+	if l.Empty() {
+		panic("no snapshot in the list")
+	}
+	return l.head.next
+}
+
+// create a snapshot at @seq and append it to the list
+func (l *snapshotList) New(seq uint64) *snapshotImpl {
+	s := &snapshotImpl{}
+	s.sequence = seq
+	s.next = &l.head
+	s.prev = l.head.prev
+	s.prev.next = s
+	s.next.prev = s
+	return s
+}
+
+// remove a snapshot from the list. Removing it again does nothing
+func (l *snapshotList) Delete(s *snapshotImpl) {
+	if s.prev == nil {
+		return
+	}
+
+	s.prev.next = s.next
+	s.next.prev = s.prev
+	s.prev, s.next = nil, nil
+}
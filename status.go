@@ -12,6 +12,11 @@ func MakeStatusNotFound(msg string) Status {
 	return StatusNotFound{msg: msg}
 }
 
+// Return a status that returns StatusDeleted
+func MakeStatusDeleted(msg string) Status {
+	return StatusDeleted{StatusNotFound{msg: msg}}
+}
+
 // Return a status that returns StatusCorruption
 func MakeStatusCorruption(msg string) Status {
 	return StatusCorruption{msg: msg}
@@ -22,6 +27,11 @@ func MakeStatusIoError(msg string) Status {
 	return StatusIoError{msg: msg}
 }
 
+// Return a status that returns StatusInvalidArgument
+func MakeStatusInvalidArgument(msg string) Status {
+	return StatusInvalidArgument{msg: msg}
+}
+
 // This structure is the base for all other status structs
 type AllNegativeStatus struct {
 }
@@ -34,6 +44,10 @@ func (a AllNegativeStatus) IsNotFound() bool {
 	return false
 }
 
+func (a AllNegativeStatus) IsDeleted() bool {
+	return false
+}
+
 func (a AllNegativeStatus) IsCorruption() bool {
 	return false
 }
@@ -42,6 +56,10 @@ func (a AllNegativeStatus) IsIoError() bool {
 	return false
 }
 
+func (a AllNegativeStatus) IsInvalidArgument() bool {
+	return false
+}
+
 func (a AllNegativeStatus) ToString() string {
 	return ""
 }
@@ -69,6 +87,17 @@ func (a StatusNotFound) ToString() string {
 	return a.msg
 }
 
+// implement Deleted status. A deleted key is not found either, the
+// status tells that a deletion of the key is found, so that older data
+// does not need to be searched
+type StatusDeleted struct {
+	StatusNotFound
+}
+
+func (a StatusDeleted) IsDeleted() bool {
+	return true
+}
+
 // implement Corruption status
 type StatusCorruption struct {
 	AllNegativeStatus
@@ -96,3 +125,17 @@ func (a StatusIoError) IsIoError() bool {
 func (a StatusIoError) ToString() string {
 	return a.msg
 }
+
+// implement InvalidArgument status
+type StatusInvalidArgument struct {
+	AllNegativeStatus
+	msg string
+}
+
+func (a StatusInvalidArgument) IsInvalidArgument() bool {
+	return true
+}
+
+func (a StatusInvalidArgument) ToString() string {
+	return a.msg
+}
@@ -1,7 +1,9 @@
 package gdb
 
 import (
-	"unsafe"
+	"fmt"
+	"math"
+	"sort"
 )
 
 // Table uses differential encoding for keys. A table has two types
@@ -9,19 +11,125 @@ import (
 // The key of index blocks are full keys, while the keys of leaf
 // blocks are partial keys (differential encoded in regard of previous
 // keys) The value field of an entry in index block is an offset to
-// corresponding entries in leaf block
+// corresponding entries in leaf block. A table file is laid out as:
+//
+//	leaf blocks
+//	filter block, optional, a filter for each leaf block
+//	metaindex block, maps names of meta blocks to their handles
+//	index block
+//	footer, fixed size
+//
+// The footer locates the other blocks by (offset, size) handles, and
+// ends with a magic number that tells a gdb table from other files
 
 const (
-	// how frequent a full key should appear in leaf block
-	kEntriesPerFullKey = 8
-	// Suppose each table has !MB data and each entry is 100 bytes,
-	// a table will have 10K entries and we will have 20 entries
-	// in index block
-	kNumLeafEntriesPerIndexEntry = 512
 	// how big a table should be, default to 1MB
 	kTableSizeHint = 1024 * 1024
+	// handles of metaindex, index and filter blocks, format version,
+	// checksum type and magic number
+	kTableFooterSize = 3*16 + 4 + 4 + 8
+	// "gdbtable" in ASCII
+	kTableMagicNumber = 0x6764627461626c65
+	// format version of tables written by this code. Tables of newer
+	// versions are rejected. Blocks of version 1 tables have no trailer.
+	// Tables before version 3 are in native byte order of the machine
+	// writing them, tables of version 3 are in little endian
+	kTableFormatVersion = 3
 )
 
+// location of a block in a table file, including its trailer
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (h blockHandle) encodeTo(scratch []byte) []byte {
+	scratch = EncodeUint64(scratch, h.offset)
+	return EncodeUint64(scratch, h.size)
+}
+
+func decodeBlockHandle(d decoder, data []byte) (h blockHandle, rest []byte) {
+	h.offset, rest = d.uint64(data)
+	h.size, rest = d.uint64(rest)
+	return
+}
+
+// the fixed size footer at the end of a table file. A table without
+// filter block has an empty filter handle
+type tableFooter struct {
+	metaindex blockHandle
+	index     blockHandle
+	filter    blockHandle
+	version   uint32
+	checksum  ChecksumType
+	// the table is in big endian byte order of an old release
+	native bool
+}
+
+func (f *tableFooter) encodeTo(scratch []byte) []byte {
+	scratch = f.metaindex.encodeTo(scratch)
+	scratch = f.index.encodeTo(scratch)
+	scratch = f.filter.encodeTo(scratch)
+	scratch = EncodeUint32(scratch, f.version)
+	scratch = EncodeUint32(scratch, uint32(f.checksum))
+	return EncodeUint64(scratch, kTableMagicNumber)
+}
+
+// decode the footer of a table file of @fileSize bytes, and make sure
+// all handles fall in the file
+func decodeTableFooter(data []byte, fileSize uint64) (*tableFooter, Status) {
+	if len(data) != kTableFooterSize {
+		return nil, MakeStatusCorruption("file is too short to be a table")
+	}
+
+	// the magic number tells byte order of the table, a table written
+	// by an old release on a big endian machine can only be read there
+	ret := &tableFooter{}
+	d := littleEndian
+	if magic, _ := d.uint64(data[kTableFooterSize-8:]); magic != kTableMagicNumber {
+		d = nativeEndian
+		if magic, _ := d.uint64(data[kTableFooterSize-8:]); magic != kTableMagicNumber {
+			return nil, MakeStatusCorruption("not a gdb table (bad magic number)")
+		}
+		ret.native = true
+	}
+
+	rest := data
+	ret.metaindex, rest = decodeBlockHandle(d, rest)
+	ret.index, rest = decodeBlockHandle(d, rest)
+	ret.filter, rest = decodeBlockHandle(d, rest)
+	var checksum uint32
+	ret.version, rest = d.uint32(rest)
+	checksum, _ = d.uint32(rest)
+	ret.checksum = ChecksumType(checksum)
+
+	switch {
+	case ret.native && ret.version >= 3:
+		return nil, MakeStatusCorruption("table is not in little endian byte order")
+	case ret.version == 0:
+		return nil, MakeStatusCorruption("bad table format version 0")
+	case ret.version > kTableFormatVersion:
+		return nil, MakeStatusCorruption(fmt.Sprintf(
+			"table format version %d is newer than supported version %d",
+			ret.version, kTableFormatVersion))
+	case ret.checksum != CRC32CChecksum && ret.checksum != XXHashChecksum:
+		return nil, MakeStatusCorruption(fmt.Sprintf("unknown checksum type %d", checksum))
+	}
+
+	// blocks are addressed by 32 bit offsets within a table
+	limit := fileSize - kTableFooterSize
+	if limit > math.MaxUint32 {
+		return nil, MakeStatusCorruption("table is too large")
+	}
+	for _, h := range []blockHandle{ret.metaindex, ret.index, ret.filter} {
+		if h.offset > limit || h.size > limit-h.offset {
+			return nil, MakeStatusCorruption("bad block handle in table footer")
+		}
+	}
+
+	return ret, MakeStatusOk()
+}
+
 // Differentiate encoding: given previous and current key,
 // generate differentiate bytes for current key
 func EncodeDifferentialKey(prev, current []byte) []byte {
@@ -46,7 +154,7 @@ func EncodeDifferentialKey(prev, current []byte) []byte {
 	}
 
 	ret := make([]byte, len(current)-common+1)
-	*(*uint8)(unsafe.Pointer(&ret[0])) = uint8(common)
+	ret[0] = uint8(common)
 	copy(ret[1:], current[common:])
 
 	return ret
@@ -55,14 +163,28 @@ func EncodeDifferentialKey(prev, current []byte) []byte {
 // Differential decoding: given previous full code and a differential
 // coded key, restore corresponding full key
 func DecodeDifferentialKey(prev, current []byte) []byte {
-	common := *(*uint8)(unsafe.Pointer(&current[0]))
+	ret, ok := decodeDifferentialKey(prev, current)
+	if !ok {
+		panic("corrupted data")
+	}
+	return ret
+}
+
+// same as DecodeDifferentialKey, return false if @current cannot be
+// decoded against @prev
+func decodeDifferentialKey(prev, current []byte) ([]byte, bool) {
+	if len(current) == 0 || int(current[0]) > len(prev) {
+		return nil, false
+	}
+
+	common := current[0]
 	ret := make([]byte, int(common)+len(current)-1)
 	if common > 0 {
 		copy(ret, prev[:common])
 	}
 
 	copy(ret[common:], current[1:])
-	return ret
+	return ret, true
 }
 
 // leaf blocks use differential encoded key. This iterator is used
@@ -81,6 +203,14 @@ func (it *DifferentialDecodingIter) Value() []byte {
 	return it.blockIter.Value()
 }
 
+func (it *DifferentialDecodingIter) Status() Status {
+	return it.blockIter.Status()
+}
+
+func (it *DifferentialDecodingIter) Release() {
+	it.blockIter.Release()
+}
+
 func (it *DifferentialDecodingIter) SeekToFirst() {
 	it.blockIter.SeekToFirst()
 	it.prevKey = nil
@@ -91,8 +221,21 @@ func (it *DifferentialDecodingIter) SeekToLast() {
 	it.prevKey = nil
 }
 
+// Keys in a leaf block are differentially encoded, so the raw block
+// iterator cannot compare them. Binary search among all entries, each
+// probe decodes its key from the nearest full key before it
 func (it *DifferentialDecodingIter) Seek(key []byte) {
-	it.blockIter.Seek(key)
+	raw := it.blockIter.(*blockIter)
+	numKeys := int(raw.block.numKeys)
+
+	// find the first entry that is not less than @key
+	n := sort.Search(numKeys, func(n int) bool {
+		raw.idx = int32(n)
+		it.prevKey = nil
+		return raw.order.Compare(it.Key(), key) >= 0
+	})
+
+	raw.idx = int32(n)
 	it.prevKey = nil
 }
 
@@ -106,44 +249,52 @@ func (it *DifferentialDecodingIter) Prev() {
 	it.prevKey = nil
 }
 
+// Keys that cannot be decoded turn the iterator invalid with a
+// corruption status, and nil is returned
 func (it *DifferentialDecodingIter) Key() []byte {
-	for true {
-		if it.prevKey != nil {
-			return DecodeDifferentialKey(it.prevKey, it.blockIter.Key())
-		} else {
-			// previous key is not available, search backward for it
-			var curKey []byte
-			backoff := 0
-			for true {
-				curKey = it.blockIter.Key()
-				if *(*uint8)(unsafe.Pointer(&curKey[0])) == uint8(0) {
-					break
-				} else {
-					backoff = backoff + 1
-					it.Prev()
-					if !it.Valid() {
-						panic("reach the beginning before a full key")
-					}
-				}
-			}
-
-			// derive latter keys from the nearest full key
-			for ; backoff > 1; backoff-- {
-				it.Next()
-				curKey = DecodeDifferentialKey(curKey, it.blockIter.Key())
-			}
-
-			it.prevKey = curKey
+	raw := it.blockIter.(*blockIter)
+	if it.prevKey != nil {
+		key, ok := decodeDifferentialKey(it.prevKey, raw.Key())
+		if !ok {
+			raw.corrupt("bad key in leaf block")
+		}
+		return key
+	}
 
-			// restore raw iterator to original position
-			if backoff > 0 {
-				it.Next()
-			}
+	// previous key is not available, derive current key from the
+	// nearest full key before it. A full key shares nothing with the
+	// previous key
+	target := raw.idx
+	defer func() { raw.idx = target }()
+
+	for {
+		current := raw.Key()
+		if len(current) == 0 {
+			raw.corrupt("bad key in leaf block")
+			return nil
+		}
+		if current[0] == 0 {
+			break
+		}
+		if raw.idx == 0 {
+			raw.corrupt("leaf block does not start with a full key")
+			return nil
 		}
+		raw.idx--
 	}
 
-	panic("should not reach here")
-	return nil
+	var key []byte
+	for ; ; raw.idx++ {
+		var ok bool
+		key, ok = decodeDifferentialKey(key, raw.Key())
+		if !ok {
+			raw.corrupt("bad key in leaf block")
+			return nil
+		}
+		if raw.idx == target {
+			return key
+		}
+	}
 }
 
 type TableBuilder struct {
@@ -158,6 +309,19 @@ type TableBuilder struct {
 	file         WritableFile
 	leafBuilder  *BlockBuilder
 	indexBuilder *BlockBuilder
+	// a leaf block is finished once it holds this many bytes
+	blockSize uint32
+	// how frequent a full key should appear in leaf block
+	restartInterval uint32
+	// builds a filter for each leaf block if not nil
+	filter        *filterBlockBuilder
+	filterSize    uint32
+	metaindexSize uint32
+	// checksum of block trailers
+	checksum ChecksumType
+	// only leaf blocks are compressed, other blocks are small or do
+	// not compress well
+	compressor blockCompressor
 }
 
 // Provide a byte slice to hold leaf blocks, a byte slice to hold
@@ -173,6 +337,10 @@ func MakeTableBuilder(data1, data2 []byte, f WritableFile) *TableBuilder {
 	ret.leafBuilder = MakeBlockBuilder(data1)
 	ret.indexBuilder = MakeBlockBuilder(data2)
 
+	ret.blockSize = kDefaultBlockSize
+	ret.restartInterval = kDefaultBlockRestartInterval
+	ret.compressor.maxRatio = kDefaultMaxCompressionRatio
+
 	return ret
 }
 
@@ -180,11 +348,11 @@ func MakeTableBuilder(data1, data2 []byte, f WritableFile) *TableBuilder {
 func (a *TableBuilder) Add(key, value []byte) {
 	a.numEntries++
 	for true {
-		if a.leafNumber < kNumLeafEntriesPerIndexEntry {
+		if a.leafBuilder.cur < a.blockSize {
 			if a.firstKey == nil {
 				a.firstKey = key
 			}
-			residual := a.leafNumber % kEntriesPerFullKey
+			residual := a.leafNumber % a.restartInterval
 			var newKey []byte
 			if residual != 0 {
 				newKey = EncodeDifferentialKey(a.prevKey, key)
@@ -193,88 +361,421 @@ func (a *TableBuilder) Add(key, value []byte) {
 				copy(newKey[1:], key)
 			}
 			a.leafBuilder.Add(newKey, value)
+			if a.filter != nil {
+				a.filter.addKey(key)
+			}
 			a.prevKey = key
 			a.leafNumber = a.leafNumber + 1
 			break
 		} else {
-			b, ok := a.leafBuilder.Finalize()
-			if !ok {
-				panic("leaf builder fails to finalize")
-			}
-			off := uint32(len(b.data))
-			a.leafPos = a.leafPos + off
-			indexValue := make([]byte, 4)
-			*(*uint32)(unsafe.Pointer(&indexValue[0])) = off
-			a.indexBuilder.Add(key, indexValue)
+			a.finishLeaf()
 			a.leafNumber = 0
 		}
 	}
 }
 
-func (a *TableBuilder) Finalize(c Comparator) *Table {
+// finish current leaf block and add its index entry
+func (a *TableBuilder) finishLeaf() {
 	b, ok := a.leafBuilder.Finalize()
 	if !ok {
 		panic("leaf builder fails to finalize")
 	}
-	off := uint32(len(b.data))
-	a.leafPos = a.leafPos + off
-	indexValue := make([]byte, 4)
-	*(*uint32)(unsafe.Pointer(&indexValue[0])) = off
-	a.indexBuilder.Add(a.prevKey, indexValue)
 
-	b, ok = a.indexBuilder.Finalize()
+	// a compressed block takes the place of the raw one
+	data, blockType := a.compressor.compress(b.data)
+	a.leafBuilder.data = a.leafData[a.leafPos:]
+	if !a.leafBuilder.appendRaw(data) ||
+		!a.leafBuilder.appendRaw(makeBlockTrailer(a.checksum, data, blockType)) {
+		panic("no room for leaf block trailer")
+	}
+	if a.filter != nil {
+		a.filter.finishBlock()
+	}
+
+	// index entry is keyed by the last key of the leaf block,
+	// and points to the end of the trailer of the leaf block
+	a.leafPos = a.leafPos + uint32(len(data)) + kBlockTrailerSize
+	a.indexBuilder.Add(a.prevKey, EncodeUint32(nil, a.leafPos))
+}
+
+// Write the table into the file, return a table that reads the built
+// blocks from memory. A write error is returned as it is, the caller
+// should delete the partial file
+func (a *TableBuilder) Finalize(c Comparator) (*Table, Status) {
+	a.finishLeaf()
+
+	b, ok := a.indexBuilder.Finalize()
 	if !ok {
 		panic("index builder fails to finalize")
 	}
-	a.indexSize = uint32(len(b.data))
+	if !a.indexBuilder.appendRaw(makeBlockTrailer(a.checksum, b.data, byte(NoCompression))) {
+		panic("no room for index block trailer")
+	}
+	a.indexSize = uint32(len(b.data)) + kBlockTrailerSize
 
 	// format of a table file: first part is many leaf blocks
 	status := a.file.Append(a.leafData[:a.leafPos])
 	if !status.Ok() {
-		panic("fails to write to table file")
+		return nil, status
+	}
+
+	// second part of table file: an optional filter block
+	footer := tableFooter{version: kTableFormatVersion, checksum: a.checksum}
+	var filter *filterBlockReader
+	var metaName string
+	if a.filter != nil {
+		data := a.filter.finish()
+		status = a.file.Append(data)
+		if status.Ok() {
+			status = a.file.Append(makeBlockTrailer(a.checksum, data, byte(NoCompression)))
+		}
+		if !status.Ok() {
+			return nil, status
+		}
+		a.filterSize = uint32(len(data)) + kBlockTrailerSize
+		footer.filter = blockHandle{uint64(a.leafPos), uint64(a.filterSize)}
+		filter = makeFilterBlockReader(a.filter.policy, data)
+		metaName = "filter." + a.filter.policy.Name()
+	}
+
+	// third part of table file: a metaindex block
+	metaBuilder := MakeBlockBuilder(make([]byte, len(metaName)+128))
+	if a.filter != nil {
+		metaBuilder.Add([]byte(metaName), footer.filter.encodeTo(nil))
+	}
+	meta, ok := metaBuilder.Finalize()
+	if !ok {
+		panic("metaindex builder fails to finalize")
+	}
+	a.metaindexSize = uint32(len(meta.data)) + kBlockTrailerSize
+	footer.metaindex = blockHandle{uint64(a.leafPos + a.filterSize), uint64(a.metaindexSize)}
+	status = a.file.Append(meta.data)
+	if status.Ok() {
+		status = a.file.Append(makeBlockTrailer(a.checksum, meta.data, byte(NoCompression)))
+	}
+	if !status.Ok() {
+		return nil, status
 	}
 
-	// second part of table file: a final index block
+	// fourth part of table file: a final index block
+	footer.index = blockHandle{footer.metaindex.offset + footer.metaindex.size, uint64(a.indexSize)}
 	status = a.file.Append(a.indexData[:a.indexSize])
 	if !status.Ok() {
-		panic("fails to write to table file")
+		return nil, status
 	}
 
-	ret := &Table{b, a.leafData, c}
-	return ret
+	// last part of table file: a fixed size footer to locate other
+	// blocks
+	status = a.file.Append(footer.encodeTo(nil))
+	if !status.Ok() {
+		return nil, status
+	}
+
+	ret := &Table{}
+	ret.index = b
+	ret.data = a.leafData
+	ret.comparator = c
+	ret.filter = filter
+	ret.trailerSize = kBlockTrailerSize
+	ret.checksum = a.checksum
+	return ret, MakeStatusOk()
+}
+
+// Return size of the table file, valid after Finalize
+func (a *TableBuilder) FileSize() uint64 {
+	return uint64(a.leafPos+a.filterSize+a.metaindexSize+a.indexSize) + kTableFooterSize
 }
 
 type Table struct {
-	index      *Block
-	leafData   []byte
+	index *Block
+	// leaf blocks are read from @file on demand, unless the table is
+	// built in memory and @data holds them
+	file       RandomAccessFile
+	data       []byte
 	comparator Comparator
+	// nil if the table has no filter block
+	filter *filterBlockReader
+	// if not nil, leaf blocks are cached in it, keyed by @number
+	cache  *BlockCache
+	number uint64
+	// format version in the footer
+	version uint32
+	// size of block trailers, zero for tables of format version 1
+	trailerSize uint32
+	checksum    ChecksumType
+	// blocks are in big endian byte order of an old release
+	native bool
+	// verify checksums of all blocks read
+	paranoid bool
 }
 
-// read table from disk file. Pass in a buffer that is the same
-// size as the file size
-func RecoverTable(file SequentialFile, buffer []byte, c Comparator) *Table {
-	used, status := file.Read(buffer)
-	if !status.Ok() || len(used) != len(buffer) {
-		return nil
+// Open a table of @size bytes in @file. Only the footer, the index
+// block and the filter block are read, leaf blocks are read when they
+// are needed. If @policy is not nil, filters built by it are used to
+// skip leaf blocks. The table owns @file from now on. A file that is
+// not a table, or a table of a newer format, is a corruption. Checksums
+// of blocks read here are always verified
+func OpenTable(file RandomAccessFile, size uint64, c Comparator, policy FilterPolicy) (*Table, Status) {
+	if size < kTableFooterSize {
+		return nil, MakeStatusCorruption("file is too short to be a table")
 	}
 
-	pos := len(used)
-	ret := &Table{}
+	data, s := file.Read(int64(size-kTableFooterSize), make([]byte, kTableFooterSize))
+	if !s.Ok() {
+		return nil, s
+	}
 
+	footer, s := decodeTableFooter(data, size)
+	if !s.Ok() {
+		return nil, s
+	}
+
+	ret := &Table{}
+	ret.file = file
 	ret.comparator = c
-	ret.leafData = used
-	ret.index = DecodeBlock(used, uint32(pos))
+	ret.checksum = footer.checksum
+	ret.native = footer.native
+	ret.version = footer.version
+	if footer.version > 1 {
+		ret.trailerSize = kBlockTrailerSize
+	}
+	ret.index, s = ret.readBlock(uint32(footer.index.offset), uint32(footer.index.size), true)
+	if !s.Ok() {
+		return nil, s
+	}
 
-	return ret
+	// leaf blocks come before all other blocks
+	if uint64(ret.leafEnd()) > footer.index.offset {
+		return nil, MakeStatusCorruption("bad index block")
+	}
+
+	// filters of big endian tables are not understood, they are left
+	// out until the table is converted
+	if policy != nil && footer.filter.size > 0 && !ret.native {
+		data, s := ret.readRaw(uint32(footer.filter.offset), uint32(footer.filter.size), true)
+		if !s.Ok() {
+			return nil, s
+		}
+		ret.filter = makeFilterBlockReader(policy, data)
+	}
+
+	return ret, MakeStatusOk()
+}
+
+// Close the table file. Nothing can be read from the table afterwards
+func (t *Table) Close() {
+	if t.file != nil {
+		t.file.Close()
+	}
 }
 
-func (t *Table) NewIterator() Iterator {
+// read @size bytes at @offset of the table file, which hold a block
+// and its trailer. Return content of the block, decompressed if
+// needed. Its checksum is verified if @verify is set
+func (t *Table) readRaw(offset, size uint32, verify bool) ([]byte, Status) {
+	var data []byte
+	if t.data != nil {
+		data = t.data[offset : offset+size]
+	} else {
+		var s Status
+		data, s = t.file.Read(int64(offset), make([]byte, size))
+		if !s.Ok() {
+			return nil, s
+		}
+	}
+
+	if len(data) != int(size) {
+		return nil, MakeStatusCorruption("truncated block")
+	}
+	if t.trailerSize == 0 {
+		return data, MakeStatusOk()
+	}
+
+	data, blockType, s := checkBlockTrailer(t.checksum, data, verify || t.paranoid, t.decoder())
+	if !s.Ok() {
+		return nil, s
+	}
+	return decompressBlock(blockType, data)
+}
+
+// return decoder of integers in blocks of the table
+func (t *Table) decoder() decoder {
+	if t.native {
+		return nativeEndian
+	}
+	return littleEndian
+}
+
+// read a block at @offset of the table file, @size includes its trailer
+func (t *Table) readBlock(offset, size uint32, verify bool) (*Block, Status) {
+	data, s := t.readRaw(offset, size, verify)
+	if !s.Ok() {
+		return nil, s
+	}
+
+	// a block handle covers exactly one block
+	ret := decodeBlock(t.decoder(), data, uint32(len(data)))
+	if ret == nil || len(ret.data) != len(data) {
+		return nil, MakeStatusCorruption("bad block")
+	}
+	return ret, MakeStatusOk()
+}
+
+// return end offset of the leaf block that entry @idx of the index
+// block points to
+func (t *Table) leafBlockEnd(idx int32) uint32 {
+	iter := t.index.NewIterator(t.comparator).(*blockIter)
+	iter.idx = idx
+	end, _ := t.index.decoder().uint32(iter.Value())
+	return end
+}
+
+// return end offset of all leaf blocks
+func (t *Table) leafEnd() uint32 {
+	if t.index.numKeys == 0 {
+		return 0
+	}
+	return t.leafBlockEnd(int32(t.index.numKeys) - 1)
+}
+
+// read the leaf block that entry @idx of the index block points to. A
+// leaf block starts where the previous one ends. If the block comes
+// from block cache, it is pinned by the returned handle, which must be
+// released
+func (t *Table) readLeaf(idx int32, opt *ReadOptions) (*Block, *LruEntry, Status) {
+	start := uint32(0)
+	if idx > 0 {
+		start = t.leafBlockEnd(idx - 1)
+	}
+
+	end := t.leafBlockEnd(idx)
+	if end < start {
+		return nil, nil, MakeStatusCorruption("bad index block")
+	}
+
+	if t.cache == nil {
+		block, s := t.readBlock(start, end-start, opt.VerifyChecksums)
+		return block, nil, s
+	}
+
+	key := blockCacheKey(t.number, uint64(start))
+	if h := t.cache.Lookup(key); h != nil {
+		return h.Value().(*Block), h, MakeStatusOk()
+	}
+
+	block, s := t.readBlock(start, end-start, opt.VerifyChecksums)
+	if !s.Ok() || opt.DontFillCache {
+		return block, nil, s
+	}
+
+	h := t.cache.Insert(key, block, len(block.data))
+	return block, h, MakeStatusOk()
+}
+
+// Look up @key in the table, reading at most one leaf block. For a
+// table of internal keys, @key is a lookup key, and the newest entry of
+// its user key not newer than it is returned. A deletion is reported by
+// a deleted status. For other tables, only an exact match is returned
+func (t *Table) Get(key []byte, opt ReadOptions) ([]byte, Status) {
+	index := t.index.NewIterator(t.comparator).(*blockIter)
+	index.Seek(key)
+	if !index.Valid() {
+		// greater than all keys in the table
+		return nil, MakeStatusNotFound("")
+	}
+
+	if t.filter != nil && !t.filter.keyMayMatch(int(index.idx), key) {
+		return nil, MakeStatusNotFound("")
+	}
+
+	leaf, h, s := t.readLeaf(index.idx, &opt)
+	if !s.Ok() {
+		return nil, s
+	}
+	if h != nil {
+		// values are not changed after the block is unpinned
+		defer t.cache.Release(h)
+	}
+
+	iter := &DifferentialDecodingIter{leaf.NewIterator(t.comparator), nil}
+	iter.Seek(key)
+	if !iter.Valid() {
+		// a corrupted block stops the search early
+		if s := iter.Status(); !s.Ok() {
+			return nil, s
+		}
+		return nil, MakeStatusNotFound("")
+	}
+
+	found, value := iter.Key(), iter.Value()
+	if s := iter.Status(); !s.Ok() {
+		return nil, s
+	}
+
+	internal, ok := t.comparator.(*InternalKeyComparator)
+	if !ok {
+		if t.comparator.Compare(found, key) != 0 {
+			return nil, MakeStatusNotFound("")
+		}
+		return value, MakeStatusOk()
+	}
+
+	parsed, ok := ParseInternalKey(found)
+	switch {
+	case !ok:
+		return nil, MakeStatusCorruption("bad internal key")
+	case internal.user.Compare(parsed.userKey, extractUserKey(key)) != 0:
+		return nil, MakeStatusNotFound("")
+	case parsed.valueType == kTypeDeletion:
+		return nil, MakeStatusDeleted("")
+	}
+
+	return value, MakeStatusOk()
+}
+
+// Return an iterator over the table. A nil @opt means default read
+// options
+func (t *Table) NewIterator(opt *ReadOptions) Iterator {
 	ret := &TableIter{}
 	ret.table = t
 	ret.indexIter = t.index.NewIterator(t.comparator)
+	ret.status = MakeStatusOk()
+	if opt != nil {
+		ret.opt = *opt
+	} else {
+		ret.opt = MakeReadOptions()
+	}
+
+	// the last block read by the iterator stays pinned until the
+	// iterator is released
 	return ret
 }
 
+// Return the approximate offset in the table file where the data
+// for @key begins, that is the start of the leaf block that would
+// hold @key. Keys past the last block map to the end of leaf blocks
+func (t *Table) ApproximateOffsetOf(key []byte) uint64 {
+	iter := t.index.NewIterator(t.comparator)
+	iter.Seek(key)
+	if !iter.Valid() {
+		iter.SeekToLast()
+		if !iter.Valid() {
+			return 0
+		}
+		end, _ := t.index.decoder().uint32(iter.Value())
+		return uint64(end)
+	}
+
+	// a leaf block starts where the previous one ends
+	iter.Prev()
+	if !iter.Valid() {
+		return 0
+	}
+
+	end, _ := t.index.decoder().uint32(iter.Value())
+	return uint64(end)
+}
+
 // This iterator composite an index block iterator and leaf block
 // iterators
 type TableIter struct {
@@ -283,63 +784,89 @@ type TableIter struct {
 	indexIter Iterator
 	leafIter  *DifferentialDecodingIter
 	valid     bool
+	opt       ReadOptions
+	// pins @leafBlock in block cache if not nil
+	handle *LruEntry
+	// the first error met, the iterator turns invalid on errors
+	status Status
 }
 
 func (it *TableIter) Valid() bool {
-	return it.valid
+	// a key or value that fails to decode turns the leaf iterator
+	// invalid
+	return it.valid && it.leafIter.Valid()
+}
+
+// read the leaf block that the index iterator points to, return false
+// if the block cannot be read. The error is kept in @status
+func (it *TableIter) loadLeaf() bool {
+	it.releaseLeaf()
+
+	idx := it.indexIter.(*blockIter).idx
+	block, h, s := it.table.readLeaf(idx, &it.opt)
+	if !s.Ok() {
+		it.setStatus(s)
+		return false
+	}
+
+	it.leafBlock = block
+	it.handle = h
+	rawIter := block.NewIterator(it.table.comparator)
+	it.leafIter = &DifferentialDecodingIter{rawIter, nil}
+	return true
+}
+
+// return true if the leaf iterator is at an entry. A corrupted leaf
+// block is an error rather than the end of the block
+func (it *TableIter) leafValid() bool {
+	if it.leafIter.Valid() {
+		return true
+	}
+	if s := it.leafIter.Status(); !s.Ok() {
+		it.setStatus(s)
+	}
+	return false
+}
+
+// keep the first error
+func (it *TableIter) setStatus(s Status) {
+	if it.status.Ok() {
+		it.status = s
+	}
+}
+
+// unpin the current leaf block in block cache
+func (it *TableIter) releaseLeaf() {
+	if it.handle != nil {
+		it.table.cache.Release(it.handle)
+		it.handle = nil
+	}
 }
 
 func (it *TableIter) SeekToFirst() {
 	it.valid = false
 	it.indexIter.SeekToFirst()
-	if it.indexIter.Valid() {
-		val := it.indexIter.Value()
-		lastOff := *(*uint32)(unsafe.Pointer(&val[0]))
-		it.leafBlock = DecodeBlock(it.table.leafData, lastOff)
-		if it.leafBlock != nil {
-			rawIt := it.leafBlock.NewIterator(it.table.comparator)
-			it.leafIter = &DifferentialDecodingIter{rawIt, nil}
-			it.leafIter.SeekToFirst()
-			if it.leafIter.Valid() {
-				it.valid = true
-			}
-		}
+	if it.indexIter.Valid() && it.loadLeaf() {
+		it.leafIter.SeekToFirst()
+		it.valid = it.leafValid()
 	}
 }
 
 func (it *TableIter) SeekToLast() {
 	it.valid = false
 	it.indexIter.SeekToLast()
-	if it.indexIter.Valid() {
-		val := it.indexIter.Value()
-		lastOff := *(*uint32)(unsafe.Pointer(&val[0]))
-		it.leafBlock = DecodeBlock(it.table.leafData, lastOff)
-		if it.leafBlock != nil {
-			rawIter := it.leafBlock.NewIterator(it.table.comparator)
-			it.leafIter = &DifferentialDecodingIter{rawIter, nil}
-			it.leafIter.SeekToLast()
-			if it.leafIter.Valid() {
-				it.valid = true
-			}
-		}
+	if it.indexIter.Valid() && it.loadLeaf() {
+		it.leafIter.SeekToLast()
+		it.valid = it.leafValid()
 	}
 }
 
 func (it *TableIter) Seek(key []byte) {
 	it.valid = false
 	it.indexIter.Seek(key)
-	if it.indexIter.Valid() {
-		val := it.indexIter.Value()
-		lastOff := *(*uint32)(unsafe.Pointer(&val[0]))
-		it.leafBlock = DecodeBlock(it.table.leafData, lastOff)
-		if it.leafBlock != nil {
-			rawIt := it.leafBlock.NewIterator(it.table.comparator)
-			it.leafIter = &DifferentialDecodingIter{rawIt, nil}
-			it.leafIter.Seek(key)
-			if it.leafIter.Valid() {
-				it.valid = true
-			}
-		}
+	if it.indexIter.Valid() && it.loadLeaf() {
+		it.leafIter.Seek(key)
+		it.valid = it.leafValid()
 	}
 }
 
@@ -353,24 +880,21 @@ func (it *TableIter) Next() {
 	}
 
 	it.leafIter.Next()
-	if !it.leafIter.Valid() {
+	if !it.leafValid() {
 		it.valid = false
-		it.indexIter.Next()
-		if it.indexIter.Valid() {
-			val := it.indexIter.Value()
-			lastOff := *(*uint32)(unsafe.Pointer(&val[0]))
-			it.leafBlock = DecodeBlock(it.table.leafData, lastOff)
-
-			if it.leafBlock != nil {
-				rawIter := it.leafBlock.NewIterator(it.table.comparator)
-				it.leafIter = &DifferentialDecodingIter{rawIter, nil}
+		if it.leafIter.Status().Ok() {
+			it.indexIter.Next()
+			if it.indexIter.Valid() && it.loadLeaf() {
 				it.leafIter.SeekToFirst()
-				if it.leafIter.Valid() {
-					it.valid = true
-				}
+				it.valid = it.leafValid()
 			}
 		}
 	}
+
+	// unpin the last block once the scan is done
+	if !it.valid {
+		it.releaseLeaf()
+	}
 }
 
 func (it *TableIter) Prev() {
@@ -379,24 +903,21 @@ func (it *TableIter) Prev() {
 	}
 
 	it.leafIter.Prev()
-	if !it.leafIter.Valid() {
+	if !it.leafValid() {
 		it.valid = false
-		it.indexIter.Prev()
-		if it.indexIter.Valid() {
-			val := it.indexIter.Value()
-			lastOff := *(*uint32)(unsafe.Pointer(&val[0]))
-			it.leafBlock = DecodeBlock(it.table.leafData, lastOff)
-
-			if it.leafBlock != nil {
-				rawIter := it.leafBlock.NewIterator(it.table.comparator)
-				it.leafIter = &DifferentialDecodingIter{rawIter, nil}
+		if it.leafIter.Status().Ok() {
+			it.indexIter.Prev()
+			if it.indexIter.Valid() && it.loadLeaf() {
 				it.leafIter.SeekToLast()
-				if it.leafIter.Valid() {
-					it.valid = true
-				}
+				it.valid = it.leafValid()
 			}
 		}
 	}
+
+	// unpin the last block once the scan is done
+	if !it.valid {
+		it.releaseLeaf()
+	}
 }
 
 func (it *TableIter) Key() []byte {
@@ -406,3 +927,21 @@ func (it *TableIter) Key() []byte {
 func (it *TableIter) Value() []byte {
 	return it.leafIter.Value()
 }
+
+// Unpin the current leaf block
+func (it *TableIter) Release() {
+	it.valid = false
+	it.releaseLeaf()
+}
+
+func (it *TableIter) Status() Status {
+	if !it.status.Ok() {
+		return it.status
+	}
+	if it.leafIter != nil {
+		if s := it.leafIter.Status(); !s.Ok() {
+			return s
+		}
+	}
+	return it.indexIter.Status()
+}
@@ -0,0 +1,138 @@
+package gdb
+
+import (
+	"fmt"
+)
+
+// max number of shards of a table cache
+const kMaxTableCacheShardBits = 4
+
+// tableCache keeps up to Options.MaxOpenFiles tables open, keyed by
+// file number. A cached table holds its index and filter blocks and
+// the open file. Least recently used tables are closed to make room
+// for new ones, a table in use is closed once it is released
+type tableCache struct {
+	name       string
+	env        Env
+	comparator *InternalKeyComparator
+	policy     FilterPolicy
+	paranoid   bool
+	blockCache *BlockCache
+	lru        *LRU
+}
+
+func makeTableCache(name string, opt *Options, c *InternalKeyComparator, blockCache *BlockCache) *tableCache {
+	ret := &tableCache{}
+	ret.name = name
+	ret.env = opt.Env
+	ret.comparator = c
+	ret.policy = makeInternalFilterPolicy(opt.FilterPolicy)
+	ret.paranoid = opt.ParanoidChecks
+	ret.blockCache = blockCache
+
+	// keep a few dozen tables in each shard so that the bound on open
+	// files stays close to @opt.MaxOpenFiles
+	bits := 0
+	for bits < kMaxTableCacheShardBits && opt.MaxOpenFiles>>uint(bits+1) >= 32 {
+		bits++
+	}
+	ret.lru = NewShardedLRU(opt.MaxOpenFiles, bits)
+	return ret
+}
+
+func tableCacheKey(number uint64) []byte {
+	return EncodeUint64(nil, number)
+}
+
+// return the table of file @number, opening it if it is not in cache.
+// The table is pinned by the returned handle, which must be released
+func (tc *tableCache) findTable(number uint64) (*LruEntry, Status) {
+	key := tableCacheKey(number)
+	if h := tc.lru.Lookup(key); h != nil {
+		return h, MakeStatusOk()
+	}
+
+	name := tableFileName(tc.name, number)
+	size, s := tc.env.GetFileSize(name)
+	if !s.Ok() {
+		return nil, s
+	}
+
+	file, s := tc.env.NewRandomAccessFile(name)
+	if !s.Ok() {
+		return nil, s
+	}
+
+	table, s := OpenTable(file, size, tc.comparator, tc.policy)
+	if !s.Ok() {
+		// errors are not cached, a later read tries again
+		file.Close()
+		if s.IsCorruption() {
+			s = MakeStatusCorruption(fmt.Sprintf("bad table %s: %s", name, s.ToString()))
+		}
+		return nil, s
+	}
+
+	table.cache = tc.blockCache
+	table.number = number
+	table.paranoid = tc.paranoid
+
+	h := tc.lru.Insert(key, table, 1, func(key []byte, value interface{}) {
+		value.(*Table).Close()
+	})
+	return h, MakeStatusOk()
+}
+
+func (tc *tableCache) release(h *LruEntry) {
+	tc.lru.Release(h)
+}
+
+// look up @key in table @number, see Table.Get
+func (tc *tableCache) get(number uint64, key []byte, opt ReadOptions) ([]byte, Status) {
+	h, s := tc.findTable(number)
+	if !s.Ok() {
+		return nil, s
+	}
+	defer tc.release(h)
+
+	return h.Value().(*Table).Get(key, opt)
+}
+
+// return an iterator over table @number. The table stays open until
+// the iterator is released
+func (tc *tableCache) newIterator(number uint64, opt *ReadOptions) (Iterator, Status) {
+	h, s := tc.findTable(number)
+	if !s.Ok() {
+		return nil, s
+	}
+
+	return &tableCacheIter{h.Value().(*Table).NewIterator(opt), tc, h}, MakeStatusOk()
+}
+
+// drop table @number from cache, its file is closed once no reader
+// uses it
+func (tc *tableCache) evict(number uint64) {
+	tc.lru.Erase(tableCacheKey(number))
+}
+
+// close all tables that are not in use
+func (tc *tableCache) close() {
+	tc.lru.Prune()
+}
+
+// an iterator over a table pinned in table cache by @handle
+type tableCacheIter struct {
+	Iterator
+	tc     *tableCache
+	handle *LruEntry
+}
+
+func (it *tableCacheIter) Release() {
+	if it.handle == nil {
+		return
+	}
+
+	it.Iterator.Release()
+	it.tc.release(it.handle)
+	it.handle = nil
+}
@@ -0,0 +1,164 @@
+package gdb
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// an env counting files opened for random access but not closed yet.
+// Files may be closed by finalizers, so the count is atomic
+type openFilesEnv struct {
+	NativeEnv
+	open int32
+}
+
+type openFilesFile struct {
+	RandomAccessFile
+	env *openFilesEnv
+}
+
+func (e *openFilesEnv) NewRandomAccessFile(name string) (RandomAccessFile, Status) {
+	f, s := e.NativeEnv.NewRandomAccessFile(name)
+	if !s.Ok() {
+		return f, s
+	}
+	atomic.AddInt32(&e.open, 1)
+	return &openFilesFile{f, e}, s
+}
+
+func (f *openFilesFile) Close() {
+	atomic.AddInt32(&f.env.open, -1)
+	f.RandomAccessFile.Close()
+}
+
+// build table files 1 to @n, each holding a single key
+func buildTableCacheTestFiles(t *testing.T, root string, n int, c *InternalKeyComparator) {
+	for i := 1; i <= n; i++ {
+		f := MakeLocalWritableFile(tableFileName(root, uint64(i)))
+		if f == nil {
+			t.Fatal("Fails to create a new file")
+		}
+
+		b := MakeTableBuilder(make([]byte, 64*1024), make([]byte, 4096), f)
+		key := MakeInternalKey(nil, []byte(fmt.Sprintf("key%d", i)), 1, kTypeValue)
+		b.Add(key, []byte(fmt.Sprintf("value%d", i)))
+		b.Finalize(c)
+		f.Close()
+	}
+}
+
+func TestTableCacheBoundsOpenFiles(t *testing.T) {
+	root := "/tmp/table_cache_test/testTableCacheBoundsOpenFiles"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	c := MakeInternalKeyComparator(&BytesSkiplistOrder{})
+	buildTableCacheTestFiles(t, root, 10, c)
+
+	env := &openFilesEnv{}
+	opt := Options{Env: env, MaxOpenFiles: 3}
+	tc := makeTableCache(root, &opt, c, nil)
+
+	for round := 0; round < 2; round++ {
+		for i := 1; i <= 10; i++ {
+			lookup := MakeInternalKey(nil, []byte(fmt.Sprintf("key%d", i)), 1, kValueTypeForSeek)
+			val, s := tc.get(uint64(i), lookup, MakeReadOptions())
+			if !s.Ok() || string(val) != fmt.Sprintf("value%d", i) {
+				t.Fatal("Fails to read table ", i, " ", s.ToString())
+			}
+			if atomic.LoadInt32(&env.open) > 3 {
+				t.Fatal("Too many open files ", atomic.LoadInt32(&env.open))
+			}
+		}
+	}
+
+	// a missing file is not cached
+	if _, s := tc.findTable(11); s.Ok() {
+		t.Error("Opens a table that does not exist")
+	}
+
+	tc.close()
+	if atomic.LoadInt32(&env.open) != 0 {
+		t.Error("Files are left open ", atomic.LoadInt32(&env.open))
+	}
+}
+
+func TestTableCacheEvictPinnedTable(t *testing.T) {
+	root := "/tmp/table_cache_test/testTableCacheEvictPinnedTable"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	c := MakeInternalKeyComparator(&BytesSkiplistOrder{})
+	buildTableCacheTestFiles(t, root, 2, c)
+
+	env := &openFilesEnv{}
+	opt := Options{Env: env, MaxOpenFiles: 1}
+	tc := makeTableCache(root, &opt, c, nil)
+
+	iter, s := tc.newIterator(1, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to open table ", s.ToString())
+	}
+
+	// the iterator keeps its table open beyond the capacity, the
+	// other table is closed once released
+	h, s := tc.findTable(2)
+	if !s.Ok() || atomic.LoadInt32(&env.open) != 2 {
+		t.Fatal("Unexpected open files ", atomic.LoadInt32(&env.open))
+	}
+	tc.release(h)
+	if atomic.LoadInt32(&env.open) != 1 {
+		t.Error("Table over capacity is not closed")
+	}
+
+	// an evicted table stays readable until the iterator is released
+	tc.evict(1)
+	iter.SeekToFirst()
+	if !iter.Valid() || string(iter.Value()) != "value1" {
+		t.Error("Fails to read an evicted table")
+	}
+	if atomic.LoadInt32(&env.open) != 1 {
+		t.Error("Table in use is closed")
+	}
+
+	iter.Release()
+	if atomic.LoadInt32(&env.open) != 0 {
+		t.Error("Evicted table is not closed ", atomic.LoadInt32(&env.open))
+	}
+}
+
+func TestTableCacheReleaseIterator(t *testing.T) {
+	root := "/tmp/table_cache_test/testTableCacheReleaseIterator"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	c := MakeInternalKeyComparator(&BytesSkiplistOrder{})
+	buildTableCacheTestFiles(t, root, 1, c)
+
+	env := &openFilesEnv{}
+	opt := Options{Env: env, MaxOpenFiles: 1}
+	tc := makeTableCache(root, &opt, c, nil)
+
+	iter, s := tc.newIterator(1, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to open table ", s.ToString())
+	}
+	iter.SeekToFirst()
+
+	// an evicted table is closed as soon as the iterator is released
+	tc.evict(1)
+	iter.Release()
+	if atomic.LoadInt32(&env.open) != 0 {
+		t.Error("Released table is not closed ", atomic.LoadInt32(&env.open))
+	}
+
+	iter.Release()
+	if atomic.LoadInt32(&env.open) != 0 {
+		t.Error("Releasing twice changes open files ", atomic.LoadInt32(&env.open))
+	}
+}
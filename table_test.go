@@ -1,7 +1,9 @@
 package gdb
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
@@ -33,14 +35,14 @@ func TestBuildTableAndIterate(t *testing.T) {
 	}
 
 	order := &BytesSkiplistOrder{}
-	res := b.Finalize(order)
+	res, _ := b.Finalize(order)
 
 	if res == nil {
 		t.Error("Fails to get a table object")
 	}
 
 	// verify that data is correct
-	iter := res.NewIterator()
+	iter := res.NewIterator(nil)
 	if iter == nil {
 		t.Error("fails to get an iterator")
 	}
@@ -96,7 +98,7 @@ func TestBuildTableAndRecover(t *testing.T) {
 		}
 
 		order := &BytesSkiplistOrder{}
-		res := b.Finalize(order)
+		res, _ := b.Finalize(order)
 
 		if res == nil {
 			t.Error("Fails to get a table object")
@@ -105,13 +107,11 @@ func TestBuildTableAndRecover(t *testing.T) {
 
 	// verify that data is correct
 	{
-		f := MakeLocalSequentialFile(fname)
+		f := MakeLocalRandomAccessFile(fname)
 		if f == nil {
-			t.Error("Fails to open table file for read")
+			t.Fatal("Fails to open table file for read")
 		}
 
-		defer f.Close()
-
 		// get file size
 		var fsize int64
 		{
@@ -129,15 +129,15 @@ func TestBuildTableAndRecover(t *testing.T) {
 			fobj.Close()
 		}
 
-		buf := make([]byte, fsize)
 		order := &BytesSkiplistOrder{}
 
-		table := RecoverTable(f, buf, order)
-		if table == nil {
-			t.Error("Fails to recover from a table file")
+		table, s := OpenTable(f, uint64(fsize), order, nil)
+		if !s.Ok() {
+			t.Fatal("Fails to open a table file ", s.ToString())
 		}
+		defer table.Close()
 
-		iter := table.NewIterator()
+		iter := table.NewIterator(nil)
 		if iter == nil {
 			t.Error("fails to get an iterator")
 		}
@@ -166,3 +166,745 @@ func TestBuildTableAndRecover(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildTableAndSeekMultiBlock(t *testing.T) {
+	root := "/tmp/table_test/testBuildTableAndSeekMultiBlock"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	fname := strings.Join([]string{root, "sstfile"}, "/")
+	f := MakeLocalWritableFile(fname)
+	if f == nil {
+		t.Error("Fails to create a new file")
+	}
+
+	data1 := make([]byte, 1024*1024)
+	data2 := make([]byte, 4096)
+
+	b := MakeTableBuilder(data1, data2, f)
+
+	// enough entries to span multiple leaf blocks
+	for i := 10000; i < 12000; i += 2 {
+		key := []byte(fmt.Sprintf("%d", i))
+		b.Add(key, key)
+	}
+
+	order := &BytesSkiplistOrder{}
+	res, _ := b.Finalize(order)
+	f.Close()
+
+	iter := res.NewIterator(nil)
+
+	for i := 10000; i < 11998; i++ {
+		iter.Seek([]byte(fmt.Sprintf("%d", i)))
+		if !iter.Valid() {
+			t.Error("Fails to seek to ", i)
+			continue
+		}
+
+		expect := i + i%2
+		key := string(iter.Key())
+		if key != fmt.Sprintf("%d", expect) {
+			t.Error("key mismatch ", key, " expect ", expect)
+		}
+	}
+
+	// scan backward from the last entry
+	iter.SeekToLast()
+	for i := 11998; i >= 10000; i -= 2 {
+		if !iter.Valid() {
+			t.Error("Premature at the beginning")
+			break
+		}
+
+		key := string(iter.Key())
+		if key != fmt.Sprintf("%d", i) {
+			t.Error("key mismatch ", key, " expect ", i)
+		}
+
+		iter.Prev()
+	}
+}
+
+func TestTableApproximateOffsetOf(t *testing.T) {
+	root := "/tmp/table_test/testTableApproximateOffsetOf"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	fname := strings.Join([]string{root, "sstfile"}, "/")
+	f := MakeLocalWritableFile(fname)
+	if f == nil {
+		t.Error("Fails to create a new file")
+	}
+
+	data1 := make([]byte, 1024*1024)
+	data2 := make([]byte, 4096)
+
+	b := MakeTableBuilder(data1, data2, f)
+
+	// many leaf blocks
+	const numEntries = 2048
+	value := make([]byte, 100)
+	for i := 10000; i < 10000+numEntries; i++ {
+		b.Add([]byte(fmt.Sprintf("%d", i)), value)
+	}
+
+	order := &BytesSkiplistOrder{}
+	res, _ := b.Finalize(order)
+	f.Close()
+
+	first := res.ApproximateOffsetOf([]byte("0"))
+	if first != 0 {
+		t.Error("Offset of a key before the table is ", first)
+	}
+
+	end := res.ApproximateOffsetOf([]byte("99999"))
+	if end != uint64(b.leafPos) {
+		t.Error("Offset of a key after the table is ", end)
+	}
+
+	// offsets grow with keys
+	prev := uint64(0)
+	for i := 10000; i < 10000+numEntries; i += 100 {
+		off := res.ApproximateOffsetOf([]byte(fmt.Sprintf("%d", i)))
+		if off < prev || off > end {
+			t.Error("Bad offset ", off, " for key ", i)
+		}
+		prev = off
+	}
+
+	mid := res.ApproximateOffsetOf([]byte(fmt.Sprintf("%d", 10000+numEntries/2)))
+	if mid < end/4 || mid > end*3/4 {
+		t.Error("Offset of middle key ", mid, " is out of range ", end)
+	}
+}
+
+func TestTableFilterBlock(t *testing.T) {
+	root := "/tmp/table_test/testTableFilterBlock"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	fname := strings.Join([]string{root, "sstfile"}, "/")
+	f := MakeLocalWritableFile(fname)
+	if f == nil {
+		t.Fatal("Fails to create a new file")
+	}
+
+	data1 := make([]byte, 1024*1024)
+	data2 := make([]byte, 4096)
+
+	policy := MakeBloomFilterPolicy(10)
+	b := MakeTableBuilder(data1, data2, f)
+	b.filter = makeFilterBlockBuilder(policy)
+
+	// even keys only, spanning multiple leaf blocks
+	for i := 10000; i < 12000; i += 2 {
+		key := []byte(fmt.Sprintf("%d", i))
+		b.Add(key, key)
+	}
+
+	order := &BytesSkiplistOrder{}
+	b.Finalize(order)
+	f.Close()
+
+	rf := MakeLocalRandomAccessFile(fname)
+	if rf == nil {
+		t.Fatal("Fails to open table file for read")
+	}
+
+	table, s := OpenTable(rf, b.FileSize(), order, policy)
+	if !s.Ok() || table.filter == nil {
+		t.Fatal("Fails to open table with filter block")
+	}
+	defer table.Close()
+
+	counter := &countingFilterPolicy{FilterPolicy: policy}
+	table.filter.policy = counter
+
+	for i := 10000; i < 12000; i++ {
+		key := []byte(fmt.Sprintf("%d", i))
+		val, s := table.Get(key, ReadOptions{})
+		if i%2 == 0 && (!s.Ok() || string(val) != string(key)) {
+			t.Fatal("Fails to get key ", i)
+		}
+		if i%2 != 0 && !s.IsNotFound() {
+			t.Fatal("Should not find key ", i)
+		}
+	}
+
+	if counter.misses < 900 {
+		t.Error("Filter rules out only ", counter.misses, " missing keys")
+	}
+
+	// data is still readable through iterators
+	iter := table.NewIterator(nil)
+	iter.Seek([]byte("11001"))
+	if !iter.Valid() || string(iter.Key()) != "11002" {
+		t.Error("Fails to seek in a table with filter block")
+	}
+}
+
+// count keys ruled out by a filter policy
+type countingFilterPolicy struct {
+	FilterPolicy
+	misses int
+}
+
+func (p *countingFilterPolicy) KeyMayMatch(key, filter []byte) bool {
+	ret := p.FilterPolicy.KeyMayMatch(key, filter)
+	if !ret {
+		p.misses++
+	}
+	return ret
+}
+
+func TestTableGetInternalKeys(t *testing.T) {
+	root := "/tmp/table_test/testTableGetInternalKeys"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	fname := strings.Join([]string{root, "sstfile"}, "/")
+	f := MakeLocalWritableFile(fname)
+	if f == nil {
+		t.Fatal("Fails to create a new file")
+	}
+
+	b := MakeTableBuilder(make([]byte, 1024*1024), make([]byte, 4096), f)
+
+	// each key has a value at sequence 10, keys divisible by 3 are
+	// deleted at sequence 20
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if i%3 == 0 {
+			b.Add(MakeInternalKey(nil, key, 20, kTypeDeletion), nil)
+		}
+		b.Add(MakeInternalKey(nil, key, 10, kTypeValue), key)
+	}
+
+	table, _ := b.Finalize(MakeInternalKeyComparator(&BytesSkiplistOrder{}))
+	f.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+
+		// the deletion is not visible at sequence 15
+		val, s := table.Get(MakeInternalKey(nil, key, 15, kValueTypeForSeek), ReadOptions{})
+		if !s.Ok() || string(val) != string(key) {
+			t.Fatal("Fails to get key ", string(key), " at sequence 15")
+		}
+
+		val, s = table.Get(MakeInternalKey(nil, key, 30, kValueTypeForSeek), ReadOptions{})
+		switch {
+		case i%3 == 0 && (!s.IsDeleted() || !s.IsNotFound()):
+			t.Fatal("Deletion of key ", string(key), " is not reported")
+		case i%3 != 0 && (!s.Ok() || string(val) != string(key)):
+			t.Fatal("Fails to get key ", string(key), " at sequence 30")
+		}
+
+		_, s = table.Get(MakeInternalKey(nil, key, 5, kValueTypeForSeek), ReadOptions{})
+		if !s.IsNotFound() || s.IsDeleted() {
+			t.Fatal("Key ", string(key), " should not be visible at sequence 5")
+		}
+	}
+
+	missing := [][]byte{[]byte("key"), []byte("key0010a"), []byte("zzz")}
+	for _, key := range missing {
+		_, s := table.Get(MakeInternalKey(nil, key, 30, kValueTypeForSeek), ReadOptions{})
+		if !s.IsNotFound() || s.IsDeleted() {
+			t.Error("Should not find key ", string(key))
+		}
+	}
+}
+
+// count reads from a table file
+type countingRandomAccessFile struct {
+	RandomAccessFile
+	reads int
+	bytes int
+	// fail all reads from now on
+	fail bool
+}
+
+func (f *countingRandomAccessFile) Read(off int64, scratch []byte) ([]byte, Status) {
+	f.reads++
+	f.bytes = f.bytes + len(scratch)
+	if f.fail {
+		return nil, MakeStatusIoError("injected read error")
+	}
+	return f.RandomAccessFile.Read(off, scratch)
+}
+
+func TestTableReadsBlocksLazily(t *testing.T) {
+	root := "/tmp/table_test/testTableReadsBlocksLazily"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	fname := strings.Join([]string{root, "sstfile"}, "/")
+	f := MakeLocalWritableFile(fname)
+	if f == nil {
+		t.Fatal("Fails to create a new file")
+	}
+
+	b := MakeTableBuilder(make([]byte, 1024*1024), make([]byte, 16*1024), f)
+	value := make([]byte, 100)
+	for i := 10000; i < 14000; i++ {
+		b.Add([]byte(fmt.Sprintf("%d", i)), value)
+	}
+
+	order := &BytesSkiplistOrder{}
+	b.Finalize(order)
+	f.Close()
+
+	rf := &countingRandomAccessFile{RandomAccessFile: MakeLocalRandomAccessFile(fname)}
+	table, s := OpenTable(rf, b.FileSize(), order, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to open table ", s.ToString())
+	}
+	defer table.Close()
+
+	// footer and index block only
+	if rf.reads != 2 || uint64(rf.bytes) != kTableFooterSize+uint64(b.indexSize) {
+		t.Error("Unexpected reads to open a table ", rf.reads, " ", rf.bytes)
+	}
+
+	// a point lookup reads a single leaf block
+	rf.reads, rf.bytes = 0, 0
+	val, s := table.Get([]byte("12345"), ReadOptions{})
+	if !s.Ok() || len(val) != len(value) {
+		t.Fatal("Fails to get a key")
+	}
+	if rf.reads != 1 || rf.bytes > 2*kDefaultBlockSize {
+		t.Error("Unexpected reads for a lookup ", rf.reads, " ", rf.bytes)
+	}
+
+	// a full scan reads every leaf block once
+	rf.reads, rf.bytes = 0, 0
+	count := 0
+	iter := table.NewIterator(nil)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		count++
+	}
+	if count != 4000 || rf.bytes != int(b.leafPos) {
+		t.Error("Unexpected scan ", count, " entries, ", rf.bytes, " bytes read")
+	}
+}
+
+func TestTableIterReportsReadErrors(t *testing.T) {
+	root := "/tmp/table_test/testTableIterReportsReadErrors"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	fname := strings.Join([]string{root, "sstfile"}, "/")
+	f := MakeLocalWritableFile(fname)
+	b := MakeTableBuilder(make([]byte, 1024*1024), make([]byte, 16*1024), f)
+	value := make([]byte, 100)
+	for i := 10000; i < 14000; i++ {
+		b.Add([]byte(fmt.Sprintf("%d", i)), value)
+	}
+
+	order := &BytesSkiplistOrder{}
+	b.Finalize(order)
+	f.Close()
+
+	rf := &countingRandomAccessFile{RandomAccessFile: MakeLocalRandomAccessFile(fname)}
+	table, s := OpenTable(rf, b.FileSize(), order, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to open table ", s.ToString())
+	}
+	defer table.Close()
+
+	// a read error in the middle of a scan is not the end of data
+	count := 0
+	iter := table.NewIterator(nil)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		count++
+		if count == 1000 {
+			rf.fail = true
+		}
+	}
+	if count >= 4000 || !iter.Status().IsIoError() {
+		t.Error("Read error is not reported ", count)
+	}
+
+	// the error sticks even if later reads succeed
+	rf.fail = false
+	iter.SeekToFirst()
+	if !iter.Status().IsIoError() {
+		t.Error("Iterator status is not sticky")
+	}
+}
+
+func TestTableBlockCache(t *testing.T) {
+	root := "/tmp/table_test/testTableBlockCache"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	fname := strings.Join([]string{root, "sstfile"}, "/")
+	f := MakeLocalWritableFile(fname)
+	if f == nil {
+		t.Fatal("Fails to create a new file")
+	}
+
+	b := MakeTableBuilder(make([]byte, 1024*1024), make([]byte, 16*1024), f)
+	value := make([]byte, 100)
+	for i := 10000; i < 14000; i++ {
+		b.Add([]byte(fmt.Sprintf("%d", i)), value)
+	}
+
+	order := &BytesSkiplistOrder{}
+	b.Finalize(order)
+	f.Close()
+
+	rf := &countingRandomAccessFile{RandomAccessFile: MakeLocalRandomAccessFile(fname)}
+	table, s := OpenTable(rf, b.FileSize(), order, nil)
+	if !s.Ok() {
+		t.Fatal("Fails to open table ", s.ToString())
+	}
+	defer table.Close()
+
+	cache := MakeBlockCache(1024 * 1024)
+	table.cache = cache
+	table.number = 7
+
+	// lookups without filling the cache always read the file
+	rf.reads = 0
+	for i := 0; i < 2; i++ {
+		if _, s := table.Get([]byte("12345"), ReadOptions{DontFillCache: true}); !s.Ok() {
+			t.Fatal("Fails to get a key")
+		}
+	}
+	if rf.reads != 2 || cache.Usage() != 0 {
+		t.Error("Unexpected cache use ", rf.reads, " ", cache.Usage())
+	}
+
+	// the second lookup hits the cache
+	rf.reads = 0
+	for i := 0; i < 2; i++ {
+		if _, s := table.Get([]byte("12345"), MakeReadOptions()); !s.Ok() {
+			t.Fatal("Fails to get a key")
+		}
+	}
+	if rf.reads != 1 || cache.Usage() == 0 {
+		t.Error("Unexpected cache use ", rf.reads, " ", cache.Usage())
+	}
+
+	// a scan that does not fill the cache still uses cached blocks
+	rf.reads = 0
+	iter := table.NewIterator(&ReadOptions{DontFillCache: true})
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+	}
+	blocks := rf.reads
+	if cache.Usage() > 2*kDefaultBlockSize {
+		t.Error("A scan fills the cache ", cache.Usage())
+	}
+
+	// all blocks are cached after a scan filling the cache
+	iter = table.NewIterator(nil)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+	}
+	rf.reads = 0
+	iter = table.NewIterator(nil)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+	}
+	// blocks are charged without their trailers
+	numBlocks := int(table.index.numKeys)
+	if blocks < 2 || rf.reads != 0 || cache.Usage() != int(b.leafPos)-numBlocks*kBlockTrailerSize {
+		t.Error("Unexpected cached scan ", blocks, " ", rf.reads, " ", cache.Usage())
+	}
+}
+
+func TestTableRejectsBadFiles(t *testing.T) {
+	root := "/tmp/table_test/testTableRejectsBadFiles"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	order := &BytesSkiplistOrder{}
+	open := func(data []byte, size uint64) Status {
+		fname := strings.Join([]string{root, "sstfile"}, "/")
+		os.Remove(fname)
+		f := MakeLocalWritableFile(fname)
+		f.Append(data)
+		f.Close()
+
+		rf := MakeLocalRandomAccessFile(fname)
+		table, s := OpenTable(rf, size, order, nil)
+		if s.Ok() {
+			table.Close()
+		} else {
+			rf.Close()
+		}
+		return s
+	}
+
+	// files that are too short or not tables at all
+	text := []byte(strings.Repeat("this is not a table. ", 10))
+	for _, size := range []uint64{4, 19, uint64(len(text))} {
+		if s := open(text, size); !s.IsCorruption() {
+			t.Error("Open a bad table of size ", size)
+		}
+	}
+
+	var buf bytes.Buffer
+	b := MakeTableBuilder(make([]byte, 64*1024), make([]byte, 4096), &bufferWritableFile{&buf})
+	for i := 10000; i < 10100; i++ {
+		b.Add([]byte(strconv.Itoa(i)), []byte("value"))
+	}
+	b.Finalize(order)
+	good := buf.Bytes()
+
+	if s := open(good, uint64(len(good))); !s.Ok() {
+		t.Fatal("Fails to open a good table ", s.ToString())
+	}
+
+	// a truncated table
+	if s := open(good[:len(good)-10], uint64(len(good)-10)); !s.IsCorruption() {
+		t.Error("Open a truncated table")
+	}
+
+	// a table of a future format version
+	future := append([]byte(nil), good...)
+	version := future[len(future)-16 : len(future)-12]
+	copy(version, EncodeUint32(nil, kTableFormatVersion+1))
+	s := open(future, uint64(len(future)))
+	if !s.IsCorruption() || !strings.Contains(s.ToString(), "version") {
+		t.Error("Open a table of a future format ", s.ToString())
+	}
+
+	// a block handle beyond the end of file
+	bad := append([]byte(nil), good...)
+	copy(bad[len(bad)-kTableFooterSize+16:], EncodeUint64(nil, uint64(len(bad))))
+	if s := open(bad, uint64(len(bad))); !s.IsCorruption() {
+		t.Error("Open a table of bad index handle")
+	}
+}
+
+func TestTableVerifyChecksums(t *testing.T) {
+	root := "/tmp/table_test/testTableVerifyChecksums"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	order := &BytesSkiplistOrder{}
+	for _, ct := range []ChecksumType{CRC32CChecksum, XXHashChecksum} {
+		var buf bytes.Buffer
+		b := MakeTableBuilder(make([]byte, 64*1024), make([]byte, 4096), &bufferWritableFile{&buf})
+		b.checksum = ct
+		for i := 10000; i < 10100; i++ {
+			b.Add([]byte(strconv.Itoa(i)), []byte("value"))
+		}
+		b.Finalize(order)
+
+		// flip a bit in the value of the first entry
+		data := buf.Bytes()
+		pos := bytes.Index(data, []byte("value"))
+		data[pos] ^= 0x01
+
+		fname := strings.Join([]string{root, "sstfile"}, "/")
+		os.Remove(fname)
+		f := MakeLocalWritableFile(fname)
+		f.Append(data)
+		f.Close()
+
+		table, s := OpenTable(MakeLocalRandomAccessFile(fname), uint64(len(data)), order, nil)
+		if !s.Ok() {
+			t.Fatal("Fails to open table ", s.ToString())
+		}
+
+		// bit rot goes unnoticed unless checksums are verified
+		val, s := table.Get([]byte("10000"), ReadOptions{})
+		if !s.Ok() || string(val) == "value" {
+			t.Error("Unexpected read of corrupted block ", s.ToString())
+		}
+		if _, s := table.Get([]byte("10000"), ReadOptions{VerifyChecksums: true}); !s.IsCorruption() {
+			t.Error("Corruption is not detected ", ct)
+		}
+
+		iter := table.NewIterator(&ReadOptions{VerifyChecksums: true})
+		if iter.SeekToFirst(); iter.Valid() {
+			t.Error("Iterates over a corrupted block ", ct)
+		}
+		if !iter.Status().IsCorruption() {
+			t.Error("Iterator does not report corruption ", ct)
+		}
+
+		// paranoid tables verify all reads
+		table.paranoid = true
+		if _, s := table.Get([]byte("10000"), ReadOptions{}); !s.IsCorruption() {
+			t.Error("Corruption is not detected by paranoid checks ", ct)
+		}
+		table.Close()
+
+		// corrupted index block is always detected
+		corrupt := append([]byte(nil), data...)
+		corrupt[pos] ^= 0x01
+		corrupt[len(corrupt)-kTableFooterSize-kBlockTrailerSize-1] ^= 0x01
+		os.Remove(fname)
+		f = MakeLocalWritableFile(fname)
+		f.Append(corrupt)
+		f.Close()
+		if _, s := OpenTable(MakeLocalRandomAccessFile(fname), uint64(len(corrupt)), order, nil); !s.IsCorruption() {
+			t.Error("Opens a table of corrupted index block ", ct)
+		}
+	}
+}
+
+func TestTableCompression(t *testing.T) {
+	root := "/tmp/table_test/testTableCompression"
+
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	order := &BytesSkiplistOrder{}
+	sizes := make(map[CompressionType]int)
+	for _, ct := range []CompressionType{NoCompression, SnappyCompression, LZ4Compression, FlateCompression} {
+		var buf bytes.Buffer
+		b := MakeTableBuilder(make([]byte, 256*1024), make([]byte, 4096), &bufferWritableFile{&buf})
+		b.compressor.compression = ct
+		for i := 10000; i < 11000; i++ {
+			b.Add([]byte(strconv.Itoa(i)), []byte(fmt.Sprintf(`{"id":%d,"name":"user","active":true}`, i)))
+		}
+		built, _ := b.Finalize(order)
+		sizes[ct] = buf.Len()
+
+		// tables built in memory read compressed blocks too
+		if val, s := built.Get([]byte("10500"), ReadOptions{}); !s.Ok() || !strings.Contains(string(val), "10500") {
+			t.Error("Fails to read a table built in memory ", ct, " ", s.ToString())
+		}
+
+		fname := strings.Join([]string{root, "sstfile"}, "/")
+		os.Remove(fname)
+		f := MakeLocalWritableFile(fname)
+		f.Append(buf.Bytes())
+		f.Close()
+
+		table, s := OpenTable(MakeLocalRandomAccessFile(fname), uint64(buf.Len()), order, nil)
+		if !s.Ok() {
+			t.Fatal("Fails to open table ", s.ToString())
+		}
+		table.cache = MakeBlockCache(1024 * 1024)
+
+		iter := table.NewIterator(&ReadOptions{VerifyChecksums: true})
+		i := 10000
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			expect := fmt.Sprintf(`{"id":%d,"name":"user","active":true}`, i)
+			if string(iter.Key()) != strconv.Itoa(i) || string(iter.Value()) != expect {
+				t.Fatal("Unexpected entry ", string(iter.Key()), " ", ct)
+			}
+			i++
+		}
+		if i != 11000 {
+			t.Error("Misses entries ", i, " ", ct)
+		}
+		table.Close()
+	}
+
+	for _, ct := range []CompressionType{SnappyCompression, LZ4Compression, FlateCompression} {
+		if sizes[ct] > sizes[NoCompression]/2 {
+			t.Error("Compression does not save space ", ct, " ", sizes[ct], " ", sizes[NoCompression])
+		}
+	}
+}
+
+func TestTableCorruptedBlocks(t *testing.T) {
+	var buf bytes.Buffer
+	b := MakeTableBuilder(make([]byte, 64*1024), make([]byte, 4096), &bufferWritableFile{&buf})
+	for i := 10000; i < 10500; i++ {
+		b.Add([]byte(strconv.Itoa(i)), []byte("value"))
+	}
+
+	order := &BytesSkiplistOrder{}
+	table, s := b.Finalize(order)
+	if !s.Ok() {
+		t.Fatal("Fails to build table ", s.ToString())
+	}
+
+	// checksums are not verified, so damaged leaf blocks are decoded.
+	// Reads fail or return garbage, but never crash
+	original := append([]byte(nil), table.data[:b.leafPos]...)
+	rnd := rand.New(rand.NewSource(301))
+	for trial := 0; trial < 500; trial++ {
+		copy(table.data, original)
+		for i := 0; i < 1+trial%4; i++ {
+			table.data[rnd.Intn(len(original))] = byte(rnd.Intn(256))
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatal("Panics on a corrupted block in trial ", trial, ": ", r)
+				}
+			}()
+
+			iter := table.NewIterator(nil)
+			for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+				iter.Key()
+				iter.Value()
+			}
+			for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+				iter.Key()
+			}
+			for i := 0; i < 10; i++ {
+				key := []byte(strconv.Itoa(10000 + rnd.Intn(500)))
+				if iter.Seek(key); iter.Valid() {
+					iter.Key()
+				}
+				table.Get(key, ReadOptions{})
+			}
+		}()
+	}
+}
+
+func TestTableBuilderWriteError(t *testing.T) {
+	for _, limit := range []int{0, 100, 5000} {
+		f := &failingWritableFile{limit: limit}
+		b := MakeTableBuilder(make([]byte, 64*1024), make([]byte, 4096), f)
+		for i := 10000; i < 10500; i++ {
+			b.Add([]byte(strconv.Itoa(i)), []byte("value"))
+		}
+
+		table, s := b.Finalize(&BytesSkiplistOrder{})
+		if table != nil || !s.IsIoError() {
+			t.Error("Write error is not returned after ", limit, " bytes")
+		}
+	}
+}
+
+// a writable file that fails once more than @limit bytes are written
+type failingWritableFile struct {
+	size  int
+	limit int
+}
+
+func (f *failingWritableFile) Append(data []byte) Status {
+	if f.size+len(data) > f.limit {
+		return MakeStatusIoError("no space left on device")
+	}
+	f.size = f.size + len(data)
+	return MakeStatusOk()
+}
+
+func (f *failingWritableFile) Size() int64   { return int64(f.size) }
+func (f *failingWritableFile) Flush() Status { return MakeStatusOk() }
+func (f *failingWritableFile) Close() Status { return MakeStatusOk() }
+
+// a writable file backed by a buffer
+type bufferWritableFile struct {
+	buf *bytes.Buffer
+}
+
+func (f *bufferWritableFile) Append(data []byte) Status {
+	f.buf.Write(data)
+	return MakeStatusOk()
+}
+
+func (f *bufferWritableFile) Size() int64   { return int64(f.buf.Len()) }
+func (f *bufferWritableFile) Flush() Status { return MakeStatusOk() }
+func (f *bufferWritableFile) Close() Status { return MakeStatusOk() }
@@ -1,9 +1,28 @@
 package gdb
 
 import (
-	"unsafe"
+	"encoding/binary"
 )
 
+// Integers in files are saved in little endian byte order, so that
+// files can be copied between machines of different architectures.
+// Files written by old releases use native byte order of the machine
+// that writes them, a decoder of native order reads them
+type decoder struct {
+	order binary.ByteOrder
+}
+
+var (
+	littleEndian = decoder{binary.LittleEndian}
+	nativeEndian = decoder{binary.NativeEndian}
+)
+
+// return true if native byte order of this machine is little endian,
+// files written by old releases on it are the same as new ones then
+func isNativeLittleEndian() bool {
+	return binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+}
+
 // encode an integer value to the end of @scratch, returns
 // the resulting slice.
 func EncodeUint32(scratch []byte, val uint32) []byte {
@@ -19,7 +38,7 @@ func EncodeUint32(scratch []byte, val uint32) []byte {
 	}
 
 	scratch = scratch[:(size + 4)]
-	*(*uint32)(unsafe.Pointer(&scratch[size])) = val
+	binary.LittleEndian.PutUint32(scratch[size:], val)
 	return scratch
 }
 
@@ -38,7 +57,7 @@ func EncodeUint64(scratch []byte, val uint64) []byte {
 	}
 
 	scratch = scratch[:(size + 8)]
-	*(*uint64)(unsafe.Pointer(&scratch[size])) = val
+	binary.LittleEndian.PutUint64(scratch[size:], val)
 	return scratch
 }
 
@@ -55,7 +74,7 @@ func EncodeVarInt(scratch []byte, val uint64) []byte {
 			if cap(scratch) > size+2 {
 				scratch = scratch[:(size + 3)]
 				scratch[size] = 0xf1
-				*(*uint16)(unsafe.Pointer((&scratch[size+1]))) = uint16(val)
+				binary.LittleEndian.PutUint16(scratch[size+1:], uint16(val))
 				return scratch
 			}
 		case val <= 0xffffffff:
@@ -63,7 +82,7 @@ func EncodeVarInt(scratch []byte, val uint64) []byte {
 			if cap(scratch) > size+4 {
 				scratch = scratch[:(size + 5)]
 				scratch[size] = 0xf2
-				*(*uint32)(unsafe.Pointer((&scratch[size+1]))) = uint32(val)
+				binary.LittleEndian.PutUint32(scratch[size+1:], uint32(val))
 				return scratch
 			}
 		default:
@@ -71,7 +90,7 @@ func EncodeVarInt(scratch []byte, val uint64) []byte {
 			if cap(scratch) > size+8 {
 				scratch = scratch[:(size + 9)]
 				scratch[size] = 0xf3
-				*(*uint64)(unsafe.Pointer((&scratch[size+1]))) = uint64(val)
+				binary.LittleEndian.PutUint64(scratch[size+1:], val)
 				return scratch
 			}
 		}
@@ -93,28 +112,32 @@ func EncodeVarInt(scratch []byte, val uint64) []byte {
 // decode a integer value and return the slice after the bytes
 // have been consumed by the decode process
 func DecodeVarInt(data []byte) (val uint64, result []byte) {
+	return littleEndian.varInt(data)
+}
+
+func (d decoder) varInt(data []byte) (val uint64, result []byte) {
 	size := len(data)
 	if size < 1 {
 		result = data
 		return
 	}
 
+	// nothing is consumed if data is too short or has a bad flag
 	flag := data[0]
+	result = data
 	switch {
 	case flag < 0xf0:
 		val = uint64(flag)
 		result = data[1:]
-	case flag == 0xf1:
-		val = uint64(*(*uint16)(unsafe.Pointer(&data[1])))
+	case flag == 0xf1 && size >= 3:
+		val = uint64(d.order.Uint16(data[1:]))
 		result = data[3:]
-	case flag == 0xf2:
-		val = uint64(*(*uint32)(unsafe.Pointer(&data[1])))
+	case flag == 0xf2 && size >= 5:
+		val = uint64(d.order.Uint32(data[1:]))
 		result = data[5:]
-	case flag == 0xf3:
-		val = uint64(*(*uint64)(unsafe.Pointer(&data[1])))
+	case flag == 0xf3 && size >= 9:
+		val = d.order.Uint64(data[1:])
 		result = data[9:]
-	default:
-		panic("Bad flag value")
 	}
 
 	return
@@ -135,7 +158,7 @@ func EncodeSlice(scratch []byte, data []byte) []byte {
 	}
 
 	scratch = scratch[:(size + dsize + 4)]
-	*(*uint32)(unsafe.Pointer(&scratch[size])) = uint32(dsize)
+	binary.LittleEndian.PutUint32(scratch[size:], uint32(dsize))
 	copy(scratch[size+4:], data)
 
 	return scratch
@@ -144,10 +167,14 @@ func EncodeSlice(scratch []byte, data []byte) []byte {
 // decode a uint32 value and return the slice after the bytes
 // have been consumed by the decode process
 func DecodeUint32(data []byte) (val uint32, result []byte) {
+	return littleEndian.uint32(data)
+}
+
+func (d decoder) uint32(data []byte) (val uint32, result []byte) {
 	if len(data) < 4 {
 		result = data
 	} else {
-		val = *(*uint32)(unsafe.Pointer(&data[0]))
+		val = d.order.Uint32(data)
 		result = data[4:]
 	}
 	return
@@ -156,10 +183,14 @@ func DecodeUint32(data []byte) (val uint32, result []byte) {
 // decode a uint64 value and return the slice after the bytes
 // have been consumed by the decode process
 func DecodeUint64(data []byte) (val uint64, result []byte) {
+	return littleEndian.uint64(data)
+}
+
+func (d decoder) uint64(data []byte) (val uint64, result []byte) {
 	if len(data) < 8 {
 		result = data
 	} else {
-		val = *(*uint64)(unsafe.Pointer(&data[0]))
+		val = d.order.Uint64(data)
 		result = data[8:]
 	}
 	return
@@ -168,13 +199,17 @@ func DecodeUint64(data []byte) (val uint64, result []byte) {
 // decode a slice and return it after the bytes
 // have been consumed by the decode process
 func DecodeSlice(data []byte) (val []byte, result []byte) {
+	return littleEndian.slice(data)
+}
+
+func (d decoder) slice(data []byte) (val []byte, result []byte) {
 	origin := len(data)
 	if origin < 4 {
 		result = data
 		return
 	}
 
-	sliceLen := *(*uint32)(unsafe.Pointer(&data[0]))
+	sliceLen := d.order.Uint32(data)
 
 	if uint32(origin) < sliceLen+4 {
 		result = data
@@ -185,3 +220,31 @@ func DecodeSlice(data []byte) (val []byte, result []byte) {
 	result = data[sliceLen+4:]
 	return
 }
+
+// murmur like hash of @data
+func hashBytes(data []byte, seed uint32) uint32 {
+	const m = 0xc6a4a793
+
+	h := seed ^ uint32(len(data))*m
+	for ; len(data) >= 4; data = data[4:] {
+		w := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+		h = h + w
+		h = h * m
+		h = h ^ (h >> 16)
+	}
+
+	switch len(data) {
+	case 3:
+		h = h + uint32(data[2])<<16
+		fallthrough
+	case 2:
+		h = h + uint32(data[1])<<8
+		fallthrough
+	case 1:
+		h = h + uint32(data[0])
+		h = h * m
+		h = h ^ (h >> 24)
+	}
+
+	return h
+}
@@ -146,3 +146,21 @@ func TestEncodeDecodeMultiObjects(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeLittleEndian(t *testing.T) {
+	// persisted integers are little endian on any machine
+	scratch := EncodeUint32(nil, 0x01020304)
+	scratch = EncodeUint64(scratch, 0x0102030405060708)
+	scratch = EncodeVarInt(scratch, 0x0102)
+	expect := []byte{4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1, 0xf1, 2, 1}
+	if !bytes.Equal(scratch, expect) {
+		t.Fatal("Not in little endian byte order ", scratch)
+	}
+
+	if isNativeLittleEndian() {
+		val, _ := nativeEndian.uint32(scratch)
+		if val != 0x01020304 {
+			t.Error("Native decoder is not little endian ", val)
+		}
+	}
+}
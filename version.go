@@ -6,6 +6,11 @@ import (
 	"strings"
 )
 
+// number of levels in a version
+const kNumLevels = 7
+
+// A file of the db. It is referred to by every live version that holds
+// it, and deleted when no version does
 type FileInfo struct {
 	size   uint32
 	ref    uint32
@@ -23,15 +28,23 @@ func (fi *FileInfo) Unref(fh uint64, set *VersionSet) {
 	case fi.ref > 0:
 		return
 	case fi.ref == 0:
-		// TODO: delete underlying file?
+		// no version refers to the file any more, remove it
 		delete(set.fileMap, fh)
+		if fi.IsLogFile() {
+			set.env.DeleteFile(walFileName(set.name, fh))
+		} else {
+			if set.tables != nil {
+				set.tables.evict(fh)
+			}
+			set.env.DeleteFile(tableFileName(set.name, fh))
+		}
 	default:
 		panic("file reference becomes negative!")
 	}
 }
 
 func (fi *FileInfo) IsLogFile() bool {
-	return fi.minKey == nil && fi.maxKey == nil
+	return len(fi.minKey) == 0 && len(fi.maxKey) == 0
 }
 
 // TODO: should we really skip @ref field?
@@ -45,29 +58,39 @@ func (fi *FileInfo) EncodeTo(scratch []byte) []byte {
 // decode from a byte buffer. Return the remaining slice. If the buffer
 // cannot be decoded, return the original buffer
 func (fi *FileInfo) DecodeFrom(buffer []byte) (res []byte) {
-	fi.size, res = DecodeUint32(buffer)
+	return fi.decodeFrom(buffer, littleEndian)
+}
+
+// decode from a byte buffer whose integers are decoded by @d
+func (fi *FileInfo) decodeFrom(buffer []byte, d decoder) (res []byte) {
+	fi.size, res = d.uint32(buffer)
 	if len(res) == len(buffer) {
 		return
 	}
 
 	oldLen := len(res)
-	fi.minKey, res = DecodeSlice(res)
+	fi.minKey, res = d.slice(res)
 	if len(res) == oldLen {
 		res = buffer
 		return
 	}
 
 	oldLen = len(res)
-	fi.maxKey, res = DecodeSlice(res)
+	fi.maxKey, res = d.slice(res)
 	if len(res) == oldLen {
 		res = buffer
 		return
 	}
 
+	// the buffer may be reused by caller, keep a copy of the keys
+	fi.minKey = append([]byte{}, fi.minKey...)
+	fi.maxKey = append([]byte{}, fi.maxKey...)
 	return
 }
 
-// describe a particular version (snapshot)
+// describe a particular version (snapshot). A version in use by
+// readers is referenced, and never changed: edits are applied to a
+// copy of it. Files of a version are kept until it is released
 type Version struct {
 	lastSequence uint64
 	logFiles     []uint64
@@ -87,31 +110,93 @@ func MakeVersion(set *VersionSet, origin *Version) *Version {
 
 	ret.logFiles = make([]uint64, 0, len(origin.logFiles))
 	for _, fh := range origin.logFiles {
-		fi, ok := set.fileMap[fh]
-		if !ok {
-			panic("Fails to find the file info")
-		}
-
-		fi.Ref()
 		ret.logFiles = append(ret.logFiles, fh)
 	}
 
-	ret.levels = make([][]uint64, 0, len(origin.levels))
-	for _, l := range origin.levels {
+	ret.levels = make([][]uint64, kNumLevels)
+	for i, l := range origin.levels {
 		fs := make([]uint64, 0, len(l))
 		for _, fh := range l {
 			fs = append(fs, fh)
 		}
-		ret.levels = append(ret.levels, fs)
+		ret.levels[i] = fs
 	}
 
+	ret.forEachFile(func(fh uint64, fi *FileInfo) {
+		fi.Ref()
+	})
 	return ret
 }
 
+// call @f on every file of the version
+func (v *Version) forEachFile(f func(fh uint64, fi *FileInfo)) {
+	files := append([]uint64(nil), v.logFiles...)
+	for _, level := range v.levels {
+		files = append(files, level...)
+	}
+
+	for _, fh := range files {
+		fi, ok := v.set.fileMap[fh]
+		if !ok {
+			panic("Fails to find the file info")
+		}
+		f(fh, fi)
+	}
+}
+
+// Pin the version so that it is not changed and its files are kept.
+// Must be called with mutex of the db held
 func (v *Version) Ref() {
 	v.ref = v.ref + 1
 }
 
+// Release a pin of the version. A version that is no longer current
+// is dropped once it is not pinned. Must be called with mutex of the
+// db held
+func (v *Version) Unref() {
+	v.ref = v.ref - 1
+	switch {
+	case v.ref < 0:
+		panic("version reference becomes negative!")
+	case v.ref == 0 && v != v.set.current:
+		v.set.dropVersion(v)
+	}
+}
+
+// return numbers of table files that may hold user key @key, in the
+// order they should be searched: level 0 files from the newest to the
+// oldest, then one file of each other level. Must be called with mutex
+// of the db held
+func (v *Version) filesForKey(user Comparator, key []byte) []uint64 {
+	ret := make([]uint64, 0, 8)
+	for level, files := range v.levels {
+		if level == 0 {
+			for i := len(files) - 1; i >= 0; i-- {
+				fi := v.set.fileMap[files[i]]
+				if user.Compare(key, extractUserKey(fi.minKey)) >= 0 &&
+					user.Compare(key, extractUserKey(fi.maxKey)) <= 0 {
+					ret = append(ret, files[i])
+				}
+			}
+			continue
+		}
+
+		// files of other levels are sorted and do not overlap, find
+		// the first file that does not end before @key
+		idx := sort.Search(len(files), func(i int) bool {
+			fi := v.set.fileMap[files[i]]
+			return user.Compare(extractUserKey(fi.maxKey), key) >= 0
+		})
+		if idx < len(files) {
+			fi := v.set.fileMap[files[idx]]
+			if user.Compare(key, extractUserKey(fi.minKey)) >= 0 {
+				ret = append(ret, files[idx])
+			}
+		}
+	}
+	return ret
+}
+
 func (v *Version) Apply(edit *VersionEdit) {
 	v.lastSequence = edit.lastSequence
 	v.set.nextFileNumber = edit.nextFileNumber
@@ -120,8 +205,9 @@ func (v *Version) Apply(edit *VersionEdit) {
 	logFilesRemoved := make([]uint64, 0, 8)
 
 	for _, add := range edit.adds {
-		fi := &add.info
-		v.set.fileMap[add.fileNumber] = *fi
+		fi := &FileInfo{}
+		*fi = add.info
+		v.set.fileMap[add.fileNumber] = fi
 		fi.Ref()
 		if fi.IsLogFile() {
 			logFilesAdded = append(logFilesAdded, add.fileNumber)
@@ -138,7 +224,7 @@ func (v *Version) Apply(edit *VersionEdit) {
 					for ; idx < last; idx++ {
 						level[idx] = level[idx+1]
 					}
-					v.levels[change.originLevel] = level[:last-1]
+					v.levels[change.originLevel] = level[:last]
 					break
 				}
 			}
@@ -156,23 +242,27 @@ func (v *Version) Apply(edit *VersionEdit) {
 			key := info.minKey
 			size := len(level)
 
-			idx := sort.Search(
-				size,
-				func(i int) bool {
-					fh := level[i]
-					fi, ok := v.set.fileMap[fh]
-					if !ok {
-						panic("Fails to find file handle!")
-					}
-
-					return v.set.comparator.Compare(fi.minKey, key) >= 0
-				})
+			// files in level 0 may overlap with each other, they are
+			// kept in the order they are created. Files in other levels
+			// are sorted by their smallest key
+			idx := size
+			if change.newLevel > 0 {
+				idx = sort.Search(
+					size,
+					func(i int) bool {
+						fh := level[i]
+						fi, ok := v.set.fileMap[fh]
+						if !ok {
+							panic("Fails to find file handle!")
+						}
+
+						return v.set.comparator.Compare(fi.minKey, key) >= 0
+					})
+			}
 
 			// insert the new file number into the correct place
 			level = append(level, uint64(0))
-			for i := idx; i < size; i++ {
-				level[i+1] = level[i]
-			}
+			copy(level[idx+1:], level[idx:size])
 
 			level[idx] = change.fileNumber
 			v.levels[change.newLevel] = level
@@ -239,22 +329,26 @@ func (change *VersionLevelChange) EncodeTo(scratch []byte) []byte {
 }
 
 func (change *VersionLevelChange) DecodeFrom(buffer []byte) []byte {
+	return change.decodeFrom(buffer, littleEndian)
+}
+
+func (change *VersionLevelChange) decodeFrom(buffer []byte, d decoder) []byte {
 	var res []byte
-	change.fileNumber, res = DecodeUint64(buffer)
+	change.fileNumber, res = d.uint64(buffer)
 	if len(buffer) == len(res) {
 		return buffer
 	}
 
 	var val uint32
 	oldLen := len(res)
-	val, res = DecodeUint32(res)
+	val, res = d.uint32(res)
 	if len(res) == oldLen {
 		return buffer
 	}
 	change.originLevel = int32(val)
 
 	oldLen = len(res)
-	val, res = DecodeUint32(res)
+	val, res = d.uint32(res)
 	if len(res) == oldLen {
 		return buffer
 	}
@@ -275,6 +369,16 @@ type VersionEdit struct {
 	versionLevelChanges []VersionLevelChange
 	lastSequence        uint64
 	nextFileNumber      uint64
+	// where compactions of levels start next time. They are not
+	// written into the version log, and only take effect once the
+	// edit is applied
+	compactPointers []compactPointer
+}
+
+// the largest internal key of the last compaction of @level
+type compactPointer struct {
+	level int
+	key   []byte
 }
 
 func (edit *VersionEdit) EncodeTo(scratch []byte) []byte {
@@ -319,23 +423,30 @@ func (edit *VersionEdit) EncodeTo(scratch []byte) []byte {
 // buffer after decoding. If the buffer is malformed and nothing
 // has been decoded, return false as second return value
 func (edit *VersionEdit) DecodeFrom(buffer []byte) (ret []byte, ok bool) {
-	var remaining []byte
+	return edit.decodeFrom(buffer, littleEndian)
+}
+
+// decode an edit whose integers are decoded by @d
+func (edit *VersionEdit) decodeFrom(buffer []byte, d decoder) (ret []byte, ok bool) {
+	var num uint32
+	remaining := buffer
 
 	// decode adds
 	{
-		num, remaining := DecodeUint32(buffer)
-		if len(remaining) == len(buffer) {
+		oldLen := len(remaining)
+		num, remaining = d.uint32(remaining)
+		if len(remaining) == oldLen {
 			return
 		}
 
 		for i := uint32(0); i < num; i++ {
-			key, result := DecodeUint64(remaining)
+			key, result := d.uint64(remaining)
 			if len(result) == len(remaining) {
 				return
 			}
 
 			fi := FileInfo{}
-			result2 := fi.DecodeFrom(result)
+			result2 := fi.decodeFrom(result, d)
 			if len(result2) == len(result) {
 				return
 			}
@@ -349,13 +460,13 @@ func (edit *VersionEdit) DecodeFrom(buffer []byte) (ret []byte, ok bool) {
 	// decode removal
 	{
 		oldLen := len(remaining)
-		num, remaining := DecodeUint32(remaining)
+		num, remaining = d.uint32(remaining)
 		if len(remaining) == oldLen {
 			return
 		}
 
 		for i := uint32(0); i < num; i++ {
-			key, result := DecodeUint64(remaining)
+			key, result := d.uint64(remaining)
 			if len(result) == len(remaining) {
 				return
 			}
@@ -368,7 +479,7 @@ func (edit *VersionEdit) DecodeFrom(buffer []byte) (ret []byte, ok bool) {
 	// decode level changes
 	{
 		oldLen := len(remaining)
-		num, remaining := DecodeUint32(remaining)
+		num, remaining = d.uint32(remaining)
 		if len(remaining) == oldLen {
 			return
 		}
@@ -376,7 +487,7 @@ func (edit *VersionEdit) DecodeFrom(buffer []byte) (ret []byte, ok bool) {
 		for i := uint32(0); i < num; i++ {
 			change := VersionLevelChange{}
 			oldLen = len(remaining)
-			remaining = change.DecodeFrom(remaining)
+			remaining = change.decodeFrom(remaining, d)
 			if len(remaining) == oldLen {
 				return
 			}
@@ -387,7 +498,7 @@ func (edit *VersionEdit) DecodeFrom(buffer []byte) (ret []byte, ok bool) {
 
 	{
 		var result []byte
-		edit.lastSequence, result = DecodeUint64(remaining)
+		edit.lastSequence, result = d.uint64(remaining)
 		if len(result) == len(remaining) {
 			return
 		}
@@ -397,7 +508,7 @@ func (edit *VersionEdit) DecodeFrom(buffer []byte) (ret []byte, ok bool) {
 
 	{
 		var result []byte
-		edit.nextFileNumber, result = DecodeUint64(remaining)
+		edit.nextFileNumber, result = d.uint64(remaining)
 		if len(result) == len(remaining) {
 			return
 		}
@@ -414,35 +525,68 @@ type VersionSet struct {
 	nextFileNumber uint64
 	current        *Version
 	base           *Version
-	fileMap        map[uint64]FileInfo
+	fileMap        map[uint64]*FileInfo
 	env            Env
 	comparator     Comparator
 	log            WritableFile
+	// open tables, closed when their files are deleted
+	tables *tableCache
+	// largest key of the last compaction in each level, next
+	// compaction of the level starts after it
+	compactPointer [kNumLevels][]byte
 }
 
 func MakeVersionSet(name string, env Env, c Comparator) *VersionSet {
 	ret := &VersionSet{}
 
+	// @base heads the list of live versions, and holds no file
 	ret.base = &Version{}
 	ret.base.prev, ret.base.next = ret.base, ret.base
-
-	ret.current = ret.base
+	ret.base.set = ret
 
 	ret.name = name
 	ret.env = env
 	ret.comparator = c
+	ret.fileMap = make(map[uint64]*FileInfo)
+	ret.nextFileNumber = 1
+
+	empty := &Version{}
+	empty.set = ret
+	empty.levels = make([][]uint64, kNumLevels)
+	ret.AddVersion(empty)
+
+	return ret
+}
 
+// allocate a file number for a new file
+func (a *VersionSet) NewFileNumber() uint64 {
+	ret := a.nextFileNumber
+	a.nextFileNumber = a.nextFileNumber + 1
 	return ret
 }
 
+// close the version log file
+func (a *VersionSet) Close() {
+	if a.log != nil {
+		a.log.Close()
+		a.log = nil
+	}
+}
+
+// Make @b the current version. The old current version is dropped
+// unless it is pinned by readers
 func (a *VersionSet) AddVersion(b *Version) {
-	b.next = a.current
-	b.prev = a.current.prev
+	b.next = a.base
+	b.prev = a.base.prev
 
-	a.current.prev = b
+	a.base.prev = b
 	b.prev.next = b
 
+	old := a.current
 	a.current = b
+	if old != nil && old.ref == 0 {
+		a.dropVersion(old)
+	}
 }
 
 func (a *VersionSet) RemoveVersion(b *Version) {
@@ -454,10 +598,23 @@ func (a *VersionSet) RemoveVersion(b *Version) {
 	b.next.prev = b.prev
 }
 
+// remove version @b from the list, and release its files
+func (a *VersionSet) dropVersion(b *Version) {
+	a.RemoveVersion(b)
+	b.forEachFile(func(fh uint64, fi *FileInfo) {
+		fi.Unref(fh, a)
+	})
+}
+
+// Save the edit in version log and apply it on top of current version.
+// The edit always carries the latest sequence number and file number
 func (a *VersionSet) LogAndApply(e *VersionEdit) Status {
 	var log WritableFile
 	var name string
 
+	e.lastSequence = a.lastSequence
+	e.nextFileNumber = a.nextFileNumber
+
 	// create a new version log file if we have not done so
 	if a.log == nil {
 		name = fmt.Sprintf("%s/version_%d.log", a.name, e.nextFileNumber)
@@ -474,8 +631,13 @@ func (a *VersionSet) LogAndApply(e *VersionEdit) Status {
 	{
 		record := make([]byte, 0, 4096)
 		record = e.EncodeTo(record)
-		s := log.Append(record)
+		writer := Writer{log}
+		s := writer.AddRecord(record)
+		if !s.Ok() {
+			return s
+		}
 
+		s = log.Flush()
 		if !s.Ok() {
 			return s
 		}
@@ -488,6 +650,9 @@ func (a *VersionSet) LogAndApply(e *VersionEdit) Status {
 		newVersion.Apply(e)
 		a.AddVersion(newVersion)
 	}
+	for _, p := range e.compactPointers {
+		a.compactPointer[p.level] = p.key
+	}
 
 	// create a new manifest file if we have not done so
 	if a.log == nil {
@@ -502,11 +667,14 @@ func (a *VersionSet) LogAndApply(e *VersionEdit) Status {
 		}
 
 		futureFile.Append([]byte(name))
+		futureFile.Flush()
 		futureFile.Close()
 
-		status = a.env.DeleteFile(manifest)
-		if !status.Ok() {
-			return status
+		if a.env.FileExists(manifest) {
+			status = a.env.DeleteFile(manifest)
+			if !status.Ok() {
+				return status
+			}
 		}
 
 		status = a.env.RenameFile(future, manifest)
@@ -558,7 +726,7 @@ func (a *VersionSet) recoverFromLogFile(name string) Status {
 	defer logFile.Close()
 
 	version := MakeVersion(a, a.current)
-	buffer := [4096]byte{}
+	buffer := make([]byte, 4096)
 	reader := Reader{logFile, 0, true}
 
 	for true {
@@ -575,7 +743,12 @@ func (a *VersionSet) recoverFromLogFile(name string) Status {
 
 		case ReadStatusEOF:
 			a.AddVersion(version)
-			return MakeStatusOk()
+			a.lastSequence = version.lastSequence
+
+			// keep appending new edits to the same version log
+			var s Status
+			a.log, s = a.env.NewWritableFile(name)
+			return s
 
 		case ReadStatusCorruption:
 			return MakeStatusCorruption("")
@@ -0,0 +1,176 @@
+package gdb
+
+// WriteBatch keeps a list of updates in a compact byte representation:
+//
+//	sequence: 8 bytes, sequence number of the first update
+//	count:    4 bytes, number of updates in the batch
+//	updates:  count entries of
+//	            kTypeValue    key value
+//	            kTypeDeletion key
+//
+// where the type takes a single byte, and keys and values are
+// encoded by EncodeSlice. The representation is saved verbatim as a
+// record in write ahead log. Updates in a batch take consecutive
+// sequence numbers
+
+const (
+	// sequence number and count
+	kBatchHeaderSize = 8 + 4
+)
+
+type WriteBatch struct {
+	rep []byte
+}
+
+// create an empty batch
+func MakeWriteBatch() *WriteBatch {
+	ret := &WriteBatch{}
+	ret.Clear()
+	return ret
+}
+
+// rebuild a batch from its byte representation. Return a corruption
+// status if the data is malformed. The batch refers to @data directly
+func WriteBatchFromBytes(data []byte) (*WriteBatch, Status) {
+	if len(data) < kBatchHeaderSize {
+		return nil, MakeStatusCorruption("write batch is too small")
+	}
+
+	ret := &WriteBatch{data}
+	s := ret.Iterate(&batchValidator{})
+	if !s.Ok() {
+		return nil, s
+	}
+
+	return ret, s
+}
+
+// remove all updates from the batch
+func (b *WriteBatch) Clear() {
+	b.rep = make([]byte, kBatchHeaderSize, 256)
+}
+
+// add a key value pair into the batch
+func (b *WriteBatch) Put(key, value []byte) {
+	b.setCount(b.Count() + 1)
+	b.rep = append(b.rep, kTypeValue)
+	b.rep = EncodeSlice(b.rep, key)
+	b.rep = EncodeSlice(b.rep, value)
+}
+
+// add the deletion of a key into the batch
+func (b *WriteBatch) Delete(key []byte) {
+	b.setCount(b.Count() + 1)
+	b.rep = append(b.rep, kTypeDeletion)
+	b.rep = EncodeSlice(b.rep, key)
+}
+
+// return number of updates in the batch
+func (b *WriteBatch) Count() int {
+	count, _ := DecodeUint32(b.rep[8:])
+	return int(count)
+}
+
+func (b *WriteBatch) setCount(count int) {
+	EncodeUint32(b.rep[8:8], uint32(count))
+}
+
+// append all updates in @src to the batch
+func (b *WriteBatch) append(src *WriteBatch) {
+	b.setCount(b.Count() + src.Count())
+	b.rep = append(b.rep, src.rep[kBatchHeaderSize:]...)
+}
+
+// return sequence number of the first update in the batch
+func (b *WriteBatch) Sequence() uint64 {
+	seq, _ := DecodeUint64(b.rep)
+	return seq
+}
+
+func (b *WriteBatch) setSequence(seq uint64) {
+	EncodeUint64(b.rep[:0], seq)
+}
+
+// return the byte representation of the batch
+func (b *WriteBatch) Data() []byte {
+	return b.rep
+}
+
+// return number of bytes of the byte representation
+func (b *WriteBatch) ByteSize() int {
+	return len(b.rep)
+}
+
+// Call @handler for every update in the batch in the order they are
+// added. Return a corruption status if the batch is malformed
+func (b *WriteBatch) Iterate(handler WriteBatchHandler) Status {
+	data := b.rep[kBatchHeaderSize:]
+	found := 0
+
+	for len(data) > 0 {
+		tag := data[0]
+		oldLen := len(data) - 1
+		key, remaining := DecodeSlice(data[1:])
+		if len(remaining) == oldLen {
+			return MakeStatusCorruption("bad key in write batch")
+		}
+
+		switch tag {
+		case kTypeValue:
+			oldLen = len(remaining)
+			var value []byte
+			value, remaining = DecodeSlice(remaining)
+			if len(remaining) == oldLen {
+				return MakeStatusCorruption("bad value in write batch")
+			}
+			handler.Put(key, value)
+
+		case kTypeDeletion:
+			handler.Delete(key)
+
+		default:
+			return MakeStatusCorruption("unknown update type in write batch")
+		}
+
+		found++
+		data = remaining
+	}
+
+	if found != b.Count() {
+		return MakeStatusCorruption("write batch has wrong count")
+	}
+
+	return MakeStatusOk()
+}
+
+// apply all updates in the batch to a memtable
+func (b *WriteBatch) insertInto(mem *MemTable) Status {
+	inserter := &memTableInserter{b.Sequence(), mem}
+	return b.Iterate(inserter)
+}
+
+// a handler that inserts updates into a memtable
+type memTableInserter struct {
+	sequence uint64
+	mem      *MemTable
+}
+
+func (h *memTableInserter) Put(key, value []byte) {
+	h.mem.Add(h.sequence, kTypeValue, key, value)
+	h.sequence++
+}
+
+func (h *memTableInserter) Delete(key []byte) {
+	h.mem.Add(h.sequence, kTypeDeletion, key, nil)
+	h.sequence++
+}
+
+// a handler that does nothing, used to validate a batch
+type batchValidator struct {
+}
+
+func (h *batchValidator) Put(key, value []byte) {
+}
+
+func (h *batchValidator) Delete(key []byte) {
+}
@@ -0,0 +1,150 @@
+package gdb
+
+import (
+	"testing"
+)
+
+// a handler that records updates of a batch as strings
+type recordingHandler struct {
+	updates []string
+}
+
+func (h *recordingHandler) Put(key, value []byte) {
+	h.updates = append(h.updates, "Put("+string(key)+", "+string(value)+")")
+}
+
+func (h *recordingHandler) Delete(key []byte) {
+	h.updates = append(h.updates, "Delete("+string(key)+")")
+}
+
+func TestWriteBatchIterate(t *testing.T) {
+	batch := MakeWriteBatch()
+	if batch.Count() != 0 {
+		t.Error("A new batch should be empty")
+	}
+
+	batch.Put([]byte("foo"), []byte("bar"))
+	batch.Delete([]byte("box"))
+	batch.Put([]byte("baz"), []byte(""))
+	batch.setSequence(100)
+
+	if batch.Count() != 3 || batch.Sequence() != 100 {
+		t.Error("Wrong count or sequence ", batch.Count(), " ", batch.Sequence())
+	}
+
+	expects := []string{"Put(foo, bar)", "Delete(box)", "Put(baz, )"}
+
+	// walk through the original batch and a batch rebuilt from bytes
+	rebuilt, s := WriteBatchFromBytes(batch.Data())
+	if !s.Ok() {
+		t.Fatal("Fails to rebuild a batch ", s.ToString())
+	}
+
+	for _, b := range []*WriteBatch{batch, rebuilt} {
+		h := &recordingHandler{}
+		s := b.Iterate(h)
+		if !s.Ok() {
+			t.Error("Fails to iterate a batch ", s.ToString())
+		}
+
+		if len(h.updates) != len(expects) {
+			t.Fatal("Wrong number of updates ", len(h.updates))
+		}
+
+		for i, e := range expects {
+			if h.updates[i] != e {
+				t.Error("Got ", h.updates[i], " expect ", e)
+			}
+		}
+	}
+
+	if rebuilt.Sequence() != 100 {
+		t.Error("Rebuilt batch has wrong sequence ", rebuilt.Sequence())
+	}
+}
+
+func TestWriteBatchFromBadBytes(t *testing.T) {
+	batch := MakeWriteBatch()
+	batch.Put([]byte("foo"), []byte("bar"))
+	batch.Delete([]byte("box"))
+
+	data := batch.Data()
+
+	// truncated in the middle of an update
+	if _, s := WriteBatchFromBytes(data[:len(data)-1]); !s.IsCorruption() {
+		t.Error("A truncated batch should be rejected")
+	}
+
+	// truncated header
+	if _, s := WriteBatchFromBytes(data[:4]); !s.IsCorruption() {
+		t.Error("A batch without header should be rejected")
+	}
+
+	// bad update type
+	bad := append([]byte{}, data...)
+	bad[kBatchHeaderSize] = 7
+	if _, s := WriteBatchFromBytes(bad); !s.IsCorruption() {
+		t.Error("A batch with bad type should be rejected")
+	}
+}
+
+func TestWriteBatchInsertIntoMemTable(t *testing.T) {
+	mem := MakeMemTable(MakeInternalKeyComparator(&BytesSkiplistOrder{}), nil)
+	defer mem.Release()
+
+	batch := MakeWriteBatch()
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Put([]byte("a"), []byte("2"))
+	batch.Delete([]byte("b"))
+	batch.setSequence(10)
+
+	s := batch.insertInto(mem)
+	if !s.Ok() {
+		t.Error("Fails to insert a batch")
+	}
+
+	// later update in the batch takes a larger sequence number
+	_, value, _ := mem.Get([]byte("a"), 11)
+	if string(value) != "2" {
+		t.Error("Wrong value ", string(value))
+	}
+
+	_, value, _ = mem.Get([]byte("a"), 10)
+	if string(value) != "1" {
+		t.Error("Wrong value ", string(value))
+	}
+
+	tag, _, found := mem.Get([]byte("b"), 12)
+	if !found || tag != kTypeDeletion {
+		t.Error("Fails to find deletion")
+	}
+}
+
+func TestWriteBatchAppend(t *testing.T) {
+	a := MakeWriteBatch()
+	a.Put([]byte("foo"), []byte("bar"))
+
+	b := MakeWriteBatch()
+	b.Delete([]byte("box"))
+	b.Put([]byte("baz"), []byte("qux"))
+
+	a.append(b)
+	a.append(MakeWriteBatch())
+
+	if a.Count() != 3 || b.Count() != 2 {
+		t.Error("Wrong count ", a.Count(), " ", b.Count())
+	}
+
+	h := &recordingHandler{}
+	s := a.Iterate(h)
+	if !s.Ok() {
+		t.Fatal("Fails to iterate a batch ", s.ToString())
+	}
+
+	expects := []string{"Put(foo, bar)", "Delete(box)", "Put(baz, qux)"}
+	for i, e := range expects {
+		if h.updates[i] != e {
+			t.Error("Got ", h.updates[i], " expect ", e)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package gdb
+
+import (
+	"sync/atomic"
+)
+
+// WriteBufferManager keeps track of memory held by memtables of all
+// dbs sharing it, so that processes running many dbs can cap the total
+// memory of memtables. When the memory is over budget, a db flushes
+// its memtable on its next write even if the memtable is not full.
+//
+// Memory of a memtable is mutable until the memtable is switched for a
+// new one, and is freed when the memtable is written into a table file
+// and released. A WriteBufferManager is safe for concurrent use
+type WriteBufferManager struct {
+	bufferSize int64
+	// memory held by all memtables, updated atomically
+	usage int64
+	// memory held by memtables that still take writes, updated
+	// atomically
+	mutable int64
+	// number of memtables that still take writes, updated atomically
+	mutableCount int64
+}
+
+// Create a manager that keeps memtables within @bufferSize bytes
+func MakeWriteBufferManager(bufferSize int) *WriteBufferManager {
+	ret := &WriteBufferManager{}
+	ret.bufferSize = int64(bufferSize)
+	return ret
+}
+
+// Return the budget for memory of memtables
+func (m *WriteBufferManager) BufferSize() int {
+	return int(m.bufferSize)
+}
+
+// Return number of bytes held by memtables
+func (m *WriteBufferManager) MemoryUsage() int {
+	return int(atomic.LoadInt64(&m.usage))
+}
+
+// Return number of bytes held by memtables that still take writes
+func (m *WriteBufferManager) MutableMemoryUsage() int {
+	return int(atomic.LoadInt64(&m.mutable))
+}
+
+// Return true if a memtable should be flushed to bring memory back
+// into budget. Memory of memtables being flushed is freed soon, so it
+// only matters if mutable memtables hold a good part of the budget
+func (m *WriteBufferManager) ShouldFlush() bool {
+	mutable := atomic.LoadInt64(&m.mutable)
+	if mutable > m.bufferSize/8*7 {
+		return true
+	}
+
+	return atomic.LoadInt64(&m.usage) >= m.bufferSize && mutable >= m.bufferSize/2
+}
+
+// Return true if a mutable memtable holding @usage bytes should be
+// flushed. Only memtables holding at least an even share of mutable
+// memory are flushed, so that a db with a small memtable is not made
+// to flush it while another db holds most of the budget. The largest
+// memtable always qualifies
+func (m *WriteBufferManager) ShouldFlushMemTable(usage int) bool {
+	if !m.ShouldFlush() {
+		return false
+	}
+
+	count := atomic.LoadInt64(&m.mutableCount)
+	return count <= 1 || int64(usage)*count >= atomic.LoadInt64(&m.mutable)
+}
+
+// a new memtable takes writes
+func (m *WriteBufferManager) addMemTable() {
+	atomic.AddInt64(&m.mutableCount, 1)
+}
+
+// charge @size bytes newly allocated by a mutable memtable
+func (m *WriteBufferManager) reserveMem(size int) {
+	atomic.AddInt64(&m.usage, int64(size))
+	atomic.AddInt64(&m.mutable, int64(size))
+}
+
+// a memtable holding @size bytes no longer takes writes
+func (m *WriteBufferManager) scheduleFreeMem(size int) {
+	atomic.AddInt64(&m.mutable, -int64(size))
+	atomic.AddInt64(&m.mutableCount, -1)
+}
+
+// release @size bytes of a memtable. @mutable tells if scheduleFreeMem
+// has not been called for the memtable
+func (m *WriteBufferManager) freeMem(size int, mutable bool) {
+	atomic.AddInt64(&m.usage, -int64(size))
+	if mutable {
+		atomic.AddInt64(&m.mutable, -int64(size))
+		atomic.AddInt64(&m.mutableCount, -1)
+	}
+}
@@ -0,0 +1,158 @@
+package gdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestWriteBufferManagerShouldFlush(t *testing.T) {
+	m := MakeWriteBufferManager(8000)
+	m.addMemTable()
+	m.addMemTable()
+
+	m.reserveMem(6000)
+	if m.ShouldFlush() {
+		t.Error("Should not flush under budget")
+	}
+
+	m.reserveMem(1500)
+	if !m.ShouldFlush() {
+		t.Error("Should flush when mutable memory is almost at budget")
+	}
+
+	// being flushed, will be freed soon
+	m.scheduleFreeMem(6000)
+	if m.ShouldFlush() || m.MutableMemoryUsage() != 1500 {
+		t.Error("Should not flush with little mutable memory")
+	}
+
+	m.reserveMem(3000)
+	if !m.ShouldFlush() {
+		t.Error("Should flush when over budget with enough mutable memory")
+	}
+
+	m.freeMem(6000, false)
+	m.freeMem(4500, true)
+	if m.MemoryUsage() != 0 || m.MutableMemoryUsage() != 0 {
+		t.Error("Memory is not freed ", m.MemoryUsage(), " ", m.MutableMemoryUsage())
+	}
+}
+
+func TestWriteBufferManagerShouldFlushMemTable(t *testing.T) {
+	m := MakeWriteBufferManager(8000)
+	m.addMemTable()
+	m.addMemTable()
+
+	m.reserveMem(7000)
+	m.reserveMem(500)
+	if !m.ShouldFlushMemTable(7000) {
+		t.Error("Should flush the memtable holding most of the budget")
+	}
+	if m.ShouldFlushMemTable(500) {
+		t.Error("Should not flush a small memtable")
+	}
+
+	m.scheduleFreeMem(7000)
+	if m.ShouldFlushMemTable(500) {
+		t.Error("Should not flush under budget")
+	}
+}
+
+func TestWriteBufferManagerSharedByDBs(t *testing.T) {
+	const numDBs = 4
+	os.MkdirAll("/tmp/db_test", os.ModePerm)
+
+	// each db alone never fills its memtable
+	manager := MakeWriteBufferManager(256 * 1024)
+	opt := Options{
+		CreateIfMissing:    true,
+		WriteBufferSize:    64 * 1024 * 1024,
+		WriteBufferManager: manager,
+	}
+
+	dbs := make([]DB, numDBs)
+	for i := range dbs {
+		root := fmt.Sprintf("/tmp/db_test/WriteBufferManager%d", i)
+		os.RemoveAll(root)
+
+		var s Status
+		dbs[i], s = Open(root, opt)
+		if !s.Ok() {
+			t.Fatal("Fails to open db ", root, " ", s.ToString())
+		}
+	}
+
+	value := make([]byte, 100)
+	for i := 0; i < 20000; i++ {
+		key := []byte(fmt.Sprintf("key%06d", i))
+		dbs[i%numDBs].Put(WriteOptions{}, key, value)
+
+		// a memtable being flushed may not be freed yet
+		if manager.MemoryUsage() > 2*manager.BufferSize() {
+			t.Fatal("Memtables use too much memory ", manager.MemoryUsage())
+		}
+	}
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		val, s := dbs[i%numDBs].Get(ReadOptions{}, []byte(key))
+		if !s.Ok() || len(val) != len(value) {
+			t.Fatal("Fails to get key ", key)
+		}
+	}
+
+	for _, db := range dbs {
+		waitForCompaction(db)
+		db.Close()
+	}
+
+	if manager.MemoryUsage() != 0 {
+		t.Error("Memory is not returned after close ", manager.MemoryUsage())
+	}
+}
+
+func TestWriteBufferManagerFlushesLargestMemTable(t *testing.T) {
+	os.MkdirAll("/tmp/db_test", os.ModePerm)
+
+	manager := MakeWriteBufferManager(256 * 1024)
+	opt := Options{
+		CreateIfMissing:    true,
+		WriteBufferSize:    64 * 1024 * 1024,
+		WriteBufferManager: manager,
+	}
+
+	dbs := make([]DB, 2)
+	for i := range dbs {
+		root := fmt.Sprintf("/tmp/db_test/WriteBufferManagerLargest%d", i)
+		os.RemoveAll(root)
+
+		var s Status
+		dbs[i], s = Open(root, opt)
+		if !s.Ok() {
+			t.Fatal("Fails to open db ", root, " ", s.ToString())
+		}
+		defer dbs[i].Close()
+	}
+	big, small := dbs[0], dbs[1]
+
+	small.Put(WriteOptions{}, []byte("small0"), []byte("value"))
+
+	// fill the budget with the memtable of the big db
+	value := make([]byte, 100)
+	for i := 0; !manager.ShouldFlush(); i++ {
+		big.Put(WriteOptions{}, []byte(fmt.Sprintf("key%06d", i)), value)
+	}
+
+	small.Put(WriteOptions{}, []byte("small1"), []byte("value"))
+	waitForCompaction(small)
+	if counts := levelFileCounts(small); counts[0] != 0 {
+		t.Error("Small memtable is flushed ", counts)
+	}
+
+	big.Put(WriteOptions{}, []byte("last"), value)
+	waitForCompaction(big)
+	if manager.ShouldFlush() {
+		t.Error("Big memtable is not flushed")
+	}
+}